@@ -0,0 +1,86 @@
+// Package conf holds the storage settings of the silossd json config, siloss
+// reads them from the same file so both work on a data directory alike
+package conf
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"silOSS/backend/storage"
+)
+
+// puts coalesced into one group commit when the config sets none
+const DefaultBatchSize = 64
+
+// Storage is the part of the config the storage options come from
+type Storage struct {
+	SegmentSize int64 `json:"segment_size"`
+	// always, batch or interval
+	WALSync          string   `json:"wal_sync"`
+	WALSyncInterval  Duration `json:"wal_sync_interval"`
+	CompactInterval  Duration `json:"compact_interval"`
+	CompactThreshold float64  `json:"compact_threshold"`
+	CompactThrottle  int64    `json:"compact_throttle"`
+	// puts of small objects coalesced into one group commit, 1 writes
+	// every put on its own
+	BatchSize    int      `json:"batch_size"`
+	BatchLatency Duration `json:"batch_latency"`
+}
+
+// Options returns the storage options of the settings rooted at dir
+func (c *Storage) Options(dir string) (storage.Options, error) {
+	o := storage.DefaultOptions(dir)
+	if c.SegmentSize > 0 {
+		o.SegmentSize = c.SegmentSize
+	}
+	switch strings.ToLower(c.WALSync) {
+	case "", "always":
+		o.WALSync = storage.SyncAlways
+	case "batch":
+		o.WALSync = storage.SyncBatch
+	case "interval":
+		o.WALSync = storage.SyncInterval
+	default:
+		return o, errors.New("unknown wal sync policy " + c.WALSync)
+	}
+	if c.WALSyncInterval.Duration > 0 {
+		o.WALSyncInterval = c.WALSyncInterval.Duration
+	}
+	o.CompactInterval = c.CompactInterval.Duration
+	if c.CompactThreshold > 0 {
+		o.CompactThreshold = c.CompactThreshold
+	}
+	o.CompactThrottle = c.CompactThrottle
+	o.BatchSize = c.BatchSize
+	if o.BatchSize <= 0 {
+		o.BatchSize = DefaultBatchSize
+	}
+	if c.BatchLatency.Duration > 0 {
+		o.BatchLatency = c.BatchLatency.Duration
+	}
+	return o, nil
+}
+
+// Duration reads as a time.ParseDuration string in json and as a flag
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"silOSS/backend/storage"
+)
+
+// open the index file of the data directory, a missing one is not created
+func (e *env) index() (*storage.Index, error) {
+	if _, err := os.Stat(e.opts.IndexPath); err != nil {
+		return nil, err
+	}
+	idx := storage.NewIndex(e.opts.IndexPath, e.opts)
+	if err := idx.Open(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// open the chunk file of unit, a missing one is not created
+func (e *env) chunk(unit uint32) (*storage.Chunk, error) {
+	p := storage.ChunkPath(e.dir, unit)
+	if _, err := os.Stat(p); err != nil {
+		return nil, err
+	}
+	c := storage.NewChunk(p, e.opts)
+	if err := c.Open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func cmdDumpIndex(e *env, args []string) error {
+	fs := e.flags("dump-index")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		fs.Usage()
+		return errUsage
+	}
+	idx, err := e.index()
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+
+	h := idx.Header()
+	w := tabwriter.NewWriter(e.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "version:\t%d\n", h.Version)
+	fmt.Fprintf(w, "slots:\t%d\n", h.Len)
+	fmt.Fprintf(w, "max offset:\t%d\n\n", h.MaxOffset)
+	fmt.Fprintln(w, "SLOT\tCHUNK\tOFFSET\tID")
+	for i, s := range idx.GetSlots() {
+		offset := strconv.FormatInt(s.GetOffset(), 10)
+		if s.IsTombstone() {
+			offset = "deleted"
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\n", i, s.GetChunkUnit(), offset, s.GetFileId())
+	}
+	return w.Flush()
+}
+
+func cmdDumpChunk(e *env, args []string) error {
+	fs := e.flags("dump-chunk")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+	unit, err := strconv.ParseUint(fs.Arg(0), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid chunk number %q", fs.Arg(0))
+	}
+	c, err := e.chunk(uint32(unit))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	h := c.Header()
+	w := tabwriter.NewWriter(e.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "version:\t%d\n", h.Version)
+	fmt.Fprintf(w, "blocks:\t%d\n", h.Sum)
+	fmt.Fprintf(w, "size:\t%d\n", h.Size)
+	fmt.Fprintf(w, "created:\t%s\n", time.Unix(h.CTime, 0).UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "max offset:\t%d\n\n", h.MaxOffset)
+	fmt.Fprintln(w, "OFFSET\tSIZE\tFLAGS\tWRITTEN\tCRC32\tID\tNAME")
+	for offset := int64(storage.ChunkHeaderSize); offset < h.MaxOffset; {
+		err, b := c.ReadBlock(offset)
+		var corrupt *storage.ErrCorrupt
+		name := ""
+		if errors.As(err, &corrupt) && b != nil {
+			// the block is still there to skip over
+			name = " (crc32 mismatch)"
+		} else if err != nil {
+			w.Flush()
+			return fmt.Errorf("block at %d: %v", offset, err)
+		}
+		name = b.Name() + name
+		fmt.Fprintf(w, "%d\t%d\t0x%02x\t%s\t%08x\t%s\t%s\n", offset, b.Size(), uint8(b.Flags()),
+			time.Unix(b.Timestamp(), 0).UTC().Format(time.RFC3339), b.CRC32(), b.ID(), name)
+		offset += b.OnDiskSize()
+	}
+	return w.Flush()
+}
+
+// cmdVerify reads every block the index points at and checks its payload
+// against the crc32 and the id, then checks every key points at a live id
+func cmdVerify(e *env, args []string) error {
+	fs := e.flags("verify")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	// the storage is opened first to replay the write ahead log, the files
+	// are checked once it is closed again
+	s, err := e.open()
+	if err != nil {
+		return err
+	}
+	names := s.List("")
+	for _, b := range s.ListBuckets() {
+		names = append(names, b.List("")...)
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+
+	idx, err := e.index()
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+	live := make(map[storage.ObjectID]storage.IndexSlot)
+	for _, slot := range idx.GetSlots() {
+		if slot.IsTombstone() {
+			delete(live, slot.GetFileId())
+		} else {
+			live[slot.GetFileId()] = slot
+		}
+	}
+	slots := make([]storage.IndexSlot, 0, len(live))
+	for _, slot := range live {
+		slots = append(slots, slot)
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		if slots[i].GetChunkUnit() != slots[j].GetChunkUnit() {
+			return slots[i].GetChunkUnit() < slots[j].GetChunkUnit()
+		}
+		return slots[i].GetOffset() < slots[j].GetOffset()
+	})
+
+	problems := 0
+	report := func(format string, a ...interface{}) {
+		problems++
+		fmt.Fprintf(e.stdout, format+"\n", a...)
+	}
+	chunks := make(map[uint32]*storage.Chunk)
+	defer func() {
+		for _, c := range chunks {
+			c.Close()
+		}
+	}()
+	for _, slot := range slots {
+		unit, offset, id := slot.GetChunkUnit(), slot.GetOffset(), slot.GetFileId()
+		c, ok := chunks[unit]
+		if !ok {
+			if c, err = e.chunk(unit); err != nil {
+				report("%s: chunk %d: %v", id, unit, err)
+				continue
+			}
+			chunks[unit] = c
+		}
+		err, b := c.ReadBlock(offset)
+		var corrupt *storage.ErrCorrupt
+		if errors.As(err, &corrupt) && b != nil {
+			report("%s: chunk %d offset %d: crc32 %08x, want %08x", id, unit, offset,
+				crc32.ChecksumIEEE(b.Payload()), b.CRC32())
+			continue
+		} else if err != nil {
+			report("%s: chunk %d offset %d: %v", id, unit, offset, err)
+			continue
+		}
+		if b.ID() != id {
+			report("%s: chunk %d offset %d: block of id %s", id, unit, offset, b.ID())
+		} else if b.Flags()&storage.FdDeleted != 0 {
+			report("%s: chunk %d offset %d: block marked deleted", id, unit, offset)
+		}
+	}
+	for _, ne := range names {
+		if _, ok := live[ne.ID]; !ok {
+			report("%s/%s: no object %s", ne.Namespace, ne.Key, ne.ID)
+		}
+	}
+
+	fmt.Fprintf(e.stdout, "%d objects, %d keys, %d problems\n", len(slots), len(names), problems)
+	if problems > 0 {
+		return fmt.Errorf("verify found %d problems", problems)
+	}
+	return nil
+}
+
+// cmdFsck prints the fsck report as json, it fails when a problem is left
+// unrepaired
+func cmdFsck(e *env, args []string) error {
+	fs := e.flags("fsck")
+	repair := fs.Bool("repair", false, "cut off torn chunk tails, regenerate a broken index and index orphaned blocks")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	// a repair replays the write ahead log first so blocks in flight at a
+	// crash are rolled forward or back rather than taken for orphans or
+	// torn tails. Opening regenerates a corrupt index, so a plain check
+	// leaves the storage closed; one that does not open is for fsck to tell
+	if *repair {
+		if s, err := e.open(); err == nil {
+			if err := s.Close(); err != nil {
+				return err
+			}
+		} else {
+			fmt.Fprintln(e.stderr, "siloss: open:", err)
+		}
+	}
+
+	err, r := storage.Fsck(e.opts, *repair)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(e.stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		return err
+	}
+	if !r.Clean() {
+		return fmt.Errorf("fsck found %d problems", len(r.Problems))
+	}
+	return nil
+}
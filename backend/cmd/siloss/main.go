@@ -0,0 +1,182 @@
+// siloss works on a silOSS data directory directly: it stores, reads and
+// removes objects, dumps or verifies the index and chunk files and checks
+// and repairs them with fsck. It takes the lock of the data directory, so
+// it refuses to run next to a silossd serving the same directory. Given the
+// config file of that silossd it works the directory with the same storage
+// settings.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"silOSS/backend/cmd/internal/conf"
+	"silOSS/backend/storage"
+	"silOSS/backend/utils/flock"
+)
+
+const (
+	// data directory used when -data is not given
+	dataEnv = "SILOSS_DATA"
+)
+
+var errUsage = errors.New("usage")
+
+type command struct {
+	args string
+	help string
+	run  func(e *env, args []string) error
+}
+
+// set in init, the commands refer back to the table for their usage
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"put":        {"[-bucket b] [-private] <key> [file]", "store file or stdin under key", cmdPut},
+		"get":        {"[-bucket b] <key> [file]", "write the object of key to file or stdout", cmdGet},
+		"stat":       {"[-bucket b] <key>", "show the metadata of key", cmdStat},
+		"ls":         {"[-bucket b] [prefix]", "list the keys starting with prefix", cmdLs},
+		"rm":         {"[-bucket b] <key>", "remove key", cmdRm},
+		"dump-index": {"", "print the index header and every slot", cmdDumpIndex},
+		"dump-chunk": {"<n>", "print the header and every block of chunk n", cmdDumpChunk},
+		"verify":     {"", "check every indexed block and name against its checksum and id", cmdVerify},
+		"fsck":       {"[-repair]", "check every chunk and the index, print a json report", cmdFsck},
+	}
+}
+
+// env of a command run
+type env struct {
+	dir    string
+	opts   storage.Options
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	if err == errUsage {
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "siloss:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("siloss", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	dir := fs.String("data", os.Getenv(dataEnv), "data directory (default $"+dataEnv+")")
+	path := fs.String("config", "", "json config file of silossd, its data dir and storage settings are used")
+	fs.Usage = func() { usage(fs) }
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "siloss: unknown command %q\n", fs.Arg(0))
+		fs.Usage()
+		return errUsage
+	}
+	// the data dir of the config unless one is given
+	var c daemonConfig
+	if *path != "" {
+		b, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &c); err != nil {
+			return fmt.Errorf("%s: %w", *path, err)
+		}
+		given := false
+		fs.Visit(func(f *flag.Flag) { given = given || f.Name == "data" })
+		if !given && c.DataDir != "" {
+			*dir = c.DataDir
+		}
+	}
+	if *dir == "" {
+		return errors.New("no data directory given, set -data or $" + dataEnv)
+	}
+	if fi, err := os.Stat(*dir); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", *dir)
+	}
+
+	lock, err := flock.TryLock(filepath.Join(*dir, storage.LockFileName))
+	if err == flock.ErrLocked {
+		return fmt.Errorf("%s is in use by silossd", *dir)
+	} else if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	opts, err := c.Options(*dir)
+	if err != nil {
+		return err
+	}
+	e := &env{
+		dir:    *dir,
+		opts:   opts,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+	return cmd.run(e, fs.Args()[1:])
+}
+
+// the part of the silossd config siloss reads
+type daemonConfig struct {
+	DataDir string `json:"data_dir"`
+	conf.Storage
+}
+
+func usage(fs *flag.FlagSet) {
+	w := fs.Output()
+	fmt.Fprintln(w, "usage: siloss [-data dir] [-config file] <command> [args]")
+	fs.PrintDefaults()
+	fmt.Fprintln(w, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := commands[name]
+		fmt.Fprintf(w, "  %s\n", strings.TrimSpace(name+" "+c.args))
+		fmt.Fprintf(w, "    \t%s\n", c.help)
+	}
+}
+
+// flag set of a subcommand, its usage line comes from the command table
+func (e *env) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(e.stderr, "usage: siloss %s\n", strings.TrimSpace(name+" "+commands[name].args))
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// open the storage of the data directory, replaying its write ahead log
+func (e *env) open() (*storage.Storage, error) {
+	s := storage.NewStorage(e.opts)
+	if err := s.Open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"silOSS/backend/storage"
+	"silOSS/backend/utils/flock"
+)
+
+// run siloss on dir with stdin, returning what it wrote to stdout
+func siloss(t *testing.T, dir string, stdin string, args ...string) (string, error) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	err := run(append([]string{"-data", dir}, args...), strings.NewReader(stdin), &stdout, &stderr)
+	return stdout.String(), err
+}
+
+func TestObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siloss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out, err := siloss(t, dir, "hello world", "put", "docs/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := storage.HashSha256.Sum([]byte("hello world"))
+	if strings.TrimSpace(out) != id.String() {
+		t.Fatalf("put printed %q, want %s", out, id)
+	}
+	p := filepath.Join(dir, "in.txt")
+	if err := ioutil.WriteFile(p, []byte("bye"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := siloss(t, dir, "", "put", "-private", "docs/bye.txt", p); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := siloss(t, dir, "", "get", "docs/hello.txt"); err != nil || out != "hello world" {
+		t.Fatalf("get %q, %v", out, err)
+	}
+	if out, err := siloss(t, dir, "", "stat", "docs/bye.txt"); err != nil || !strings.Contains(out, "private:  true") {
+		t.Fatalf("stat %q, %v", out, err)
+	}
+	if out, err := siloss(t, dir, "", "ls", "docs/"); err != nil || strings.Count(out, "\n") != 2 {
+		t.Fatalf("ls %q, %v", out, err)
+	}
+	if _, err := siloss(t, dir, "", "rm", "docs/bye.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := siloss(t, dir, "", "get", "docs/bye.txt"); err != storage.ErrKeyNotFound {
+		t.Fatalf("get removed key: %v", err)
+	}
+	if _, err := siloss(t, dir, "", "ls", "-bucket", "photos"); err != storage.ErrBucketNotFound {
+		t.Fatalf("ls of a missing bucket: %v", err)
+	}
+	if _, err := siloss(t, dir, "", "get"); err != errUsage {
+		t.Fatalf("get without a key: %v", err)
+	}
+	if _, err := siloss(t, dir, "", "cp"); err != errUsage {
+		t.Fatalf("unknown command: %v", err)
+	}
+
+	// silossd holds the lock of the data dir
+	lock, err := flock.TryLock(filepath.Join(dir, storage.LockFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := siloss(t, dir, "", "ls"); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("ls under the lock: %v", err)
+	}
+	lock.Unlock()
+}
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siloss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := filepath.Join(dir, "data")
+	if err := os.Mkdir(data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "silossd.json")
+	if err := ioutil.WriteFile(p, []byte(`{"data_dir": "`+data+`", "segment_size": 4096}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the data dir and segment size of the daemon config
+	payload := strings.Repeat("x", 3000)
+	for _, key := range []string{"a", "b", "c"} {
+		var stdout, stderr bytes.Buffer
+		if err := run([]string{"-config", p, "put", key}, strings.NewReader(key+payload), &stdout, &stderr); err != nil {
+			t.Fatalf("put %s: %v, %s", key, err, stderr.String())
+		}
+	}
+	err, units := storage.ListChunkUnits(data)
+	if err != nil || len(units) < 2 {
+		t.Fatalf("chunks %v, %v", units, err)
+	}
+	if out, err := siloss(t, data, "", "get", "c"); err != nil || out != "c"+payload {
+		t.Fatalf("get %d bytes, %v", len(out), err)
+	}
+
+	if err := ioutil.WriteFile(p, []byte(`{"data_dir": "`+data+`", "wal_sync": "sometimes"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"-config", p, "ls"}, nil, &stdout, &stderr); err == nil {
+		t.Fatal("config with an unknown wal sync policy taken")
+	}
+}
+
+func TestDumpAndVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siloss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, k := range []string{"a", "b", "c"} {
+		if _, err := siloss(t, dir, "payload of "+k, "put", k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := siloss(t, dir, "", "rm", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := siloss(t, dir, "", "dump-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// three stores and the tombstone of b
+	if !strings.Contains(out, "slots:       4") || strings.Count(out, "deleted") != 1 {
+		t.Fatalf("dump-index:\n%s", out)
+	}
+	out, err = siloss(t, dir, "", "dump-chunk", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "blocks:      3") || !strings.Contains(out, storage.HashSha256.Sum([]byte("payload of c")).String()) {
+		t.Fatalf("dump-chunk:\n%s", out)
+	}
+	if _, err := siloss(t, dir, "", "dump-chunk", "7"); !os.IsNotExist(err) {
+		t.Fatalf("dump of a missing chunk: %v", err)
+	}
+
+	if out, err := siloss(t, dir, "", "verify"); err != nil {
+		t.Fatalf("verify: %v\n%s", err, out)
+	} else if !strings.HasPrefix(out, "2 objects, 2 keys, 0 problems") {
+		t.Fatalf("verify:\n%s", out)
+	}
+
+	// flip the last payload byte of the chunk, the block of c
+	p := storage.ChunkPath(dir, 1)
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xff
+	if err := ioutil.WriteFile(p, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = siloss(t, dir, "", "verify")
+	if err == nil || !strings.Contains(out, "crc32") || !strings.Contains(out, "1 problems") {
+		t.Fatalf("verify of a corrupt block: %v\n%s", err, out)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siloss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := siloss(t, dir, "payload", "put", "a"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(storage.ChunkPath(dir, 1), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("torn"))
+	f.Close()
+
+	out, err := siloss(t, dir, "", "fsck")
+	if err == nil {
+		t.Fatal("fsck passed a torn tail")
+	}
+	var r storage.FsckReport
+	if err := json.Unmarshal([]byte(out), &r); err != nil {
+		t.Fatalf("%v in %s", err, out)
+	}
+	if len(r.Problems) != 1 || r.Problems[0].Kind != storage.FsckTornTail || r.Problems[0].Repaired {
+		t.Fatalf("report %s", out)
+	}
+	if out, err := siloss(t, dir, "", "fsck", "--repair"); err != nil {
+		t.Fatalf("repair: %v\n%s", err, out)
+	}
+	if out, err := siloss(t, dir, "", "fsck"); err != nil || !strings.Contains(out, `"problems": []`) {
+		t.Fatalf("fsck after repair: %v\n%s", err, out)
+	}
+}
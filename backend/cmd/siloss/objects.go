@@ -0,0 +1,198 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"silOSS/backend/storage"
+)
+
+// the keys of the default namespace or of a bucket
+type objects interface {
+	PutReader(key string, r io.Reader, size int64, flags int8) (error, storage.ObjectID)
+	Stat(key string) (error, storage.NameEntry)
+	Remove(key string) error
+	List(prefix string) []storage.NameEntry
+}
+
+// the default namespace of a storage as objects
+type defaultObjects struct {
+	*storage.Storage
+}
+
+func (o defaultObjects) PutReader(key string, r io.Reader, size int64, flags int8) (error, storage.ObjectID) {
+	return o.StoreReader(key, r, size, flags)
+}
+
+// parse the flags of an object command and open the storage with the
+// namespace named by -bucket, the caller closes the storage
+func (e *env) objects(name string, args []string, nargs int, setup func(fs *flag.FlagSet)) (*storage.Storage, objects, []string, error) {
+	fs := e.flags(name)
+	bucket := fs.String("bucket", "", "bucket of the key, the default namespace when empty")
+	if setup != nil {
+		setup(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, nil, errUsage
+	}
+	if fs.NArg() < nargs || fs.NArg() > nargs+1 {
+		fs.Usage()
+		return nil, nil, nil, errUsage
+	}
+
+	s, err := e.open()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if *bucket == "" {
+		return s, defaultObjects{s}, fs.Args(), nil
+	}
+	err, b := s.GetBucket(*bucket)
+	if err != nil {
+		s.Close()
+		return nil, nil, nil, err
+	}
+	return s, b, fs.Args(), nil
+}
+
+func cmdPut(e *env, args []string) error {
+	var private bool
+	s, o, args, err := e.objects("put", args, 1, func(fs *flag.FlagSet) {
+		fs.BoolVar(&private, "private", false, "store the object private")
+	})
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// a file streams into the chunk, stdin has no size to tell up front and
+	// is spooled to learn it
+	var r io.Reader
+	var size int64
+	if len(args) > 1 && args[1] != "-" {
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		r, size = f, fi.Size()
+	} else {
+		err, f, n := s.Spool(e.stdin)
+		if err != nil {
+			return err
+		}
+		defer s.Unspool(f)
+		r, size = f, n
+	}
+	var flags int8
+	if private {
+		flags |= storage.FdPrivate
+	}
+	err, id := o.PutReader(args[0], r, size, flags)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(e.stdout, id)
+	return nil
+}
+
+func cmdGet(e *env, args []string) error {
+	s, o, args, err := e.objects("get", args, 1, nil)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	err, ne := o.Stat(args[0])
+	if err != nil {
+		return err
+	}
+	// the object streams out a part at a time
+	err, _, _, r := s.Transfer(ne.ID)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if len(args) < 2 || args[1] == "-" {
+		_, err = io.Copy(e.stdout, r)
+		return err
+	}
+	f, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, e.opts.FileMode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(args[1])
+	}
+	return err
+}
+
+func cmdStat(e *env, args []string) error {
+	s, o, args, err := e.objects("stat", args, 1, nil)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	err, ne := o.Stat(args[0])
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(e.stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "key:\t%s\n", ne.Key)
+	if ne.Namespace != "" {
+		fmt.Fprintf(w, "bucket:\t%s\n", ne.Namespace)
+	}
+	fmt.Fprintf(w, "id:\t%s\n", ne.ID)
+	fmt.Fprintf(w, "size:\t%d\n", ne.Size)
+	fmt.Fprintf(w, "flags:\t0x%02x\n", uint8(ne.Flags))
+	fmt.Fprintf(w, "private:\t%t\n", !ne.Public())
+	fmt.Fprintf(w, "modified:\t%s\n", ne.ModTime.UTC().Format(time.RFC3339))
+	if ne.ContentType != "" {
+		fmt.Fprintf(w, "content type:\t%s\n", ne.ContentType)
+	}
+	if ne.ETag != "" {
+		fmt.Fprintf(w, "etag:\t%s\n", ne.ETag)
+	}
+	return w.Flush()
+}
+
+func cmdLs(e *env, args []string) error {
+	s, o, args, err := e.objects("ls", args, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	var prefix string
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+	w := tabwriter.NewWriter(e.stdout, 0, 8, 2, ' ', 0)
+	for _, ne := range o.List(prefix) {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", ne.Size,
+			ne.ModTime.UTC().Format(time.RFC3339), ne.ID, ne.Key)
+	}
+	return w.Flush()
+}
+
+func cmdRm(e *env, args []string) error {
+	s, o, args, err := e.objects("rm", args, 1, nil)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return o.Remove(args[0])
+}
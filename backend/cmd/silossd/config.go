@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"silOSS/backend/cmd/internal/conf"
+	"silOSS/backend/storage"
+)
+
+const (
+	defaultListen          = ":8080"
+	defaultShutdownTimeout = 30 * time.Second
+)
+
+// config of the daemon, read from a json file and overridden by flags
+type config struct {
+	// root of the chunk, index and log files
+	DataDir string `json:"data_dir"`
+	// address of the object http api
+	Listen string `json:"listen"`
+	// address of the s3 gateway, disabled when empty
+	S3Listen string `json:"s3_listen"`
+	// bearer token of the object http api, no auth when empty
+	Token string `json:"token"`
+	// region s3 requests have to be signed for
+	S3Region string `json:"s3_region"`
+	// key pairs s3 requests are signed with, no auth when empty
+	S3Credentials []s3Credential `json:"s3_credentials"`
+	// pid file, the lock file in DataDir when empty. The data dir is
+	// locked through that one whatever the pid file is
+	PidFile string `json:"pid_file"`
+	// time in flight requests get to finish on shutdown
+	ShutdownTimeout conf.Duration `json:"shutdown_timeout"`
+
+	// storage settings, siloss reads them from the same file
+	conf.Storage
+}
+
+type s3Credential struct {
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+}
+
+// loadConfig parses the command line, the file named by -config is read
+// first and every flag given goes over it
+func loadConfig(args []string) (*config, error) {
+	fs := flag.NewFlagSet("silossd", flag.ContinueOnError)
+	path := fs.String("config", "", "path of the json config file")
+	var flags config
+	fs.StringVar(&flags.DataDir, "data", "", "data directory")
+	fs.StringVar(&flags.Listen, "listen", "", "address of the object http api (default "+defaultListen+")")
+	fs.StringVar(&flags.S3Listen, "s3-listen", "", "address of the s3 gateway, disabled when empty")
+	fs.StringVar(&flags.Token, "token", "", "bearer token of the object http api")
+	fs.StringVar(&flags.PidFile, "pid-file", "", "pid file (default <data>/"+storage.LockFileName+")")
+	fs.StringVar(&flags.WALSync, "wal-sync", "", "wal sync policy: always, batch or interval")
+	fs.Var(&flags.CompactInterval, "compact-interval", "time between compaction passes, 0 disables them")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := new(config)
+	if *path != "" {
+		b, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, c); err != nil {
+			return nil, err
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "data":
+			c.DataDir = flags.DataDir
+		case "listen":
+			c.Listen = flags.Listen
+		case "s3-listen":
+			c.S3Listen = flags.S3Listen
+		case "token":
+			c.Token = flags.Token
+		case "pid-file":
+			c.PidFile = flags.PidFile
+		case "wal-sync":
+			c.WALSync = flags.WALSync
+		case "compact-interval":
+			c.CompactInterval = flags.CompactInterval
+		}
+	})
+
+	if c.DataDir == "" {
+		return nil, errors.New("no data directory given")
+	}
+	if c.Listen == "" {
+		c.Listen = defaultListen
+	}
+	if c.PidFile == "" {
+		c.PidFile = filepath.Join(c.DataDir, storage.LockFileName)
+	}
+	if c.ShutdownTimeout.Duration <= 0 {
+		c.ShutdownTimeout.Duration = defaultShutdownTimeout
+	}
+	return c, nil
+}
+
+// storage options of the config
+func (c *config) options() (storage.Options, error) {
+	return c.Storage.Options(c.DataDir)
+}
@@ -0,0 +1,129 @@
+// silossd serves a silOSS data directory over the object http api and,
+// when configured, the s3 gateway
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"silOSS/backend/service"
+	"silOSS/backend/storage"
+	"silOSS/backend/utils/flock"
+)
+
+func main() {
+	c, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "silossd:", err)
+		os.Exit(2)
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	if err := run(c, stop); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run serves until a signal comes in on stop, then drains the servers and
+// closes the storage
+func run(c *config, stop <-chan os.Signal) error {
+	opts, err := c.options()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.DataDir, opts.DirMode); err != nil {
+		return err
+	}
+	// siloss takes the same lock, a pid file elsewhere can't keep either out
+	lockPath, err := filepath.Abs(filepath.Join(c.DataDir, storage.LockFileName))
+	if err != nil {
+		return err
+	}
+	lock, err := flock.TryLockPid(lockPath)
+	if err == flock.ErrLocked {
+		return fmt.Errorf("%s is in use by another silossd", c.DataDir)
+	} else if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if abs, _ := filepath.Abs(c.PidFile); abs != lockPath {
+		pid := []byte(strconv.Itoa(os.Getpid()) + "\n")
+		if err := ioutil.WriteFile(c.PidFile, pid, opts.FileMode); err != nil {
+			return err
+		}
+		defer os.Remove(c.PidFile)
+	}
+
+	s := storage.NewStorage(opts)
+	if err := s.Open(); err != nil {
+		return err
+	}
+
+	api := service.NewServer(s)
+	api.Token = c.Token
+	servers := []*http.Server{{Addr: c.Listen, Handler: api}}
+	if c.S3Listen != "" {
+		g := service.NewS3Gateway(s)
+		if c.S3Region != "" {
+			g.Region = c.S3Region
+		}
+		for _, cred := range c.S3Credentials {
+			g.AddCredential(cred.AccessKey, cred.SecretKey)
+		}
+		servers = append(servers, &http.Server{Addr: c.S3Listen, Handler: g})
+	}
+
+	errc := make(chan error, len(servers))
+	for _, srv := range servers {
+		l, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			shutdown(servers, c)
+			s.Close()
+			return err
+		}
+		log.Printf("silossd: serving %s on %s", c.DataDir, l.Addr())
+		go func(srv *http.Server) {
+			if err := srv.Serve(l); err != http.ErrServerClosed {
+				errc <- err
+			}
+		}(srv)
+	}
+
+	select {
+	case sig := <-stop:
+		log.Printf("silossd: %v, shutting down", sig)
+		err = nil
+	case err = <-errc:
+		log.Printf("silossd: %v, shutting down", err)
+	}
+	if e := shutdown(servers, c); e != nil && err == nil {
+		err = e
+	}
+	if e := s.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// stop taking connections and wait for the requests in flight, up to the
+// shutdown timeout
+func shutdown(servers []*http.Server, c *config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout.Duration)
+	defer cancel()
+	var err error
+	for _, srv := range servers {
+		if e := srv.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
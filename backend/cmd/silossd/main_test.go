@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"silOSS/backend/cmd/internal/conf"
+	"silOSS/backend/storage"
+	"silOSS/backend/utils/flock"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "silossd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "silossd.json")
+	err = ioutil.WriteFile(p, []byte(`{
+		"data_dir": "/var/lib/siloss",
+		"listen": ":9000",
+		"wal_sync": "batch",
+		"compact_interval": "1m",
+		"batch_latency": "5ms",
+		"s3_credentials": [{"access_key": "ak", "secret_key": "sk"}]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadConfig([]string{"-config", p, "-listen", ":9001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DataDir != "/var/lib/siloss" || c.Listen != ":9001" || c.CompactInterval.Duration != time.Minute {
+		t.Fatalf("config %+v", c)
+	}
+	if c.PidFile != "/var/lib/siloss/silossd.pid" || len(c.S3Credentials) != 1 {
+		t.Fatalf("config %+v", c)
+	}
+	opts, err := c.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.WALSync != storage.SyncBatch || opts.CompactInterval != time.Minute {
+		t.Fatalf("options %+v", opts)
+	}
+	if opts.BatchSize != conf.DefaultBatchSize || opts.BatchLatency != 5*time.Millisecond {
+		t.Fatalf("options %+v", opts)
+	}
+	c.BatchSize = 1
+	if opts, _ = c.options(); opts.BatchSize != 1 {
+		t.Fatalf("batching not turned off, options %+v", opts)
+	}
+
+	if _, err := loadConfig(nil); err == nil {
+		t.Fatal("config without a data dir")
+	}
+	c, _ = loadConfig([]string{"-data", dir, "-wal-sync", "sometimes"})
+	if _, err := c.options(); err == nil {
+		t.Fatal("unknown wal sync policy taken")
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "silossd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := loadConfig([]string{"-data", dir, "-listen", "127.0.0.1:0", "-s3-listen", "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan os.Signal, 1)
+	done := make(chan error)
+	go func() { done <- run(c, stop) }()
+
+	// a second daemon on the same data dir is turned away by the lock
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := ioutil.ReadFile(c.PidFile)
+		if len(b) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("pid file not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := run(c, make(chan os.Signal)); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("second run: %v", err)
+	}
+
+	stop <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no shutdown on SIGTERM")
+	}
+	if b, _ := ioutil.ReadFile(c.PidFile); len(b) != 0 {
+		t.Fatalf("pid file left with %q", b)
+	}
+}
+
+func TestRun_PidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "silossd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, pid := filepath.Join(dir, "data"), filepath.Join(dir, "run", "silossd.pid")
+	os.Mkdir(filepath.Dir(pid), 0755)
+	c, err := loadConfig([]string{"-data", data, "-listen", "127.0.0.1:0", "-pid-file", pid})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan os.Signal, 1)
+	done := make(chan error)
+	go func() { done <- run(c, stop) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := ioutil.ReadFile(pid)
+		if len(b) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("pid file not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the data dir is locked whatever the pid file is
+	if _, err := flock.TryLock(filepath.Join(data, storage.LockFileName)); err != flock.ErrLocked {
+		t.Fatalf("lock of the data dir: %v", err)
+	}
+	other, _ := loadConfig([]string{"-data", data, "-listen", "127.0.0.1:0", "-pid-file", filepath.Join(dir, "other.pid")})
+	if err := run(other, make(chan os.Signal)); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("second run: %v", err)
+	}
+
+	stop <- syscall.SIGTERM
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pid); !os.IsNotExist(err) {
+		t.Fatalf("pid file left: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// a byte range of an object asked for by a Range header
+type httpRange struct {
+	start, length int64
+}
+
+func (ra httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", ra.start, ra.start+ra.length-1, size)
+}
+
+func (ra httpRange) header(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {ra.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+var (
+	errMalformedRange = errors.New("malformed range")
+	// every range starts past the end of the object
+	errNoOverlap = errors.New("invalid range: failed to overlap")
+)
+
+// parseRange parses the byte ranges of a Range header against an object of
+// size bytes, see RFC 7233. Ranges reaching past the end are cut there,
+// those starting past it are dropped, errNoOverlap when none is left. No
+// ranges for an empty header
+func parseRange(s string, size int64) ([]httpRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errMalformedRange
+	}
+	ranges := make([]httpRange, 0)
+	noOverlap := false
+	for _, spec := range strings.Split(s[len(b):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.IndexByte(spec, '-')
+		if i < 0 {
+			return nil, errMalformedRange
+		}
+		first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		var ra httpRange
+		if first == "" {
+			// a suffix, the last bytes of the object
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errMalformedRange
+			}
+			if n == 0 {
+				noOverlap = true
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			ra.start, ra.length = size-n, n
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errMalformedRange
+			}
+			if start >= size {
+				noOverlap = true
+				continue
+			}
+			ra.start, ra.length = start, size-start
+			if last != "" {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, errMalformedRange
+				}
+				if end < size-1 {
+					ra.length = end - start + 1
+				}
+			}
+		}
+		ranges = append(ranges, ra)
+	}
+	if len(ranges) == 0 && noOverlap {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+// the ranges the request asks for, nil for the whole object: for a Range
+// header on anything but a GET or HEAD, under an If-Range the object no
+// longer matches, or ranges adding up to more than the object, which a
+// client gets cheaper as a whole
+func requestRanges(r *http.Request, size int64, etag, modTime string) ([]httpRange, error) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil, nil
+	}
+	if ir := r.Header.Get("If-Range"); ir != "" && ir != etag && (modTime == "" || ir != modTime) {
+		return nil, nil
+	}
+	ranges, err := parseRange(r.Header.Get("Range"), size)
+	if err != nil {
+		return nil, err
+	}
+	var sum int64
+	for _, ra := range ranges {
+		sum += ra.length
+	}
+	if sum > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// the size of a multipart/byteranges body of the ranges
+func multipartSize(boundary string, ranges []httpRange, contentType string, size int64) int64 {
+	var cw countingWriter
+	mw := multipart.NewWriter(&cw)
+	mw.SetBoundary(boundary)
+	for _, ra := range ranges {
+		mw.CreatePart(ra.header(contentType, size))
+		cw += countingWriter(ra.length)
+	}
+	mw.Close()
+	return int64(cw)
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
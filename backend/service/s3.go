@@ -0,0 +1,594 @@
+package service
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"silOSS/backend/storage"
+)
+
+const (
+	s3Namespace     = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat    = "2006-01-02T15:04:05.000Z"
+	requestIdHeader = "X-Amz-Request-Id"
+	defaultRegion   = "us-east-1"
+	uploadsDirName  = "uploads"
+	maxListKeys     = 1000
+)
+
+// S3Gateway serves a Storage over the s3 rest api with path style
+// addressing, /<bucket>/<key>. Requests are checked against the added
+// credentials with sigv4, with none added every request is let through
+type S3Gateway struct {
+	s *storage.Storage
+	// region requests have to be signed for
+	Region string
+	// secret keys by access key
+	creds   map[string]string
+	mu      sync.RWMutex
+	uploads *uploads
+	// clock the request dates are checked against
+	now func() time.Time
+}
+
+func NewS3Gateway(s *storage.Storage) *S3Gateway {
+	g := new(S3Gateway)
+	g.s = s
+	g.Region = defaultRegion
+	g.creds = make(map[string]string)
+	opts := s.Options()
+	g.uploads = &uploads{dir: filepath.Join(opts.DataDir, uploadsDirName), fileMode: opts.FileMode, dirMode: opts.DirMode}
+	g.now = time.Now
+	return g
+}
+
+// AddCredential lets requests signed with the key pair in
+func (g *S3Gateway) AddCredential(accessKey, secretKey string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.creds[accessKey] = secretKey
+}
+
+func (g *S3Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(requestIdHeader, newRequestId())
+	anonymous, e := g.authenticate(r)
+	if e != nil {
+		writeS3Error(w, r, e)
+		return
+	}
+	g.mu.RLock()
+	open := len(g.creds) == 0
+	g.mu.RUnlock()
+
+	bucket, key := splitS3Path(r.URL.Path)
+	q := r.URL.Query()
+	if anonymous && !open {
+		// anonymous clients may only read public objects
+		if key == "" || r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeS3Error(w, r, errAccessDenied)
+			return
+		}
+		g.getObject(w, r, bucket, key, true)
+		return
+	}
+
+	switch {
+	case bucket == "":
+		if r.Method != http.MethodGet {
+			writeS3Error(w, r, errMethodNotAllowed)
+			return
+		}
+		g.listBuckets(w, r)
+	case key == "":
+		switch r.Method {
+		case http.MethodPut:
+			g.createBucket(w, r, bucket)
+		case http.MethodHead:
+			if err, _ := g.s.GetBucket(bucket); err != nil {
+				writeS3Error(w, r, s3ErrorOf(err))
+			}
+		case http.MethodDelete:
+			if err := g.s.DeleteBucket(bucket); err != nil {
+				writeS3Error(w, r, s3ErrorOf(err))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet:
+			if _, ok := q["location"]; ok {
+				g.getBucketLocation(w, r, bucket)
+				return
+			}
+			g.listObjects(w, r, bucket)
+		default:
+			writeS3Error(w, r, errMethodNotAllowed)
+		}
+	default:
+		_, isUpload := q["uploadId"]
+		switch r.Method {
+		case http.MethodPut:
+			if r.Header.Get("X-Amz-Copy-Source") != "" {
+				writeS3Error(w, r, errNotImplemented)
+			} else if isUpload {
+				g.uploadPart(w, r, bucket, key)
+			} else {
+				g.putObject(w, r, bucket, key)
+			}
+		case http.MethodGet, http.MethodHead:
+			g.getObject(w, r, bucket, key, false)
+		case http.MethodDelete:
+			if isUpload {
+				g.abortUpload(w, r, bucket, key)
+			} else {
+				g.deleteObject(w, r, bucket, key)
+			}
+		case http.MethodPost:
+			if _, ok := q["uploads"]; ok {
+				g.createUpload(w, r, bucket, key)
+			} else if isUpload {
+				g.completeUpload(w, r, bucket, key)
+			} else {
+				writeS3Error(w, r, errNotImplemented)
+			}
+		default:
+			writeS3Error(w, r, errMethodNotAllowed)
+		}
+	}
+}
+
+// split /<bucket>/<key> into its parts
+func splitS3Path(p string) (bucket, key string) {
+	p = strings.TrimPrefix(p, "/")
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+// the error a failed body read is reported as
+func bodyError(err error) *s3ErrorCode {
+	switch err {
+	case errChunkSignature:
+		return errSignatureDoesNotMatch
+	case errChunkFormat, io.ErrUnexpectedEOF:
+		return errIncompleteBody
+	}
+	if errors.As(err, new(*http.MaxBytesError)) {
+		return errEntityTooLarge
+	}
+	return s3ErrorOf(err)
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Owner   s3Owner
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+var siloOwner = s3Owner{ID: "siloss", DisplayName: "siloss"}
+
+func (g *S3Gateway) listBuckets(w http.ResponseWriter, r *http.Request) {
+	resp := listAllMyBucketsResult{Xmlns: s3Namespace, Owner: siloOwner, Buckets: []s3Bucket{}}
+	for _, b := range g.s.ListBuckets() {
+		resp.Buckets = append(resp.Buckets, s3Bucket{Name: b.Name, CreationDate: b.Created.UTC().Format(s3TimeFormat)})
+	}
+	writeXML(w, &resp)
+}
+
+// buckets are private unless created with a public acl
+func (g *S3Gateway) createBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	cfg := storage.BucketConfig{Private: true}
+	switch r.Header.Get("X-Amz-Acl") {
+	case "public-read", "public-read-write":
+		cfg.Private = false
+	}
+	if err := g.s.CreateBucket(bucket, cfg); err != nil {
+		writeS3Error(w, r, s3ErrorOf(err))
+		return
+	}
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+}
+
+type locationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Region  string   `xml:",chardata"`
+}
+
+func (g *S3Gateway) getBucketLocation(w http.ResponseWriter, r *http.Request, bucket string) {
+	if err, _ := g.s.GetBucket(bucket); err != nil {
+		writeS3Error(w, r, s3ErrorOf(err))
+		return
+	}
+	writeXML(w, &locationConstraint{Xmlns: s3Namespace, Region: g.Region})
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+// ListObjectsV2, keys are rolled up into common prefixes at the delimiter.
+// The continuation token is the last key or prefix handed out, tagged so a
+// prefix skips everything under it
+func (g *S3Gateway) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	err, b := g.s.GetBucket(bucket)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorOf(err))
+		return
+	}
+	q := r.URL.Query()
+	resp := listBucketResult{
+		Xmlns:             s3Namespace,
+		Name:              bucket,
+		Prefix:            q.Get("prefix"),
+		Delimiter:         q.Get("delimiter"),
+		MaxKeys:           maxListKeys,
+		ContinuationToken: q.Get("continuation-token"),
+		StartAfter:        q.Get("start-after"),
+	}
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeS3Error(w, r, errInvalidArgument)
+			return
+		}
+		if n < maxListKeys {
+			resp.MaxKeys = n
+		}
+	}
+	urlEncode := q.Get("encoding-type") == "url"
+	if urlEncode {
+		resp.EncodingType = "url"
+	}
+
+	after, skipPrefix := resp.StartAfter, false
+	if resp.ContinuationToken != "" {
+		t, err := base64.RawURLEncoding.DecodeString(resp.ContinuationToken)
+		if err != nil || len(t) == 0 {
+			writeS3Error(w, r, errInvalidArgument)
+			return
+		}
+		after, skipPrefix = string(t[1:]), t[0] == 'p'
+	}
+
+	var last string
+	lastIsPrefix := false
+	for _, e := range b.List(resp.Prefix) {
+		if e.Key <= after || skipPrefix && strings.HasPrefix(e.Key, after) {
+			continue
+		}
+		cp := ""
+		if resp.Delimiter != "" {
+			if i := strings.Index(e.Key[len(resp.Prefix):], resp.Delimiter); i >= 0 {
+				cp = e.Key[:len(resp.Prefix)+i+len(resp.Delimiter)]
+			}
+		}
+		if cp != "" && lastIsPrefix && cp == last {
+			continue
+		}
+		if resp.KeyCount == resp.MaxKeys {
+			resp.IsTruncated = true
+			break
+		}
+		resp.KeyCount++
+		if cp != "" {
+			last, lastIsPrefix = cp, true
+			resp.CommonPrefixes = append(resp.CommonPrefixes, s3CommonPrefix{Prefix: encodeKey(cp, urlEncode)})
+			continue
+		}
+		last, lastIsPrefix = e.Key, false
+		resp.Contents = append(resp.Contents, s3Object{
+			Key:          encodeKey(e.Key, urlEncode),
+			LastModified: e.ModTime.UTC().Format(s3TimeFormat),
+			ETag:         strconv.Quote(entryETag(&e)),
+			Size:         e.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	if resp.IsTruncated {
+		tag := "k"
+		if lastIsPrefix {
+			tag = "p"
+		}
+		resp.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(tag + last))
+	}
+	resp.Prefix = encodeKey(resp.Prefix, urlEncode)
+	resp.Delimiter = encodeKey(resp.Delimiter, urlEncode)
+	resp.StartAfter = encodeKey(resp.StartAfter, urlEncode)
+	writeXML(w, &resp)
+}
+
+func encodeKey(k string, urlEncode bool) string {
+	if urlEncode {
+		return url.QueryEscape(k)
+	}
+	return k
+}
+
+func entryETag(e *storage.NameEntry) string {
+	if e.ETag != "" {
+		return e.ETag
+	}
+	return e.ID.String()
+}
+
+// flags an object is stored with, on top of the bucket defaults
+func aclFlags(r *http.Request) int8 {
+	if r.Header.Get("X-Amz-Acl") == "private" {
+		return storage.FdPrivate
+	}
+	return storage.FdNullFlags
+}
+
+// checkBody checks a body read up to its end against the length and the
+// Content-MD5 the request gave
+func checkBody(r *http.Request, size int64, sum []byte) error {
+	if r.ContentLength >= 0 && size != r.ContentLength {
+		return errIncompleteBody
+	}
+	if v := r.Header.Get("Content-Md5"); v != "" {
+		want, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(want) != md5.Size {
+			return errInvalidDigest
+		}
+		if !bytes.Equal(sum, want) {
+			return errBadDigest
+		}
+	}
+	return nil
+}
+
+// the body is spooled to disk with its md5 taken on the way, the sha256 or
+// chunk signatures are checked as it is read, see authenticate. Nothing is
+// stored unless the whole body passed
+func (g *S3Gateway) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	err, b := g.s.GetBucket(bucket)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorOf(err))
+		return
+	}
+	h := md5.New()
+	err, f, size := g.s.Spool(io.TeeReader(r.Body, h))
+	if err != nil {
+		writeS3Error(w, r, bodyError(err))
+		return
+	}
+	defer g.s.Unspool(f)
+	sum := h.Sum(nil)
+	if err := checkBody(r, size, sum); err != nil {
+		writeS3Error(w, r, s3ErrorOf(err))
+		return
+	}
+	meta := storage.ObjectMeta{ContentType: r.Header.Get("Content-Type"), ETag: hex.EncodeToString(sum)}
+	if err, _ := b.PutReaderMeta(key, f, size, aclFlags(r), meta); err != nil {
+		writeS3Error(w, r, s3ErrorOf(err))
+		return
+	}
+	w.Header().Set("ETag", strconv.Quote(meta.ETag))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *S3Gateway) getObject(w http.ResponseWriter, r *http.Request, bucket, key string, anonymous bool) {
+	err, b := g.s.GetBucket(bucket)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorOf(err))
+		return
+	}
+	err, e := b.Stat(key)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorOf(err))
+		return
+	}
+	if anonymous && !e.Public() {
+		writeS3Error(w, r, errAccessDenied)
+		return
+	}
+	if err := sendObject(w, r, g.s, e.ID, &e); err != nil {
+		writeS3Error(w, r, s3ErrorOf(err))
+	}
+}
+
+// deleting a key that is not there succeeds as well
+func (g *S3Gateway) deleteObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	err, b := g.s.GetBucket(bucket)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorOf(err))
+		return
+	}
+	if err := b.Remove(key); err != nil && !errors.Is(err, storage.ErrKeyNotFound) {
+		writeS3Error(w, r, s3ErrorOf(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+func (g *S3Gateway) createUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	if err, _ := g.s.GetBucket(bucket); err != nil {
+		writeS3Error(w, r, s3ErrorOf(err))
+		return
+	}
+	info := uploadInfo{
+		Bucket:      bucket,
+		Key:         key,
+		ContentType: r.Header.Get("Content-Type"),
+		Private:     aclFlags(r)&storage.FdPrivate != 0,
+		Initiated:   g.now(),
+	}
+	id, err := g.uploads.create(info)
+	if err != nil {
+		writeS3Error(w, r, errInternalError)
+		return
+	}
+	writeXML(w, &initiateMultipartUploadResult{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadId: id})
+}
+
+// look the upload of the request up and check it is for the bucket and key
+func (g *S3Gateway) upload(r *http.Request, bucket, key string) (string, uploadInfo, *s3ErrorCode) {
+	id := r.URL.Query().Get("uploadId")
+	info, e := g.uploads.info(id)
+	if e == nil && (info.Bucket != bucket || info.Key != key) {
+		e = errNoSuchUpload
+	}
+	return id, info, e
+}
+
+func (g *S3Gateway) uploadPart(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	id, _, e := g.upload(r, bucket, key)
+	if e != nil {
+		writeS3Error(w, r, e)
+		return
+	}
+	n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > maxPartNumber {
+		writeS3Error(w, r, errInvalidArgument)
+		return
+	}
+	etag, err := g.uploads.writePart(id, n, r.Body, func(size int64, sum []byte) error {
+		return checkBody(r, size, sum)
+	})
+	if err != nil {
+		writeS3Error(w, r, bodyError(err))
+		return
+	}
+	w.Header().Set("ETag", strconv.Quote(etag))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *S3Gateway) completeUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	id, info, e := g.upload(r, bucket, key)
+	if e != nil {
+		writeS3Error(w, r, e)
+		return
+	}
+	err, b := g.s.GetBucket(bucket)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorOf(err))
+		return
+	}
+	var req completeMultipartUpload
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		writeS3Error(w, r, errMalformedXML)
+		return
+	}
+	j, e := g.uploads.join(id, req.Parts)
+	if e != nil {
+		writeS3Error(w, r, e)
+		return
+	}
+	var flags int8 = storage.FdNullFlags
+	if info.Private {
+		flags |= storage.FdPrivate
+	}
+	meta := storage.ObjectMeta{ContentType: info.ContentType, ETag: j.etag}
+	err, _ = b.PutReaderMeta(key, j, j.size, flags, meta)
+	j.Close()
+	if err != nil {
+		writeS3Error(w, r, s3ErrorOf(err))
+		return
+	}
+	g.uploads.remove(id)
+	writeXML(w, &completeMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     strconv.Quote(j.etag),
+	})
+}
+
+func (g *S3Gateway) abortUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	id, _, e := g.upload(r, bucket, key)
+	if e != nil {
+		writeS3Error(w, r, e)
+		return
+	}
+	if err := g.uploads.remove(id); err != nil {
+		writeS3Error(w, r, errInternalError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
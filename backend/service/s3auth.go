@@ -0,0 +1,399 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signV4Algorithm = "AWS4-HMAC-SHA256"
+	iso8601Format   = "20060102T150405Z"
+	yyyymmdd        = "20060102"
+	s3Service       = "s3"
+	scopeTerminator = "aws4_request"
+
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	emptySHA256      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// how far the request date may be off the server clock
+	maxClockSkew = 15 * time.Minute
+	// longest a presigned url may be valid for
+	maxPresignExpiry = 7 * 24 * time.Hour
+	// biggest chunk of an aws-chunked body taken
+	maxChunkSize = 16 * 1024 * 1024
+)
+
+var (
+	errChunkSignature = errors.New("chunk signature does not match")
+	errChunkFormat    = errors.New("malformed aws-chunked body")
+)
+
+// the signature of a request and what it was made over
+type sigV4 struct {
+	accessKey     string
+	date          time.Time
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	// signed in the query string instead of the authorization header
+	presigned bool
+	expires   time.Duration
+}
+
+func (sig *sigV4) scope() string {
+	return strings.Join([]string{sig.date.Format(yyyymmdd), sig.region, sig.service, scopeTerminator}, "/")
+}
+
+// parse AWS4-HMAC-SHA256 Credential=<key>/<date>/<region>/s3/aws4_request,
+// SignedHeaders=<h1;h2>, Signature=<hex>
+func parseAuthHeader(r *http.Request) (*sigV4, *s3ErrorCode) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, signV4Algorithm+" ") {
+		return nil, errAuthorizationHeaderMalformed
+	}
+	sig := new(sigV4)
+	var credential string
+	for _, f := range strings.Split(auth[len(signV4Algorithm)+1:], ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) != 2 {
+			return nil, errAuthorizationHeaderMalformed
+		}
+		switch kv[0] {
+		case "Credential":
+			credential = kv[1]
+		case "SignedHeaders":
+			sig.signedHeaders = strings.Split(kv[1], ";")
+		case "Signature":
+			sig.signature = kv[1]
+		}
+	}
+	if credential == "" || sig.signedHeaders == nil || sig.signature == "" {
+		return nil, errAuthorizationHeaderMalformed
+	}
+
+	date := r.Header.Get("X-Amz-Date")
+	if date == "" {
+		date = r.Header.Get("Date")
+	}
+	t, err := time.Parse(iso8601Format, date)
+	if err != nil {
+		if t, err = http.ParseTime(date); err != nil {
+			return nil, errAccessDenied
+		}
+	}
+	sig.date = t.UTC()
+	if e := sig.parseCredential(credential); e != nil {
+		return nil, e
+	}
+	return sig, nil
+}
+
+// parse the X-Amz-* query parameters of a presigned url
+func parsePresigned(q url.Values) (*sigV4, *s3ErrorCode) {
+	if q.Get("X-Amz-Algorithm") != signV4Algorithm {
+		return nil, errAuthorizationHeaderMalformed
+	}
+	sig := &sigV4{presigned: true}
+	t, err := time.Parse(iso8601Format, q.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, errAuthorizationHeaderMalformed
+	}
+	sig.date = t.UTC()
+	expires, err := strconv.ParseInt(q.Get("X-Amz-Expires"), 10, 64)
+	if err != nil || expires < 0 || time.Duration(expires)*time.Second > maxPresignExpiry {
+		return nil, errAuthorizationHeaderMalformed
+	}
+	sig.expires = time.Duration(expires) * time.Second
+	sig.signedHeaders = strings.Split(q.Get("X-Amz-SignedHeaders"), ";")
+	sig.signature = q.Get("X-Amz-Signature")
+	if sig.signature == "" {
+		return nil, errAuthorizationHeaderMalformed
+	}
+	if e := sig.parseCredential(q.Get("X-Amz-Credential")); e != nil {
+		return nil, e
+	}
+	return sig, nil
+}
+
+func (sig *sigV4) parseCredential(credential string) *s3ErrorCode {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != scopeTerminator {
+		return errAuthorizationHeaderMalformed
+	}
+	if parts[1] != sig.date.Format(yyyymmdd) || parts[3] != s3Service {
+		return errAuthorizationHeaderMalformed
+	}
+	sig.accessKey, sig.region, sig.service = parts[0], parts[2], parts[3]
+	return nil
+}
+
+// authenticate checks the signature of the request, a request without one
+// is anonymous. The body is swapped for one that decodes aws-chunked
+// payloads and fails at its end when it does not match the signed hash
+func (g *S3Gateway) authenticate(r *http.Request) (anonymous bool, e *s3ErrorCode) {
+	var sig *sigV4
+	q := r.URL.Query()
+	switch {
+	case r.Header.Get("Authorization") != "":
+		sig, e = parseAuthHeader(r)
+	case q.Get("X-Amz-Signature") != "":
+		sig, e = parsePresigned(q)
+	default:
+		return true, nil
+	}
+	if e != nil {
+		return false, e
+	}
+
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	if sig.presigned || payload == "" {
+		payload = unsignedPayload
+	}
+	secret, known, open := g.secret(sig.accessKey)
+	if !known && !open {
+		return false, errInvalidAccessKeyId
+	}
+
+	if known {
+		now := g.now().UTC()
+		if sig.presigned {
+			if now.Before(sig.date.Add(-maxClockSkew)) || now.After(sig.date.Add(sig.expires)) {
+				return false, errAccessDenied
+			}
+		} else if d := now.Sub(sig.date); d > maxClockSkew || d < -maxClockSkew {
+			return false, errRequestTimeTooSkewed
+		}
+		if g.Region != "" && sig.region != g.Region {
+			return false, errAuthorizationHeaderMalformed
+		}
+		want := signature(signingKey(secret, sig), stringToSign(sig, canonicalRequest(r, sig, payload)))
+		if subtle.ConstantTimeCompare([]byte(want), []byte(sig.signature)) != 1 {
+			return false, errSignatureDoesNotMatch
+		}
+	}
+
+	switch payload {
+	case unsignedPayload:
+	case streamingPayload:
+		cr := &chunkedReader{r: bufio.NewReader(r.Body), prevSig: sig.signature, sig: sig}
+		if known {
+			cr.key = signingKey(secret, sig)
+		}
+		if n, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64); err == nil {
+			r.ContentLength = n
+		} else {
+			r.ContentLength = -1
+		}
+		r.Body = readCloser{cr, r.Body}
+	default:
+		want, err := hex.DecodeString(payload)
+		if err != nil || len(want) != sha256.Size {
+			return false, errContentSHA256Mismatch
+		}
+		r.Body = readCloser{&hashingReader{r: r.Body, h: sha256.New(), want: want}, r.Body}
+	}
+	return false, nil
+}
+
+// the secret of the access key, open is set when no key pair is known and
+// no request is checked
+func (g *S3Gateway) secret(accessKey string) (secret string, find, open bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	secret, find = g.creds[accessKey]
+	return secret, find, len(g.creds) == 0
+}
+
+// method \n uri \n query \n headers \n signed headers \n payload hash
+func canonicalRequest(r *http.Request, sig *sigV4, payload string) string {
+	var buf bytes.Buffer
+	buf.WriteString(r.Method)
+	buf.WriteByte('\n')
+	buf.WriteString(awsEscape(r.URL.Path, false))
+	buf.WriteByte('\n')
+
+	q := r.URL.Query()
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		if sig.presigned && k == "X-Amz-Signature" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		vs := q[k]
+		sort.Strings(vs)
+		for _, v := range vs {
+			params = append(params, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	buf.WriteString(strings.Join(params, "&"))
+	buf.WriteByte('\n')
+
+	for _, h := range sig.signedHeaders {
+		buf.WriteString(h)
+		buf.WriteByte(':')
+		switch h {
+		case "host":
+			buf.WriteString(r.Host)
+		case "content-length":
+			buf.WriteString(strconv.FormatInt(r.ContentLength, 10))
+		default:
+			vs := r.Header[http.CanonicalHeaderKey(h)]
+			for i, v := range vs {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				buf.WriteString(strings.Join(strings.Fields(v), " "))
+			}
+		}
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	buf.WriteString(strings.Join(sig.signedHeaders, ";"))
+	buf.WriteByte('\n')
+	buf.WriteString(payload)
+	return buf.String()
+}
+
+func stringToSign(sig *sigV4, canonical string) string {
+	sum := sha256.Sum256([]byte(canonical))
+	return signV4Algorithm + "\n" + sig.date.Format(iso8601Format) + "\n" + sig.scope() + "\n" + hex.EncodeToString(sum[:])
+}
+
+func signingKey(secret string, sig *sigV4) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), sig.date.Format(yyyymmdd))
+	k = hmacSHA256(k, sig.region)
+	k = hmacSHA256(k, sig.service)
+	return hmacSHA256(k, scopeTerminator)
+}
+
+func signature(key []byte, sts string) string {
+	return hex.EncodeToString(hmacSHA256(key, sts))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uri encode as sigv4 wants it: everything but the unreserved characters,
+// and the slash when it separates path segments
+func awsEscape(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			buf.WriteByte(c)
+			continue
+		}
+		buf.WriteByte('%')
+		buf.WriteByte(hexDigits[c>>4])
+		buf.WriteByte(hexDigits[c&0xf])
+	}
+	return buf.String()
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// hashingReader fails at the end of the body if it does not hash to want
+type hashingReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(hr.h.Sum(nil), hr.want) {
+		return n, errContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// chunkedReader decodes an aws-chunked body, every chunk is
+// <hex size>;chunk-signature=<sig>\r\n<data>\r\n and signed over the
+// signature of the one before, the first over the request signature. With
+// no key the signatures are not checked
+type chunkedReader struct {
+	r       *bufio.Reader
+	key     []byte
+	sig     *sigV4
+	prevSig string
+	buf     []byte
+	done    bool
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := cr.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+func (cr *chunkedReader) readChunk() error {
+	line, err := cr.r.ReadString('\n')
+	if err != nil {
+		return errChunkFormat
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	i := strings.Index(line, ";chunk-signature=")
+	if i < 0 {
+		return errChunkFormat
+	}
+	size, err := strconv.ParseInt(line[:i], 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return errChunkFormat
+	}
+	sig := line[i+len(";chunk-signature="):]
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(cr.r, data); err != nil || !bytes.HasSuffix(data, []byte("\r\n")) {
+		return errChunkFormat
+	}
+	data = data[:size]
+
+	if cr.key != nil {
+		sum := sha256.Sum256(data)
+		sts := signV4Algorithm + "-PAYLOAD\n" + cr.sig.date.Format(iso8601Format) + "\n" + cr.sig.scope() + "\n" +
+			cr.prevSig + "\n" + emptySHA256 + "\n" + hex.EncodeToString(sum[:])
+		if subtle.ConstantTimeCompare([]byte(signature(cr.key, sts)), []byte(sig)) != 1 {
+			return errChunkSignature
+		}
+	}
+	cr.prevSig = sig
+	cr.buf = data
+	cr.done = size == 0
+	return nil
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+
+	"silOSS/backend/storage"
+)
+
+// s3ErrorCode is an error as the s3 api reports it
+type s3ErrorCode struct {
+	code    string
+	status  int
+	message string
+}
+
+var (
+	errAccessDenied = &s3ErrorCode{"AccessDenied", http.StatusForbidden,
+		"Access Denied."}
+	errAuthorizationHeaderMalformed = &s3ErrorCode{"AuthorizationHeaderMalformed", http.StatusBadRequest,
+		"The authorization header is malformed."}
+	errBadDigest = &s3ErrorCode{"BadDigest", http.StatusBadRequest,
+		"The Content-MD5 you specified did not match what we received."}
+	errBucketAlreadyOwnedByYou = &s3ErrorCode{"BucketAlreadyOwnedByYou", http.StatusConflict,
+		"Your previous request to create the named bucket succeeded and you already own it."}
+	errBucketNotEmpty = &s3ErrorCode{"BucketNotEmpty", http.StatusConflict,
+		"The bucket you tried to delete is not empty."}
+	errEntityTooLarge = &s3ErrorCode{"EntityTooLarge", http.StatusBadRequest,
+		"Your proposed upload exceeds the maximum allowed object size."}
+	errIncompleteBody = &s3ErrorCode{"IncompleteBody", http.StatusBadRequest,
+		"You did not provide the number of bytes specified by the Content-Length HTTP header."}
+	errInternalError = &s3ErrorCode{"InternalError", http.StatusInternalServerError,
+		"We encountered an internal error. Please try again."}
+	errInvalidAccessKeyId = &s3ErrorCode{"InvalidAccessKeyId", http.StatusForbidden,
+		"The AWS access key ID you provided does not exist in our records."}
+	errInvalidArgument = &s3ErrorCode{"InvalidArgument", http.StatusBadRequest,
+		"Invalid Argument."}
+	errInvalidBucketName = &s3ErrorCode{"InvalidBucketName", http.StatusBadRequest,
+		"The specified bucket is not valid."}
+	errInvalidDigest = &s3ErrorCode{"InvalidDigest", http.StatusBadRequest,
+		"The Content-MD5 you specified is not valid."}
+	errInvalidRange = &s3ErrorCode{"InvalidRange", http.StatusRequestedRangeNotSatisfiable,
+		"The requested range is not satisfiable."}
+	errInvalidPart = &s3ErrorCode{"InvalidPart", http.StatusBadRequest,
+		"One or more of the specified parts could not be found or its entity tag did not match."}
+	errInvalidPartOrder = &s3ErrorCode{"InvalidPartOrder", http.StatusBadRequest,
+		"The list of parts was not in ascending order."}
+	errKeyTooLong = &s3ErrorCode{"KeyTooLongError", http.StatusBadRequest,
+		"Your key is too long."}
+	errMalformedXML = &s3ErrorCode{"MalformedXML", http.StatusBadRequest,
+		"The XML you provided was not well-formed or did not validate against our published schema."}
+	errMethodNotAllowed = &s3ErrorCode{"MethodNotAllowed", http.StatusMethodNotAllowed,
+		"The specified method is not allowed against this resource."}
+	errNoSuchBucket = &s3ErrorCode{"NoSuchBucket", http.StatusNotFound,
+		"The specified bucket does not exist."}
+	errNoSuchKey = &s3ErrorCode{"NoSuchKey", http.StatusNotFound,
+		"The specified key does not exist."}
+	errNoSuchUpload = &s3ErrorCode{"NoSuchUpload", http.StatusNotFound,
+		"The specified multipart upload does not exist."}
+	errNotImplemented = &s3ErrorCode{"NotImplemented", http.StatusNotImplemented,
+		"A header or query you provided implies functionality that is not implemented."}
+	errQuotaExceeded = &s3ErrorCode{"QuotaExceeded", http.StatusForbidden,
+		"The bucket quota would be exceeded."}
+	errServiceUnavailable = &s3ErrorCode{"ServiceUnavailable", http.StatusServiceUnavailable,
+		"The service is unavailable. Please try again."}
+	errRequestTimeTooSkewed = &s3ErrorCode{"RequestTimeTooSkewed", http.StatusForbidden,
+		"The difference between the request time and the server's time is too large."}
+	errSignatureDoesNotMatch = &s3ErrorCode{"SignatureDoesNotMatch", http.StatusForbidden,
+		"The request signature we calculated does not match the signature you provided."}
+	errContentSHA256Mismatch = &s3ErrorCode{"XAmzContentSHA256Mismatch", http.StatusBadRequest,
+		"The provided 'x-amz-content-sha256' header does not match what was computed."}
+)
+
+func (e *s3ErrorCode) Error() string {
+	return e.code + ": " + e.message
+}
+
+// the xml body of an error response
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestId string
+}
+
+// the s3 error a storage error is reported as, the sentinels come first so
+// a missing bucket is not taken for a missing key
+func s3ErrorOf(err error) *s3ErrorCode {
+	var e *s3ErrorCode
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, storage.ErrBucketNotFound):
+		return errNoSuchBucket
+	case errors.Is(err, storage.ErrBucketExists):
+		return errBucketAlreadyOwnedByYou
+	case errors.Is(err, storage.ErrBucketNotEmpty):
+		return errBucketNotEmpty
+	case errors.Is(err, storage.ErrInvalidBucketName):
+		return errInvalidBucketName
+	case errors.Is(err, storage.ErrNotFound):
+		return errNoSuchKey
+	case errors.Is(err, storage.ErrInvalidKey):
+		return errKeyTooLong
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		return errQuotaExceeded
+	case errors.Is(err, storage.ErrClosed):
+		return errServiceUnavailable
+	case errors.Is(err, storage.ErrInvalidRange):
+		return errInvalidRange
+	}
+	return errInternalError
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, e *s3ErrorCode) {
+	resp := s3ErrorResponse{
+		Code:      e.code,
+		Message:   e.message,
+		Resource:  r.URL.Path,
+		RequestId: w.Header().Get(requestIdHeader),
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(&resp)
+}
@@ -0,0 +1,206 @@
+package service
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	uploadInfoFile = "upload.json"
+	maxPartNumber  = 10000
+)
+
+// uploads keeps the parts of multipart uploads in a staging dir, one
+// directory per upload id holding the upload info and a file per part,
+// until the upload is completed into an object or aborted
+type uploads struct {
+	dir string
+	// permissions of the staged files and dirs, those of the storage
+	fileMode, dirMode os.FileMode
+}
+
+type uploadInfo struct {
+	Bucket      string
+	Key         string
+	ContentType string
+	Private     bool
+	Initiated   time.Time
+}
+
+// a part as CompleteMultipartUpload lists it
+type completePart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (u *uploads) path(id string, elem ...string) string {
+	return filepath.Join(append([]string{u.dir, id}, elem...)...)
+}
+
+// upload ids are 32 hex chars, anything else could point out of the dir
+func validUploadId(id string) bool {
+	if len(id) != 2*16 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func (u *uploads) create(info uploadInfo) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	if err := os.MkdirAll(u.path(id), u.dirMode); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(&info)
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(u.path(id, uploadInfoFile), data, u.fileMode); err != nil {
+		os.RemoveAll(u.path(id))
+		return "", err
+	}
+	return id, nil
+}
+
+func (u *uploads) info(id string) (info uploadInfo, e *s3ErrorCode) {
+	if !validUploadId(id) {
+		return info, errNoSuchUpload
+	}
+	data, err := ioutil.ReadFile(u.path(id, uploadInfoFile))
+	if os.IsNotExist(err) {
+		return info, errNoSuchUpload
+	} else if err != nil {
+		return info, errInternalError
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, errInternalError
+	}
+	return info, nil
+}
+
+// write the part aside and rename it in place, a part uploaded again
+// replaces the earlier one. The md5 of the part is its etag, check gets it
+// with the size once r is read up and keeps the part out on an error
+func (u *uploads) writePart(id string, n int, r io.Reader, check func(size int64, sum []byte) error) (string, error) {
+	p := u.path(id, strconv.Itoa(n))
+	f, err := ioutil.TempFile(u.path(id), "part")
+	if err != nil {
+		return "", err
+	}
+	h := md5.New()
+	size, err := io.Copy(f, io.TeeReader(r, h))
+	if err == nil {
+		err = check(size, h.Sum(nil))
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Chmod(u.fileMode); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// joinedUpload streams the parts of an upload one after the other, the
+// caller must close it
+type joinedUpload struct {
+	io.Reader
+	size int64
+	// the md5 of the part md5s followed by the number of parts as s3 does it
+	etag  string
+	files []*os.File
+}
+
+func (j *joinedUpload) Close() error {
+	var err error
+	for _, f := range j.files {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// join checks the listed parts against their etags and opens them as one
+// stream, the parts are read from their files rather than held in memory
+func (u *uploads) join(id string, parts []completePart) (*joinedUpload, *s3ErrorCode) {
+	if len(parts) == 0 {
+		return nil, errMalformedXML
+	}
+	j := new(joinedUpload)
+	readers := make([]io.Reader, 0, len(parts))
+	sums := md5.New()
+	for i, p := range parts {
+		if p.PartNumber < 1 || p.PartNumber > maxPartNumber {
+			j.Close()
+			return nil, errInvalidPart
+		}
+		if i > 0 && p.PartNumber <= parts[i-1].PartNumber {
+			j.Close()
+			return nil, errInvalidPartOrder
+		}
+		f, err := os.Open(u.path(id, strconv.Itoa(p.PartNumber)))
+		if os.IsNotExist(err) {
+			j.Close()
+			return nil, errInvalidPart
+		} else if err != nil {
+			j.Close()
+			return nil, errInternalError
+		}
+		j.files = append(j.files, f)
+		h := md5.New()
+		n, err := io.Copy(h, f)
+		if err != nil {
+			j.Close()
+			return nil, errInternalError
+		}
+		sum := h.Sum(nil)
+		if strings.Trim(p.ETag, `"`) != hex.EncodeToString(sum) {
+			j.Close()
+			return nil, errInvalidPart
+		}
+		j.size += n
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			j.Close()
+			return nil, errInternalError
+		}
+		sums.Write(sum)
+		readers = append(readers, f)
+	}
+	j.Reader = io.MultiReader(readers...)
+	j.etag = fmt.Sprintf("%s-%d", hex.EncodeToString(sums.Sum(nil)), len(parts))
+	return j, nil
+}
+
+func (u *uploads) remove(id string) error {
+	if !validUploadId(id) {
+		return errNoSuchUpload
+	}
+	return os.RemoveAll(u.path(id))
+}
@@ -0,0 +1,372 @@
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"silOSS/backend/storage"
+)
+
+const (
+	// objects of the default namespace, /objects/<key>
+	objectsPrefix = "/objects/"
+	// objects of a bucket, /buckets/<bucket>/<key>
+	bucketsPrefix = "/buckets/"
+	// objects by id, /ids/<hex id>, read only
+	idsPrefix = "/ids/"
+	// the store merkle root, /merkle, and inclusion proofs, /merkle/<hex id>
+	merklePath = "/merkle"
+
+	// header set to "true" on a put to store the object private
+	privateHeader = "X-Siloss-Private"
+	// header carrying the object id
+	idHeader = "X-Siloss-Id"
+)
+
+// Server serves the objects of a Storage over http: PUT stores the request
+// body under the key, GET streams the object straight from its chunk file
+// with sendfile, HEAD tells its metadata and DELETE removes it
+type Server struct {
+	s *storage.Storage
+	// bearer token writes and private reads need, no auth when empty
+	Token string
+}
+
+// the key space a request addresses, the default namespace or a bucket
+type objects interface {
+	PutReader(key string, r io.Reader, size int64, flags int8) (error, storage.ObjectID)
+	Stat(key string) (error, storage.NameEntry)
+	Remove(key string) error
+}
+
+// the default namespace of a storage as objects
+type defaultObjects struct {
+	*storage.Storage
+}
+
+func (o defaultObjects) PutReader(key string, r io.Reader, size int64, flags int8) (error, storage.ObjectID) {
+	return o.StoreReader(key, r, size, flags)
+}
+
+func NewServer(s *storage.Storage) *Server {
+	return &Server{s: s}
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+	switch {
+	case strings.HasPrefix(p, objectsPrefix):
+		srv.serveObject(w, r, defaultObjects{srv.s}, strings.TrimPrefix(p, objectsPrefix))
+	case strings.HasPrefix(p, bucketsPrefix):
+		i := strings.IndexByte(p[len(bucketsPrefix):], '/')
+		if i < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		name, key := p[len(bucketsPrefix):len(bucketsPrefix)+i], p[len(bucketsPrefix)+i+1:]
+		err, b := srv.s.GetBucket(name)
+		if err != nil {
+			storageError(w, err)
+			return
+		}
+		srv.serveObject(w, r, b, key)
+	case strings.HasPrefix(p, idsPrefix):
+		srv.serveId(w, r, strings.TrimPrefix(p, idsPrefix))
+	case p == merklePath || strings.HasPrefix(p, merklePath+"/"):
+		srv.serveMerkle(w, r, strings.TrimPrefix(p[len(merklePath):], "/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (srv *Server) serveObject(w http.ResponseWriter, r *http.Request, o objects, key string) {
+	if key == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		if !srv.authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		srv.put(w, r, o, key)
+	case http.MethodGet, http.MethodHead:
+		err, e := o.Stat(key)
+		if err != nil {
+			storageError(w, err)
+			return
+		}
+		if !e.Public() && !srv.authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		srv.get(w, r, e.ID, &e)
+	case http.MethodDelete:
+		if !srv.authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := o.Remove(key); err != nil {
+			storageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "PUT, GET, HEAD, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (srv *Server) serveId(w http.ResponseWriter, r *http.Request, hex string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// an id says nothing about visibility, only the keys do
+	if !srv.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id, err := storage.ParseObjectID(hex)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	srv.get(w, r, id, nil)
+}
+
+// merkleResponse is the json body of a merkle request, the proof is left
+// out when asked for the root only
+type merkleResponse struct {
+	Root  storage.MerkleHash   `json:"root"`
+	Proof *storage.MerkleProof `json:"proof,omitempty"`
+}
+
+func (srv *Server) serveMerkle(w http.ResponseWriter, r *http.Request, hex string) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// a proof tells where an object sits, as much as an id does
+	if !srv.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var resp merkleResponse
+	if hex == "" {
+		err, root := srv.s.MerkleRoot()
+		if err != nil {
+			storageError(w, err)
+			return
+		}
+		resp.Root = root
+	} else {
+		id, err := storage.ParseObjectID(hex)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err, resp.Proof, resp.Root = srv.s.Prove(id); err != nil {
+			storageError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&resp)
+}
+
+func (srv *Server) put(w http.ResponseWriter, r *http.Request, o objects, key string) {
+	// the body is spooled by the storage before it goes into the chunks and
+	// split into parts when it is large. A chunked one has no length to
+	// stream against, it is spooled here up to its end to learn it
+	body, size := io.Reader(r.Body), r.ContentLength
+	if size < 0 {
+		err, f, n := srv.s.Spool(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer srv.s.Unspool(f)
+		body, size = f, n
+	}
+	var flags int8 = storage.FdNullFlags
+	if r.Header.Get(privateHeader) == "true" {
+		flags |= storage.FdPrivate
+	}
+	err, id := o.PutReader(key, body, size, flags)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	w.Header().Set(idHeader, id.String())
+	w.Header().Set("ETag", strconv.Quote(id.String()))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// stream the object to the client, e carries the key metadata if the
+// object was addressed by one
+func (srv *Server) get(w http.ResponseWriter, r *http.Request, id storage.ObjectID, e *storage.NameEntry) {
+	if err := sendObject(w, r, srv.s, id, e); err != nil {
+		storageError(w, err)
+	}
+}
+
+// send the object with its headers, the payload goes from the chunk file
+// to the socket with sendfile. A Range header gets the ranges it asks for
+// with 206 Partial Content, several of them as multipart/byteranges.
+// Nothing is written when the object cannot be opened or the ranges are
+// not satisfiable
+func sendObject(w http.ResponseWriter, r *http.Request, s *storage.Storage, id storage.ObjectID, e *storage.NameEntry) error {
+	err, name, sz, br := s.Transfer(id)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if br != nil {
+			br.Close()
+		}
+	}()
+
+	h := w.Header()
+	etag, ct := id.String(), ""
+	if e != nil {
+		name = e.Key
+		if e.ETag != "" {
+			etag = e.ETag
+		}
+		ct = e.ContentType
+		h.Set("Last-Modified", e.ModTime.UTC().Format(http.TimeFormat))
+	}
+	// a set content type keeps net/http from sniffing the first bytes
+	// through a buffer
+	if ct == "" {
+		ct = mime.TypeByExtension(path.Ext(name))
+	}
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	h.Set("ETag", strconv.Quote(etag))
+	h.Set(idHeader, id.String())
+	h.Set("Accept-Ranges", "bytes")
+	ranges, err := requestRanges(r, sz, h.Get("ETag"), h.Get("Last-Modified"))
+	if err != nil {
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", sz))
+		return fmt.Errorf("%v: %w", err, storage.ErrInvalidRange)
+	}
+
+	switch len(ranges) {
+	case 0:
+		h.Set("Content-Type", ct)
+		h.Set("Content-Length", strconv.FormatInt(sz, 10))
+		w.WriteHeader(http.StatusOK)
+	case 1:
+		// the reader starts right at the range in the chunk file, once the
+		// block it is cut from passed its crc32
+		ra := ranges[0]
+		if err := br.Narrow(ra.start, ra.length); err != nil {
+			return err
+		}
+		h.Set("Content-Type", ct)
+		h.Set("Content-Range", ra.contentRange(sz))
+		h.Set("Content-Length", strconv.FormatInt(ra.length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+	default:
+		if err := br.Narrow(ranges[0].start, ranges[0].length); err != nil {
+			return err
+		}
+		rr := br
+		br = nil
+		return sendRanges(w, r, s, id, rr, ranges, ct, sz)
+	}
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	// the block reader of each part hands an *io.LimitedReader over its
+	// *os.File to the response writer, which sends it to the tcp conn with
+	// sendfile. A payload failing its crc32 has the tail held back, the
+	// short body makes the server drop the connection
+	io.Copy(w, br)
+	return nil
+}
+
+// send the ranges as a multipart/byteranges body, rr is narrowed to the
+// first one, every other range is opened once the one before it went out
+func sendRanges(w http.ResponseWriter, r *http.Request, s *storage.Storage, id storage.ObjectID, rr *storage.ObjectReader, ranges []httpRange, ct string, sz int64) error {
+	defer func() {
+		if rr != nil {
+			rr.Close()
+		}
+	}()
+	mw := multipart.NewWriter(w)
+	h := w.Header()
+	h.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	h.Set("Content-Length", strconv.FormatInt(multipartSize(mw.Boundary(), ranges, ct, sz), 10))
+	w.WriteHeader(http.StatusPartialContent)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	for i, ra := range ranges {
+		part, err := mw.CreatePart(ra.header(ct, sz))
+		if err != nil {
+			return nil
+		}
+		if i > 0 {
+			if err, _, _, rr = s.TransferRange(id, ra.start, ra.length); err != nil {
+				// the headers are out, the short body drops the connection
+				return nil
+			}
+		}
+		_, err = io.Copy(part, rr)
+		rr.Close()
+		rr = nil
+		if err != nil {
+			return nil
+		}
+	}
+	mw.Close()
+	return nil
+}
+
+// the status a storage error is answered with
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrExists), errors.Is(err, storage.ErrBucketNotEmpty):
+		return http.StatusConflict
+	case errors.Is(err, storage.ErrInvalidKey), errors.Is(err, storage.ErrInvalidBucketName):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, storage.ErrClosed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, storage.ErrInvalidRange):
+		return http.StatusRequestedRangeNotSatisfiable
+	}
+	// a corrupt block, *storage.ErrCorrupt, is a failure of the server too
+	return http.StatusInternalServerError
+}
+
+func storageError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), errorStatus(err))
+}
+
+func (srv *Server) authorized(r *http.Request) bool {
+	if srv.Token == "" {
+		return true
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(srv.Token)) == 1
+}
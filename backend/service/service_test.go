@@ -0,0 +1,360 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"silOSS/backend/storage"
+)
+
+func newTestServer(t *testing.T) (*storage.Storage, *Server, *httptest.Server) {
+	dir, err := ioutil.TempDir("", "silOSS-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := storage.NewStorage(storage.DefaultOptions(dir))
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(s)
+	ts := httptest.NewServer(srv)
+	t.Cleanup(func() {
+		ts.Close()
+		s.Close()
+		os.RemoveAll(dir)
+	})
+	return s, srv, ts
+}
+
+func do(t *testing.T, method, url string, body []byte, header http.Header) *http.Response {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestServer_Object(t *testing.T) {
+	_, _, ts := newTestServer(t)
+	url := ts.URL + "/objects/photos/a.txt"
+	body := bytes.Repeat([]byte("hello "), 1000)
+
+	resp := do(t, http.MethodPut, url, body, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("put status %d", resp.StatusCode)
+	}
+	id := resp.Header.Get(idHeader)
+	if id != storage.HashSha256.Sum(body).String() {
+		t.Fatalf("put id %q", id)
+	}
+
+	resp = do(t, http.MethodGet, url, nil, nil)
+	got, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(got, body) {
+		t.Fatalf("get status %d, %d bytes", resp.StatusCode, len(got))
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("content type %q", ct)
+	}
+
+	resp = do(t, http.MethodHead, url, nil, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(body)) {
+		t.Fatalf("head status %d, length %d", resp.StatusCode, resp.ContentLength)
+	}
+
+	resp = do(t, http.MethodGet, ts.URL+"/ids/"+id, nil, nil)
+	got, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(got, body) {
+		t.Fatalf("get by id status %d", resp.StatusCode)
+	}
+
+	resp = do(t, http.MethodDelete, url, nil, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete status %d", resp.StatusCode)
+	}
+	resp = do(t, http.MethodGet, url, nil, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("get after delete status %d", resp.StatusCode)
+	}
+}
+
+func TestServer_Bucket(t *testing.T) {
+	s, srv, ts := newTestServer(t)
+	srv.Token = "secret"
+	if err := s.CreateBucket("photos", storage.BucketConfig{Private: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateBucket("public", storage.BucketConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	auth := http.Header{"Authorization": {"Bearer secret"}}
+
+	resp := do(t, http.MethodPut, ts.URL+"/buckets/photos/a.jpg", []byte("jpeg"), nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("put without token status %d", resp.StatusCode)
+	}
+	for _, b := range []string{"photos", "public"} {
+		resp = do(t, http.MethodPut, ts.URL+"/buckets/"+b+"/a.jpg", []byte("jpeg"), auth)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("put into %s status %d", b, resp.StatusCode)
+		}
+	}
+
+	resp = do(t, http.MethodGet, ts.URL+"/buckets/photos/a.jpg", nil, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("get private without token status %d", resp.StatusCode)
+	}
+	resp = do(t, http.MethodGet, ts.URL+"/buckets/photos/a.jpg", nil, auth)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("get private status %d", resp.StatusCode)
+	}
+	resp = do(t, http.MethodGet, ts.URL+"/buckets/public/a.jpg", nil, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("get public status %d", resp.StatusCode)
+	}
+	resp = do(t, http.MethodGet, ts.URL+"/buckets/missing/a.jpg", nil, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("get from missing bucket status %d", resp.StatusCode)
+	}
+}
+
+func TestServer_ChunkedPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "silOSS-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := storage.DefaultOptions(dir)
+	opts.SegmentSize = 64 * 1024
+	opts.PartSize = 16 * 1024
+	s := storage.NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ts := httptest.NewServer(NewServer(s))
+	defer ts.Close()
+
+	// a body bigger than a segment with no length given
+	body := bytes.Repeat([]byte("chunked "), 10*1024)
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/objects/big.bin", ioutil.NopCloser(bytes.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = -1
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get(idHeader) != storage.HashSha256.Sum(body).String() {
+		t.Fatalf("chunked put status %d, id %s", resp.StatusCode, resp.Header.Get(idHeader))
+	}
+	err, got := s.Get("big.bin")
+	if err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("read back %d bytes, %v", len(got), err)
+	}
+	// nothing is left in the spool
+	if fs, _ := ioutil.ReadDir(s.Options().SpoolDir); len(fs) != 0 {
+		t.Fatalf("%d spooled files left", len(fs))
+	}
+}
+
+func TestServer_CorruptObject(t *testing.T) {
+	s, _, ts := newTestServer(t)
+	url := ts.URL + "/objects/rotten.txt"
+	body := bytes.Repeat([]byte("bit rot "), 10000)
+	resp := do(t, http.MethodPut, url, body, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("put status %d", resp.StatusCode)
+	}
+
+	// the last payload byte of the only block
+	p := storage.ChunkPath(s.Options().DataDir, 1)
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := f.Stat()
+	f.WriteAt([]byte{'!'}, fi.Size()-1)
+	f.Close()
+
+	resp = do(t, http.MethodGet, url, nil, nil)
+	if got, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Fatalf("corrupt object sent whole, %d bytes", len(got))
+	}
+	resp.Body.Close()
+
+	// a range clear of the bad byte is refused before any header goes out
+	for _, ra := range []string{"bytes=0-99", "bytes=0-9,20-29"} {
+		resp = do(t, http.MethodGet, url, nil, http.Header{"Range": {ra}})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("range %s of a corrupt object status %d", ra, resp.StatusCode)
+		}
+	}
+}
+
+func TestServer_Merkle(t *testing.T) {
+	_, srv, ts := newTestServer(t)
+	srv.Token = "secret"
+	auth := http.Header{"Authorization": {"Bearer secret"}}
+	body := []byte("audited")
+	resp := do(t, http.MethodPut, ts.URL+"/objects/audit.txt", body, auth)
+	resp.Body.Close()
+	id := resp.Header.Get(idHeader)
+
+	resp = do(t, http.MethodGet, ts.URL+"/merkle/"+id, nil, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("proof without auth, status %d", resp.StatusCode)
+	}
+	resp = do(t, http.MethodGet, ts.URL+"/merkle/"+id, nil, auth)
+	var proof merkleResponse
+	err := json.NewDecoder(resp.Body).Decode(&proof)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proof.Proof == nil || proof.Proof.ID != storage.HashSha256.Sum(body) || !proof.Proof.Verify(proof.Root) {
+		t.Fatalf("proof %+v", proof)
+	}
+
+	resp = do(t, http.MethodGet, ts.URL+"/merkle", nil, auth)
+	var root merkleResponse
+	err = json.NewDecoder(resp.Body).Decode(&root)
+	resp.Body.Close()
+	if err != nil || root.Root != proof.Root || root.Proof != nil {
+		t.Fatalf("root %+v, %v", root, err)
+	}
+	resp = do(t, http.MethodGet, ts.URL+"/merkle/"+storage.HashSha256.Sum([]byte("nope")).String(), nil, auth)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("proof of a missing object, status %d", resp.StatusCode)
+	}
+}
+
+func TestServer_ErrorStatus(t *testing.T) {
+	s, _, ts := newTestServer(t)
+	if err := s.CreateBucket("photos", storage.BucketConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, "/buckets/videos/a.mp4", http.StatusNotFound},
+		{http.MethodGet, "/buckets/photos/a.jpg", http.StatusNotFound},
+		{http.MethodDelete, "/objects/a.txt", http.StatusNotFound},
+		{http.MethodPut, "/objects/a%00b", http.StatusBadRequest},
+	} {
+		resp := do(t, c.method, ts.URL+c.path, []byte("x"), nil)
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s %q, status %d, want %d", c.method, c.path, resp.StatusCode, c.status)
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	resp := do(t, http.MethodGet, ts.URL+"/objects/a.txt", nil, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("get from a closed storage, status %d", resp.StatusCode)
+	}
+}
+
+func TestServer_Range(t *testing.T) {
+	_, _, ts := newTestServer(t)
+	url := ts.URL + "/objects/a.txt"
+	body := []byte("0123456789abcdefghij")
+	resp := do(t, http.MethodPut, url, body, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("put status %d", resp.StatusCode)
+	}
+
+	for _, c := range []struct {
+		ranges, contentRange string
+		want                 []byte
+	}{
+		{"bytes=2-5", "bytes 2-5/20", body[2:6]},
+		{"bytes=15-", "bytes 15-19/20", body[15:]},
+		{"bytes=-4", "bytes 16-19/20", body[16:]},
+		{"bytes=18-100", "bytes 18-19/20", body[18:]},
+	} {
+		resp := do(t, http.MethodGet, url, nil, http.Header{"Range": {c.ranges}})
+		got, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(got, c.want) {
+			t.Fatalf("%s: status %d, %q", c.ranges, resp.StatusCode, got)
+		}
+		if cr := resp.Header.Get("Content-Range"); cr != c.contentRange {
+			t.Fatalf("%s: content range %q", c.ranges, cr)
+		}
+	}
+
+	resp = do(t, http.MethodGet, url, nil, http.Header{"Range": {"bytes=0-1,10-12"}})
+	defer resp.Body.Close()
+	mt, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusPartialContent || err != nil || mt != "multipart/byteranges" {
+		t.Fatalf("multi range status %d, content type %q", resp.StatusCode, mt)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for _, want := range []string{"01", "abc"} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := ioutil.ReadAll(part); string(got) != want {
+			t.Fatalf("part %q, want %q", got, want)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Fatalf("parts past the ranges: %v", err)
+	}
+
+	// a range past the end is not satisfiable
+	resp = do(t, http.MethodGet, url, nil, http.Header{"Range": {"bytes=20-"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Content-Range") != "bytes */20" {
+		t.Fatalf("unsatisfiable range, status %d", resp.StatusCode)
+	}
+	// an If-Range the object no longer matches gets all of it
+	resp = do(t, http.MethodGet, url, nil, http.Header{"Range": {"bytes=2-5"}, "If-Range": {`"stale"`}})
+	got, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(got, body) {
+		t.Fatalf("stale if-range, status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultBatchLatency = 2 * time.Millisecond
+
+// batcher coalesces concurrent puts of small objects into group commits:
+// the blocks of a batch go to the chunk in one write with one header
+// update and one fsync, to the index in one append and to the wal and the
+// names in one write each
+type batcher struct {
+	reqs chan *batchReq
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// a put waiting in a batch
+type batchReq struct {
+	e   NameEntry
+	b   *Block
+	err chan error
+}
+
+func (s *Storage) startBatcher() {
+	bt := new(batcher)
+	bt.reqs = make(chan *batchReq)
+	bt.done = make(chan struct{})
+	bt.wg.Add(1)
+	go func() {
+		defer bt.wg.Done()
+		for {
+			select {
+			case <-bt.done:
+				return
+			default:
+			}
+			var batch []*batchReq
+			select {
+			case r := <-bt.reqs:
+				batch = append(batch, r)
+			case <-bt.done:
+				return
+			}
+			t := time.NewTimer(s.opts.BatchLatency)
+		collect:
+			for len(batch) < s.opts.BatchSize {
+				select {
+				case r := <-bt.reqs:
+					batch = append(batch, r)
+				case <-t.C:
+					break collect
+				case <-bt.done:
+					break collect
+				}
+			}
+			t.Stop()
+			s.commitBatch(batch)
+		}
+	}()
+	s.batcher = bt
+}
+
+// stop taking puts, the batch being collected is committed first like any
+// writer in flight
+func (s *Storage) stopBatcher() {
+	if s.batcher == nil {
+		return
+	}
+	close(s.batcher.done)
+	s.batcher.wg.Wait()
+}
+
+// put hands the entry and its block to the batch being collected and waits
+// for the batch to commit
+func (bt *batcher) put(e NameEntry, b *Block) error {
+	r := &batchReq{e: e, b: b, err: make(chan error, 1)}
+	select {
+	case bt.reqs <- r:
+	case <-bt.done:
+		return ErrClosed
+	}
+	return <-r.err
+}
+
+// commit the puts of a batch in order, as put would one after the other
+func (s *Storage) commitBatch(reqs []*batchReq) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	batch := make(map[string]NameEntry)
+	stored := make(map[ObjectID]bool)
+	blocks := make([]*Block, 0, len(reqs))
+	accepted := make([]*batchReq, 0, len(reqs))
+	for _, r := range reqs {
+		if err := s.checkQuota(r.e.Namespace, r.e.Key, r.e.Size, batch); err != nil {
+			r.err <- err
+			continue
+		}
+		find, _ := s.index.find(r.e.ID)
+		if find {
+			if err := s.storedAs(&r.e); err != nil {
+				r.err <- err
+				continue
+			}
+		}
+		batch[nameKey(r.e.Namespace, r.e.Key)] = r.e
+		accepted = append(accepted, r)
+		// content already stored or put earlier in the batch is shared
+		if !find && !stored[r.e.ID] {
+			stored[r.e.ID] = true
+			blocks = append(blocks, r.b)
+		}
+	}
+	if len(accepted) == 0 {
+		return
+	}
+
+	err := s.storeBlocks(blocks)
+	var olds []*NameEntry
+	entries := make([]NameEntry, len(accepted))
+	if err == nil {
+		now := time.Now()
+		for i, r := range accepted {
+			entries[i] = r.e
+			entries[i].ModTime = now
+		}
+		olds, err = s.names.putAll(entries)
+		if err != nil {
+			// the blocks are new, no name but those of the batch maps them
+			for _, b := range blocks {
+				s.deleteObject(b.ID())
+			}
+		}
+	}
+	for i, r := range accepted {
+		if err == nil {
+			r.err <- s.remapped(entries[i], olds[i])
+		} else {
+			r.err <- err
+		}
+	}
+}
+
+// storeBlocks is storeBlock of every block with a group commit per chunk
+// the blocks go to, a batch rolls over to a new chunk like single blocks
+// do. On failure the blocks committed to the chunks before are deleted
+// again, none of the batch is stored. Called under wmu
+func (s *Storage) storeBlocks(bs []*Block) error {
+	all := bs
+	for len(bs) > 0 {
+		s.decideChunk(bs[0].OnDiskSize())
+		end, n := s.currChunk.maxOffset+bs[0].OnDiskSize(), 1
+		for n < len(bs) && end+bs[n].OnDiskSize() <= s.opts.SegmentSize {
+			end += bs[n].OnDiskSize()
+			n++
+		}
+		if err := s.appendBlocks(bs[:n]); err != nil {
+			for _, b := range all[:len(all)-len(bs)] {
+				s.deleteObject(b.ID())
+			}
+			return err
+		}
+		bs = bs[n:]
+	}
+	return nil
+}
+
+// log, append, flush and index the blocks in the current chunk, the blocks
+// are cut off again on failure
+func (s *Storage) appendBlocks(bs []*Block) error {
+	c := s.currChunk
+	unit, err := c.GetChunkUint()
+	if err != nil {
+		return err
+	}
+	start := c.maxOffset
+	logged := make([][]byte, len(bs))
+	offset := start
+	for i, b := range bs {
+		e := walStoreEntry{chunk: unit, offset: offset, size: b.OnDiskSize(), fId: b.ID()}
+		logged[i] = e.bytes()
+		offset += b.OnDiskSize()
+	}
+	seqs, err := s.wal.AppendBatch(walRecordStore, logged)
+	if err != nil {
+		return err
+	}
+
+	err, slots := c.appendBlocks(bs)
+	if err == nil {
+		err = c.Sync()
+	}
+	if err == nil {
+		err = s.index.InsertBatch(slots)
+	}
+	if err != nil {
+		c.truncateBlocks(start, int64(len(bs)))
+		return err
+	}
+
+	commits := make([][]byte, len(seqs))
+	for i, seq := range seqs {
+		commits[i] = seqBytes(seq)
+	}
+	if _, err := s.wal.AppendBatch(walRecordCommit, commits); err != nil {
+		return err
+	}
+	if s.wal.Size() >= walCheckpointSize {
+		return s.checkpoint()
+	}
+	return nil
+}
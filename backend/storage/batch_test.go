@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func batchOptions(t *testing.T) Options {
+	opts := tempOptions(t)
+	opts.SegmentSize = 4096
+	opts.BatchSize = 16
+	opts.BatchLatency = 20 * time.Millisecond
+	return opts
+}
+
+func TestStorage_Batch(t *testing.T) {
+	opts := batchOptions(t)
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	files := make([][]byte, 64)
+	for i := range files {
+		// every fourth file has the content of the one before
+		files[i] = bytes.Repeat([]byte(fmt.Sprintf("file %03d ", i-i%4/3)), 20)
+	}
+
+	var wg sync.WaitGroup
+	for i := range files {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err, id := s.Store(fmt.Sprintf("%d.txt", i), files[i], FdNullFlags); err != nil || id != HashSha256.Sum(files[i]) {
+				t.Errorf("store %d: %s, %v", i, id, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err, units := ListChunkUnits(opts.DataDir); err != nil || len(units) < 2 {
+		t.Fatalf("batches did not roll over, chunks %v, %v", units, err)
+	}
+
+	check := func(s *Storage) {
+		for i, f := range files {
+			if err, got := s.Get(fmt.Sprintf("%d.txt", i)); err != nil || !bytes.Equal(got, f) {
+				t.Fatalf("get %d: %v", i, err)
+			}
+		}
+	}
+	check(s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := s.Store("late.txt", []byte("late"), FdNullFlags); err != ErrClosed {
+		t.Fatalf("store after close: %v", err)
+	}
+
+	if err, r := Fsck(opts, false); err != nil || len(r.Problems) != 0 {
+		t.Fatalf("fsck %+v, %v", r, err)
+	}
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	check(s)
+}
+
+func TestStorage_BatchQuota(t *testing.T) {
+	s := NewStorage(batchOptions(t))
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.CreateBucket("photos", BucketConfig{QuotaObjects: 3}); err != nil {
+		t.Fatal(err)
+	}
+	err, b := s.GetBucket("photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stored, exceeded := 0, 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err, _ := b.Put(fmt.Sprintf("%d.jpg", i), []byte{byte(i)}, FdNullFlags)
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				stored++
+			} else if err == ErrQuotaExceeded {
+				exceeded++
+			} else {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if stored != 3 || exceeded != 5 || b.Usage().Objects != 3 {
+		t.Fatalf("%d stored, %d over the quota, usage %+v", stored, exceeded, b.Usage())
+	}
+}
+
+func TestStorage_BatchStreamed(t *testing.T) {
+	opts := batchOptions(t)
+	opts.BatchSize = 4
+	opts.BatchLatency = time.Hour
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// small streamed puts wait in the batch like any other until it fills
+	done := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			f := []byte(fmt.Sprintf("streamed %d", i))
+			err, _ := s.StoreReader(fmt.Sprintf("%d.txt", i), iotest.OneByteReader(bytes.NewReader(f)), int64(len(f)), FdNullFlags)
+			done <- err
+		}(i)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("streamed put committed on its own: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err, _ := s.Store("3.txt", []byte("stored 3"), FdNullFlags); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err, f := s.Get("2.txt"); err != nil || string(f) != "streamed 2" {
+		t.Fatalf("get %q, %v", f, err)
+	}
+	// the payload is read in full before it joins a batch
+	if err, _ := s.StoreReader("short.txt", bytes.NewReader([]byte("short")), 10, FdNullFlags); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("short payload: %v", err)
+	}
+}
+
+func TestStorage_BatchFailed(t *testing.T) {
+	s := NewStorage(batchOptions(t))
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// the names file goes away under the batch
+	s.names.w.Close()
+
+	files := [][]byte{[]byte("first of the batch"), []byte("second of the batch")}
+	var wg sync.WaitGroup
+	for i := range files {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err, _ := s.Store(fmt.Sprintf("%d.txt", i), files[i], FdNullFlags); err == nil {
+				t.Errorf("store %d with no names file", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	// the blocks of the batch are deleted again, nothing is left behind
+	for _, f := range files {
+		if err, _, _ := s.Read(HashSha256.Sum(f)); !errors.Is(err, ErrObjectNotFound) {
+			t.Fatalf("block of a failed batch left behind: %v", err)
+		}
+	}
+}
+
+func TestStorage_ReplayTornBatch(t *testing.T) {
+	opts := tempOptions(t)
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	start := s.currChunk.maxOffset
+
+	// a batch of three logged, the crash hit halfway through the second
+	var buf bytes.Buffer
+	logged := make([][]byte, 3)
+	blocks := make([]*Block, 3)
+	offset := start
+	for i := range blocks {
+		bts := bytes.Repeat([]byte{byte('a' + i)}, 100)
+		blocks[i] = NewBlock()
+		blocks[i].SetBlock(fmt.Sprintf("%d.txt", i), FdNullFlags, &bts)
+		blocks[i].WriteTo(&buf)
+		e := walStoreEntry{chunk: 1, offset: offset, size: blocks[i].OnDiskSize(), fId: blocks[i].ID()}
+		logged[i] = e.bytes()
+		offset += blocks[i].OnDiskSize()
+	}
+	if _, err := s.wal.AppendBatch(walRecordStore, logged); err != nil {
+		t.Fatal(err)
+	}
+	end := start + blocks[0].OnDiskSize()
+	if _, err := s.currChunk.w.WriteAt(buf.Bytes()[:end-start+20], start); err != nil {
+		t.Fatal(err)
+	}
+	// the first one has a key, without one it would go with the replay
+	if _, err := s.names.put(NameEntry{Key: "0.txt", ID: blocks[0].ID(), Size: 100}); err != nil {
+		t.Fatal(err)
+	}
+	crash(s)
+
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err, _, f := s.Read(blocks[0].ID()); err != nil || !bytes.Equal(f, blocks[0].Payload()) {
+		t.Fatalf("first block not rolled forward: %v", err)
+	}
+	if s.currChunk.maxOffset != end {
+		t.Fatalf("max offset %d, want %d", s.currChunk.maxOffset, end)
+	}
+	if fi, _ := os.Stat(s.currChunk.path); fi.Size() != end {
+		t.Fatalf("torn block not cut, chunk size %d", fi.Size())
+	}
+}
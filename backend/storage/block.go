@@ -23,10 +23,16 @@ type Block struct {
 	fNameSz   uint8
 	fileName  string
 	fSz       int64
-	fOffset   int64
-	file      []byte
-	block     []byte
-	r         *io.Reader
+	// size of the payload as stored, fSz unless it is compressed
+	sSz   int64
+	file  []byte
+	block []byte
+	r     *io.Reader
+	id    ObjectID
+	// mapping the payload was read from, see Release
+	mapping *chunkMapping
+	// codec a streamed payload is compressed by on its way in
+	codec Codec
 }
 
 func NewBlock() *Block {
@@ -43,75 +49,163 @@ func (b *Block) SetBlock(name string, flags int8, f *[]byte) {
 	b.fNameSz = uint8(len([]byte(name)))
 	b.fileName = name
 	b.fSz = int64(len(*f))
-	b.fOffset = int64(len(*f))
+	b.sSz = int64(len(*f))
 	b.file = *f
+	b.id = ObjectID{}
+	b.ID()
 }
 
-func (b *Block) OnDiskSize() int64 {
-	return blockHeaderSz + int64(len(b.file))
+// ID returns the object id of the block, calculated from the payload by the
+// algorithm in its flags. A compressed payload is decompressed for it, the
+// id is the one of the content whatever it is stored as
+func (b *Block) ID() ObjectID {
+	if !b.id.IsZero() {
+		return b.id
+	}
+	if b.flags&FdManifest != 0 {
+		// the id of the whole object, recorded in the manifest
+		if m, err := readManifest(b.Payload()); err == nil {
+			b.id = m.id
+		}
+		return b.id
+	}
+	a := algoOfFlags(b.flags)
+	if a == HashCrc32 && b.flags&FdCompressed == 0 {
+		b.id = crc32Id(b.crc32)
+	} else if f, err := b.content(); err == nil {
+		b.id = a.Sum(f)
+	}
+	return b.id
 }
 
-func (b *Block) WriteTo(w io.Writer) (n int64, err error) {
-	// append to file
-	var buf bytes.Buffer
-
-	if err := binary.Write(&buf, binary.BigEndian, b.crc32); err != nil {
-		return 0, err
-	}
-	if err := binary.Write(&buf, binary.BigEndian, b.flags); err != nil {
-		return 0, err
+// compress stores the payload set with SetBlock compressed by the codec,
+// the id is taken before. A payload that does not get smaller is kept as
+// it is
+func (b *Block) compress(c Codec) error {
+	if c == CodecNone || b.flags&FdCompressed != 0 {
+		return nil
 	}
-	if err := binary.Write(&buf, binary.BigEndian, b.timestamp); err != nil {
-		return 0, err
-	}
-	if err := binary.Write(&buf, binary.BigEndian, b.fNameSz); err != nil {
-		return 0, err
-	}
-	if err := binary.Write(&buf, binary.BigEndian, []byte(b.fileName)); err != nil {
-		return 0, err
+	b.ID()
+	stored, err := c.encode(b.file)
+	if err != nil {
+		return err
 	}
-	if err := binary.Write(&buf, binary.BigEndian, b.fSz); err != nil {
-		return 0, err
+	if int64(len(stored)) >= b.fSz {
+		return nil
 	}
-	if err := binary.Write(&buf, binary.BigEndian, b.fOffset); err != nil {
-		return 0, err
+	b.flags |= FdCompressed
+	b.file = stored
+	b.sSz = int64(len(stored))
+	b.crc32 = crc32.ChecksumIEEE(stored)
+	return nil
+}
+
+// content returns the payload as it was put, decompressed
+func (b *Block) content() ([]byte, error) {
+	if b.flags&FdCompressed == 0 {
+		return b.Payload(), nil
 	}
-	buf.Write(b.file)
+	return decodeStored(b.Payload(), b.fSz)
+}
 
-	return buf.WriteTo(w)
+// Name returns the file name stored with the block
+func (b *Block) Name() string {
+	return b.fileName
 }
 
-func ReadBlock(r io.Reader) (error, *Block) {
-	b := NewBlock()
-	if err := binary.Read(r, binary.BigEndian, &b.crc32); err != nil {
-		return err, nil
-	}
-	if err := binary.Read(r, binary.BigEndian, &b.flags); err != nil {
-		return err, nil
-	}
-	if err := binary.Read(r, binary.BigEndian, &b.timestamp); err != nil {
-		return err, nil
-	}
-	if err := binary.Read(r, binary.BigEndian, &b.fNameSz); err != nil {
-		return err, nil
+func (b *Block) Flags() int8 {
+	return b.flags
+}
+
+// Timestamp returns the unix time the block was written at
+func (b *Block) Timestamp() int64 {
+	return b.timestamp
+}
+
+// Size returns the size of the payload as it was put
+func (b *Block) Size() int64 {
+	return b.fSz
+}
+
+// StoredSize returns the size of the payload in the chunk, less than Size
+// for a compressed one
+func (b *Block) StoredSize() int64 {
+	return b.sSz
+}
+
+func (b *Block) CRC32() uint32 {
+	return b.crc32
+}
+
+// Payload returns the payload of a block read with ReadBlock as it is
+// stored, compressed when FdCompressed is set
+func (b *Block) Payload() []byte {
+	if b.file != nil {
+		return b.file
 	}
+	return b.block
+}
 
-	fNameBts := make([]byte, b.fNameSz)
-	if _, err := io.ReadFull(r, fNameBts); err == nil {
-		b.fileName = string(fNameBts)
-	} else {
-		return err, nil
+func (b *Block) OnDiskSize() int64 {
+	return blockHeaderSz + int64(b.fNameSz) + b.sSz
+}
+
+// set block para for a payload of size bytes streamed in from a reader, the
+// crc32 and id are set once it went through
+func (b *Block) setStream(name string, flags int8, size int64) {
+	b.flags = flags
+	b.timestamp = time.Now().Unix()
+	b.fNameSz = uint8(len([]byte(name)))
+	b.fileName = name
+	b.fSz = size
+	b.sSz = size
+}
+
+// setCodec has the payload streamed in compressed by the codec, its stored
+// size is known once it went through and until then the most it can take
+func (b *Block) setCodec(c Codec) {
+	if c != CodecNone {
+		b.flags |= FdCompressed
+		b.codec = c
+		b.sSz = c.bound(b.fSz)
 	}
+}
 
-	if err := binary.Read(r, binary.BigEndian, &b.fSz); err != nil {
-		return err, nil
+// every field of the block up to its payload
+func (b *Block) header() []byte {
+	var buf bytes.Buffer
+	buf.Grow(blockHeaderSz + int(b.fNameSz))
+	binary.Write(&buf, binary.BigEndian, b.crc32)
+	binary.Write(&buf, binary.BigEndian, b.flags)
+	binary.Write(&buf, binary.BigEndian, b.timestamp)
+	binary.Write(&buf, binary.BigEndian, b.fNameSz)
+	buf.WriteString(b.fileName)
+	binary.Write(&buf, binary.BigEndian, b.fSz)
+	binary.Write(&buf, binary.BigEndian, b.sSz)
+	return buf.Bytes()
+}
+
+// WriteTo writes the header and then the payload as it is, without copying
+// it into a buffer of its own
+func (b *Block) WriteTo(w io.Writer) (n int64, err error) {
+	m, err := w.Write(b.header())
+	n += int64(m)
+	if err != nil {
+		return n, err
 	}
-	if err := binary.Read(r, binary.BigEndian, &b.fOffset); err != nil {
+	m, err = w.Write(b.file)
+	n += int64(m)
+	return n, err
+}
+
+func ReadBlock(r io.Reader) (error, *Block) {
+	err, b := readBlockHeader(r)
+	if err != nil {
 		return err, nil
 	}
 
-	b.block = make([]byte, b.fSz)
-	_, err := io.ReadFull(r, b.block)
+	b.block = make([]byte, b.sSz)
+	_, err = io.ReadFull(r, b.block)
 	if err != nil {
 		return err, nil
 	}
@@ -119,35 +213,34 @@ func ReadBlock(r io.Reader) (error, *Block) {
 	return nil, b
 }
 
-func transferBlock(r io.Reader) (error, *Block, *io.Reader) {
+// read every field of the block up to its payload
+func readBlockHeader(r io.Reader) (error, *Block) {
 	b := NewBlock()
 	if err := binary.Read(r, binary.BigEndian, &b.crc32); err != nil {
-		return err, nil, nil
+		return err, nil
 	}
 	if err := binary.Read(r, binary.BigEndian, &b.flags); err != nil {
-		return err, nil, nil
+		return err, nil
 	}
 	if err := binary.Read(r, binary.BigEndian, &b.timestamp); err != nil {
-		return err, nil, nil
+		return err, nil
 	}
 	if err := binary.Read(r, binary.BigEndian, &b.fNameSz); err != nil {
-		return err, nil, nil
+		return err, nil
 	}
 
 	fNameBts := make([]byte, b.fNameSz)
 	if _, err := io.ReadFull(r, fNameBts); err == nil {
 		b.fileName = string(fNameBts)
 	} else {
-		return err, nil, nil
+		return err, nil
 	}
 
 	if err := binary.Read(r, binary.BigEndian, &b.fSz); err != nil {
-		return err, nil, nil
+		return err, nil
 	}
-	if err := binary.Read(r, binary.BigEndian, &b.fOffset); err != nil {
-		return err, nil, nil
+	if err := binary.Read(r, binary.BigEndian, &b.sSz); err != nil {
+		return err, nil
 	}
-
-	reader := io.LimitReader(r, b.fSz)
-	return nil, b, &reader
+	return nil, b
 }
@@ -0,0 +1,420 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	bucketsFileName = "buckets"
+	// a catalog record holds one bucket
+	bucketRecord = 0x1
+
+	minBucketNameSize = 3
+	maxBucketNameSize = 63
+)
+
+var (
+	ErrBucketNotFound    = kindError("bucket not found", ErrNotFound)
+	ErrBucketExists      = kindError("bucket already exists", ErrExists)
+	ErrBucketNotEmpty    = errors.New("bucket not empty")
+	ErrInvalidBucketName = errors.New("invalid bucket name")
+	ErrQuotaExceeded     = errors.New("bucket quota exceeded")
+)
+
+// BucketConfig holds the settings of a bucket
+type BucketConfig struct {
+	// flags every object put into the bucket gets
+	DefaultFlags int8
+	// objects of a private bucket are stored FdPrivate
+	Private bool
+	// max bytes of object payload, 0 for no limit
+	QuotaBytes int64
+	// max number of objects, 0 for no limit
+	QuotaObjects int64
+	// codec objects put with FdCompressed are compressed by, the one of
+	// the storage options when CodecNone
+	Codec Codec
+}
+
+// Bucket is a namespace of keys with its own settings, objects put through
+// it are stored in the namespace of the bucket name
+type Bucket struct {
+	Name    string
+	Created time.Time
+	BucketConfig
+
+	s *Storage
+}
+
+// Usage is what the objects of a namespace take up
+type Usage struct {
+	Objects int64
+	Bytes   int64
+}
+
+// catalog is the persistent list of buckets, small enough to be rewritten
+// whole on every change
+type catalog struct {
+	path string
+	opts Options
+	m    map[string]*Bucket
+
+	sync.RWMutex
+}
+
+func newCatalog(path string, opts Options) *catalog {
+	c := new(catalog)
+	c.path = path
+	c.opts = opts
+	c.m = make(map[string]*Bucket)
+	return c
+}
+
+func (c *catalog) open() error {
+	c.Lock()
+	defer c.Unlock()
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		rec, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		} else if err == errWALTorn {
+			// the catalog is replaced whole, a torn one is damage
+			return errors.New("bucket catalog corrupt")
+		} else if err != nil {
+			return err
+		}
+		if rec.typ != bucketRecord {
+			return errors.New("unknown bucket catalog record type")
+		}
+		b, err := readBucket(rec.data)
+		if err != nil {
+			return err
+		}
+		c.m[b.Name] = b
+	}
+}
+
+func (c *catalog) get(name string) (b Bucket, find bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if v := c.m[name]; v != nil {
+		return *v, true
+	}
+	return b, false
+}
+
+func (c *catalog) list() []Bucket {
+	c.RLock()
+	buckets := make([]Bucket, 0, len(c.m))
+	for _, b := range c.m {
+		buckets = append(buckets, *b)
+	}
+	c.RUnlock()
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+	return buckets
+}
+
+// set adds or replaces the bucket, the map is only changed once the new
+// catalog is on disk
+func (c *catalog) set(b Bucket) error {
+	c.Lock()
+	defer c.Unlock()
+	m := make(map[string]*Bucket, len(c.m)+1)
+	for k, v := range c.m {
+		m[k] = v
+	}
+	m[b.Name] = &b
+	if err := c.save(m); err != nil {
+		return err
+	}
+	c.m = m
+	return nil
+}
+
+func (c *catalog) remove(name string) error {
+	c.Lock()
+	defer c.Unlock()
+	m := make(map[string]*Bucket, len(c.m))
+	for k, v := range c.m {
+		if k != name {
+			m[k] = v
+		}
+	}
+	if err := c.save(m); err != nil {
+		return err
+	}
+	c.m = m
+	return nil
+}
+
+func (c *catalog) save(m map[string]*Bucket) error {
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for i, k := range names {
+		rec := walRecord{typ: bucketRecord, seq: uint64(i + 1), data: m[k].bytes()}
+		if _, err := writeFrame(&buf, &rec); err != nil {
+			return err
+		}
+	}
+	return replaceFile(c.path, buf.Bytes(), c.opts)
+}
+
+// a record is name | created | default flags | private | quota bytes |
+// quota objects | codec
+func (b *Bucket) bytes() []byte {
+	var buf bytes.Buffer
+	writeNameString(&buf, b.Name)
+	binary.Write(&buf, binary.BigEndian, b.Created.UnixNano())
+	binary.Write(&buf, binary.BigEndian, b.DefaultFlags)
+	binary.Write(&buf, binary.BigEndian, b.Private)
+	binary.Write(&buf, binary.BigEndian, b.QuotaBytes)
+	binary.Write(&buf, binary.BigEndian, b.QuotaObjects)
+	buf.WriteByte(byte(b.Codec))
+	return buf.Bytes()
+}
+
+func readBucket(data []byte) (b *Bucket, err error) {
+	r := bytes.NewReader(data)
+	b = new(Bucket)
+	if b.Name, err = readNameString(r); err != nil {
+		return nil, err
+	}
+	var created int64
+	if err := binary.Read(r, binary.BigEndian, &created); err != nil {
+		return nil, err
+	}
+	b.Created = time.Unix(0, created)
+	if err := binary.Read(r, binary.BigEndian, &b.DefaultFlags); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &b.Private); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &b.QuotaBytes); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &b.QuotaObjects); err != nil {
+		return nil, err
+	}
+	// records written before buckets had a codec end here
+	if r.Len() > 0 {
+		c, _ := r.ReadByte()
+		b.Codec = Codec(c)
+	}
+	return b, nil
+}
+
+// bucket names follow the s3 rules: 3 to 63 lower case letters, digits,
+// dots and dashes, starting and ending with a letter or digit
+func validBucketName(name string) bool {
+	if len(name) < minBucketNameSize || len(name) > maxBucketNameSize {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		alnum := c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+		if !alnum && (c != '.' && c != '-' || i == 0 || i == len(name)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+// CreateBucket adds an empty bucket
+func (s *Storage) CreateBucket(name string, cfg BucketConfig) error {
+	if !validBucketName(name) {
+		return ErrInvalidBucketName
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.isClosed() {
+		return ErrClosed
+	}
+	if _, find := s.catalog.get(name); find {
+		return ErrBucketExists
+	}
+	return s.catalog.set(Bucket{Name: name, Created: time.Now(), BucketConfig: cfg})
+}
+
+// SetBucketConfig replaces the settings of a bucket, objects already in it
+// keep the flags they were stored with
+func (s *Storage) SetBucketConfig(name string, cfg BucketConfig) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.isClosed() {
+		return ErrClosed
+	}
+	b, find := s.catalog.get(name)
+	if !find {
+		return ErrBucketNotFound
+	}
+	b.BucketConfig = cfg
+	return s.catalog.set(b)
+}
+
+// DeleteBucket removes a bucket, it has to be empty
+func (s *Storage) DeleteBucket(name string) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.isClosed() {
+		return ErrClosed
+	}
+	if _, find := s.catalog.get(name); !find {
+		return ErrBucketNotFound
+	}
+	if s.names.usage(name).Objects > 0 {
+		return ErrBucketNotEmpty
+	}
+	return s.catalog.remove(name)
+}
+
+// GetBucket returns the bucket of the name
+func (s *Storage) GetBucket(name string) (error, *Bucket) {
+	if s.isClosed() {
+		return ErrClosed, nil
+	}
+	b, find := s.catalog.get(name)
+	if !find {
+		return ErrBucketNotFound, nil
+	}
+	b.s = s
+	return nil, &b
+}
+
+// ListBuckets returns every bucket ordered by name
+func (s *Storage) ListBuckets() []Bucket {
+	buckets := s.catalog.list()
+	for i := range buckets {
+		buckets[i].s = s
+	}
+	return buckets
+}
+
+// check the bucket of the namespace can take the object, the default
+// namespace has no bucket and no quota. The entries of a batch, by name
+// key, count as mapped already. Called under wmu
+func (s *Storage) checkQuota(ns, key string, size int64, batch map[string]NameEntry) error {
+	if ns == defaultNamespace {
+		return nil
+	}
+	b, find := s.catalog.get(ns)
+	if !find {
+		return ErrBucketNotFound
+	}
+	u := s.names.usage(ns)
+	for _, e := range batch {
+		if e.Namespace != ns {
+			continue
+		}
+		if old, find := s.names.get(ns, e.Key); find {
+			u.Objects--
+			u.Bytes -= old.Size
+		}
+		u.Objects++
+		u.Bytes += e.Size
+	}
+	if old, find := batch[nameKey(ns, key)]; find {
+		u.Objects--
+		u.Bytes -= old.Size
+	} else if old, find := s.names.get(ns, key); find {
+		u.Objects--
+		u.Bytes -= old.Size
+	}
+	if b.QuotaObjects > 0 && u.Objects+1 > b.QuotaObjects {
+		return ErrQuotaExceeded
+	}
+	if b.QuotaBytes > 0 && u.Bytes+size > b.QuotaBytes {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// flags objects put into the bucket are stored with
+func (b *Bucket) flags(flags int8) int8 {
+	flags |= b.DefaultFlags
+	if b.Private {
+		flags |= FdPrivate
+	}
+	return flags
+}
+
+// Put stores the object under the key in the bucket, see Storage.Store
+func (b *Bucket) Put(key string, bts []byte, flags int8) (error, ObjectID) {
+	return b.PutMeta(key, bts, flags, ObjectMeta{})
+}
+
+// PutMeta is Put keeping the metadata along with the key
+func (b *Bucket) PutMeta(key string, bts []byte, flags int8, meta ObjectMeta) (error, ObjectID) {
+	return b.s.put(b.Name, key, bts, b.flags(flags), meta, CodecNone)
+}
+
+// PutCodec is Put with the payload compressed by the codec
+func (b *Bucket) PutCodec(key string, bts []byte, flags int8, codec Codec) (error, ObjectID) {
+	return b.s.put(b.Name, key, bts, b.flags(flags), ObjectMeta{}, codec)
+}
+
+// PutReader stores size bytes read from r under the key in the bucket, see
+// Storage.StoreReader
+func (b *Bucket) PutReader(key string, r io.Reader, size int64, flags int8) (error, ObjectID) {
+	return b.PutReaderMeta(key, r, size, flags, ObjectMeta{})
+}
+
+// PutReaderMeta is PutReader keeping the metadata along with the key
+func (b *Bucket) PutReaderMeta(key string, r io.Reader, size int64, flags int8, meta ObjectMeta) (error, ObjectID) {
+	return b.s.putReader(b.Name, key, r, size, b.flags(flags), meta, CodecNone)
+}
+
+// Get reads the object stored under the key
+func (b *Bucket) Get(key string) (err error, e NameEntry, f []byte) {
+	if err, e = b.Stat(key); err != nil {
+		return err, e, nil
+	}
+	err, _, f = b.s.Read(e.ID)
+	return err, e, f
+}
+
+// Stat returns what the key maps to in the bucket
+func (b *Bucket) Stat(key string) (err error, e NameEntry) {
+	return b.s.stat(b.Name, key)
+}
+
+// Remove unmaps the key from the bucket
+func (b *Bucket) Remove(key string) error {
+	return b.s.remove(b.Name, key)
+}
+
+// List returns the entries of the bucket whose key starts with prefix,
+// ordered by key
+func (b *Bucket) List(prefix string) []NameEntry {
+	return b.s.names.list(b.Name, prefix)
+}
+
+// Usage returns what the objects of the bucket take up
+func (b *Bucket) Usage() Usage {
+	return b.s.names.usage(b.Name)
+}
+
+// Public tells whether the object may be served without authorization
+func (e *NameEntry) Public() bool {
+	return e.Flags&FdPrivate == 0
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestStorage_Buckets(t *testing.T) {
+	opts := tempOptions(t)
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateBucket("photos", BucketConfig{Private: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateBucket("docs", BucketConfig{QuotaObjects: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateBucket("photos", BucketConfig{}); err != ErrBucketExists {
+		t.Fatalf("create twice: %v", err)
+	}
+	for _, name := range []string{"ab", "Photos", "-ab", "ab-", "a_b"} {
+		if err := s.CreateBucket(name, BucketConfig{}); err != ErrInvalidBucketName {
+			t.Fatalf("create %q: %v", name, err)
+		}
+	}
+
+	err, photos := s.GetBucket("photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := photos.Put("2024/a.jpg", []byte("jpeg"), FdNullFlags); err != nil {
+		t.Fatal(err)
+	}
+	// the same key in another bucket or without one is another object
+	if err, _ := s.Store("2024/a.jpg", []byte("plain"), FdNullFlags); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	buckets := s.ListBuckets()
+	if len(buckets) != 2 || buckets[0].Name != "docs" || buckets[1].Name != "photos" {
+		t.Fatalf("buckets after reopen: %v", buckets)
+	}
+	if !buckets[1].Private || buckets[0].QuotaObjects != 2 {
+		t.Fatalf("bucket settings lost: %#v", buckets)
+	}
+	err, e, f := buckets[1].Get("2024/a.jpg")
+	if err != nil || string(f) != "jpeg" {
+		t.Fatalf("get from bucket: %v %q", err, f)
+	}
+	if e.Public() {
+		t.Fatal("object of a private bucket is public")
+	}
+	if err, f := s.Get("2024/a.jpg"); err != nil || string(f) != "plain" {
+		t.Fatalf("get without bucket: %v %q", err, f)
+	}
+
+	if err := s.DeleteBucket("photos"); err != ErrBucketNotEmpty {
+		t.Fatalf("delete a bucket with objects: %v", err)
+	}
+	if err := buckets[1].Remove("2024/a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteBucket("photos"); err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := buckets[1].Put("b.jpg", []byte("jpeg"), FdNullFlags); err != ErrBucketNotFound {
+		t.Fatalf("put into a deleted bucket: %v", err)
+	}
+}
+
+func TestBucket_Quota(t *testing.T) {
+	s := NewStorage(tempOptions(t))
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.CreateBucket("docs", BucketConfig{QuotaObjects: 2, QuotaBytes: 10}); err != nil {
+		t.Fatal(err)
+	}
+	err, b := s.GetBucket("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := b.Put("a", []byte("aaaa"), FdNullFlags); err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := b.Put("b", []byte("bbbbbbb"), FdNullFlags); err != ErrQuotaExceeded {
+		t.Fatalf("put over byte quota: %v", err)
+	}
+	if err, _ := b.Put("b", []byte("bbbb"), FdNullFlags); err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := b.Put("c", []byte("c"), FdNullFlags); err != ErrQuotaExceeded {
+		t.Fatalf("put over object quota: %v", err)
+	}
+	// overwriting counts the new size only
+	if err, _ := b.Put("a", []byte("aaaaaa"), FdNullFlags); err != nil {
+		t.Fatal(err)
+	}
+	if u := b.Usage(); u.Objects != 2 || u.Bytes != 10 {
+		t.Fatalf("usage %#v", u)
+	}
+}
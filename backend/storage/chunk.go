@@ -1,11 +1,16 @@
 package storage
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,7 +21,7 @@ const (
 	defaultSegmentSize = 2 * 1024 * 1024 * 1024 //2G
 	chunkFileVersion   = 0x1
 	chunkMagic         = "SILOSSC"
-	chunkHeaderCount   = 0 +
+	ChunkHeaderSize    = 0 +
 		7 + 1 +
 		8 + 8 +
 		8 + 8 +
@@ -24,6 +29,28 @@ const (
 	chunkFileSuffix = ".chunk"
 )
 
+// bytes of a transferred payload held back until its crc32 is checked
+const transferVerifyTail = 32 * 1024
+
+var errChunkRetired = errors.New("chunk compacted away")
+
+// ChunkHeader is the header of a chunk file as read from disk
+type ChunkHeader struct {
+	Version uint8
+	// blocks appended to the chunk
+	Sum  int64
+	Size int64
+	// creation time in unix seconds
+	CTime int64
+	// end of the last block, the offset the next block goes to
+	MaxOffset int64
+}
+
+// Chunk is an append only file of blocks. The file is only ever read and
+// written at explicit offsets, never through its shared offset, so any
+// number of readers go along with the one appender: the appender writes
+// past maxOffset unlocked and takes the lock to move maxOffset over the
+// block, readers hold the read lock while they read below it
 type Chunk struct {
 	path      string
 	fName     string
@@ -32,20 +59,47 @@ type Chunk struct {
 	cTime     int64
 	maxOffset int64
 	blockIds  []uint32
+	opts      Options
+	// compacted away, the file is closed and about to be removed
+	retired bool
 
 	w *os.File
+	// leaves of the merkle tree over the blocks and their file, merkleErr
+	// is set when they could not be rebuilt
+	mf        *os.File
+	leaves    []merkleLeaf
+	root      *MerkleHash
+	merkleErr error
+	// read only mapping of the file once the chunk is sealed
+	m *chunkMapping
+	// offsets of the blocks whose payload matched its crc32 in full, see
+	// verify
+	verified map[int64]bool
 
 	sync.RWMutex
 }
 
-func NewChunk(p string) *Chunk {
+func NewChunk(p string, opts Options) *Chunk {
 	c := new(Chunk)
 	c.path = p
+	opts.normalize()
+	c.opts = opts
 
 	return c
 }
 
 func (c *Chunk) Close() error {
+	if c.retired {
+		return nil
+	}
+	if err := c.unmap(); err != nil {
+		return err
+	}
+	if c.mf != nil {
+		if err := c.mf.Close(); err != nil {
+			return err
+		}
+	}
 	return c.w.Close()
 }
 
@@ -57,10 +111,10 @@ func (c *Chunk) Open() error {
 		return err
 	} else if _, err := os.Stat(c.path); err != nil && os.IsNotExist(err) {
 		// file not exist create a new one and open
-		if err := makeDir(c.path); err != nil {
+		if err := makeDir(c.path, c.opts.DirMode); err != nil {
 			return err
 		}
-		f, err := os.OpenFile(c.path, os.O_RDWR|os.O_CREATE, 0644)
+		f, err := os.OpenFile(c.path, os.O_RDWR|os.O_CREATE, c.opts.FileMode)
 		if err != nil {
 			return err
 		}
@@ -71,19 +125,23 @@ func (c *Chunk) Open() error {
 		c.size = 0
 		c.cTime = time.Now().Unix()
 		// offset relative to the start position of the chunk file
-		c.maxOffset = chunkHeaderCount
+		c.maxOffset = ChunkHeaderSize
 
 		//write default header
 		if err = c.WriteHeader(); err != nil {
-			return err
+			return c.closeFile(err)
 		}
 		c.blockIds = make([]uint32, 0)
 
 		// proceed remaining normal open procedure
 
 		c.fName = c.getFName()
+		if err := c.openLeaves(true); err != nil {
+			return c.closeFile(err)
+		}
+		return nil
 	} else if err == nil {
-		f, err := os.OpenFile(c.path, os.O_RDWR, 0644)
+		f, err := os.OpenFile(c.path, os.O_RDWR, c.opts.FileMode)
 		if err != nil {
 			return err
 		}
@@ -92,19 +150,35 @@ func (c *Chunk) Open() error {
 		// normal open
 		err = c.ReadHeader()
 		if err != nil {
-			return err
+			return c.closeFile(err)
 		}
 		c.fName = c.getFName()
+		if err := c.openLeaves(false); err != nil {
+			return c.closeFile(err)
+		}
+		return nil
 
 	}
 
 	return nil
 }
 
+// close the file of a chunk that failed to open, so a caller giving up on
+// it leaks no descriptor, err is passed through
+func (c *Chunk) closeFile(err error) error {
+	if c.mf != nil {
+		c.mf.Close()
+		c.mf = nil
+	}
+	c.w.Close()
+	c.w = nil
+	return err
+}
+
 func (c *Chunk) WriteHeader() error {
 	var buf bytes.Buffer
 	buf.WriteString(chunkMagic)
-	if err := binary.Write(&buf, binary.BigEndian, chunkFileVersion); err != nil {
+	if err := binary.Write(&buf, binary.BigEndian, uint8(chunkFileVersion)); err != nil {
 		return err
 	}
 	if err := binary.Write(&buf, binary.BigEndian, c.sum); err != nil {
@@ -119,109 +193,645 @@ func (c *Chunk) WriteHeader() error {
 	if err := binary.Write(&buf, binary.BigEndian, c.maxOffset); err != nil {
 		return err
 	}
-	h := buf.Bytes()
-	_, err := c.w.Seek(0, 0)
-	if err != nil {
-		return err
-	}
-	_, err = c.w.Write(h)
-	if err != nil {
-		return err
-	}
-	return nil
+	_, err := c.w.WriteAt(buf.Bytes(), 0)
+	return err
 }
 
 func (c *Chunk) ReadHeader() error {
-
+	r := io.NewSectionReader(c.w, 0, ChunkHeaderSize)
 	magic := make([]byte, len(chunkMagic))
 	// check magic
-	if _, err := io.ReadFull(c.w, magic); err != nil {
-		return err
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return c.corrupt(0, err)
 	} else if !bytes.Equal(magic, []byte(chunkMagic)) {
-		return errors.New("invalid chunk file")
+		return c.corrupt(0, nil)
+	}
+	// version
+	var v uint8
+	if err := binary.Read(r, binary.BigEndian, &v); err != nil {
+		return err
+	} else if v != chunkFileVersion {
+		return fmt.Errorf("chunk file version %d: %w", v, ErrVersionMismatch)
 	}
 	// sum
-	if err := binary.Read(c.w, binary.BigEndian, &c.sum); err != nil {
+	if err := binary.Read(r, binary.BigEndian, &c.sum); err != nil {
 		return err
 	}
 	// size
-	if err := binary.Read(c.w, binary.BigEndian, &c.size); err != nil {
+	if err := binary.Read(r, binary.BigEndian, &c.size); err != nil {
 		return err
 	}
 	// cTime
-	if err := binary.Read(c.w, binary.BigEndian, &c.cTime); err != nil {
+	if err := binary.Read(r, binary.BigEndian, &c.cTime); err != nil {
 		return err
 	}
 	// maxOffset
-	if err := binary.Read(c.w, binary.BigEndian, &c.maxOffset); err != nil {
+	if err := binary.Read(r, binary.BigEndian, &c.maxOffset); err != nil {
 		return err
 	}
 	return nil
 }
 
+// Header returns the header of the opened chunk
+func (c *Chunk) Header() ChunkHeader {
+	c.RLock()
+	defer c.RUnlock()
+	return ChunkHeader{
+		Version:   chunkFileVersion,
+		Sum:       c.sum,
+		Size:      c.size,
+		CTime:     c.cTime,
+		MaxOffset: c.maxOffset,
+	}
+}
+
 // at this point the block only has a valid bytes which representing the file is holds
 // the outer caller should insert the index slot to the new Index file
 func (c *Chunk) AppendBlock(b *Block) (err error, slot *IndexSlot) {
-	if _, err := c.w.Seek(c.maxOffset, 0); err != nil {
+	if _, err := b.WriteTo(&offsetWriter{f: c.w, off: c.maxOffset}); err != nil {
 		return err, slot
 	}
-	if _, err := b.WriteTo(c.w); err != nil {
-		return err, slot
+	return c.commitBlock(b)
+}
+
+// offsetWriter writes to f from off on without moving the offset of f
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// appendFrom writes the block set with setStream to the end of the chunk,
+// its payload read from r and compressed on the way by the codec set with
+// setCodec. The crc32 and id are calculated on the way and the crc32 and
+// stored size written into the block header once the payload is through.
+// The block is not committed, see commitBlock, and truncate cuts it off
+// again on failure
+func (c *Chunk) appendFrom(b *Block, r io.Reader) error {
+	start := c.maxOffset
+	header := b.header()
+	cw := &offsetWriter{f: c.w, off: start}
+	if _, err := cw.Write(header); err != nil {
+		return err
+	}
+	// the crc32 covers the payload as stored, the id the one read from r
+	crc := crc32.NewIEEE()
+	var w io.Writer = io.MultiWriter(cw, crc)
+	sum := crc
+	var enc io.WriteCloser
+	if b.flags&FdCompressed != 0 {
+		if _, err := w.Write([]byte{byte(b.codec)}); err != nil {
+			return err
+		}
+		var err error
+		if enc, err = b.codec.writer(w); err != nil {
+			return err
+		}
+		w = enc
+		sum = crc32.NewIEEE()
+	}
+	algo := algoOfFlags(b.flags)
+	hs := []io.Writer{w}
+	if sum != crc {
+		hs = append(hs, sum)
+	}
+	h := algo.hasher()
+	if h != nil {
+		hs = append(hs, h)
+	}
+	if n, err := io.CopyN(io.MultiWriter(hs...), r, b.fSz); err == io.EOF {
+		return fmt.Errorf("payload of %d bytes short of %d: %w", n, b.fSz, io.ErrUnexpectedEOF)
+	} else if err != nil {
+		return err
+	}
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			return err
+		}
+	}
+	b.crc32 = crc.Sum32()
+	b.sSz = cw.off - start - int64(len(header))
+	b.id = algo.sumOf(h, sum.Sum32())
+	var fix [8]byte
+	binary.BigEndian.PutUint32(fix[:4], b.crc32)
+	if _, err := c.w.WriteAt(fix[:4], start); err != nil {
+		return err
 	}
-	c.blockIds = append(c.blockIds, b.crc32)
-	c.sum++
-	startOffset := c.maxOffset
-	c.maxOffset += b.OnDiskSize()
-	c.size += b.OnDiskSize()
+	binary.BigEndian.PutUint64(fix[:], uint64(b.sSz))
+	_, err := c.w.WriteAt(fix[:], start+int64(len(header))-8)
+	return err
+}
 
-	slot = new(IndexSlot)
-	if c, err := c.GetChunkUint(); err == nil {
-		slot.chunkFile = c
-	} else {
+// appendBlocks writes the blocks to the end of the chunk in one write and
+// commits them with one header update, see commitBlocks. The caller cuts
+// them off again with truncate on failure
+func (c *Chunk) appendBlocks(bs []*Block) (err error, slots []IndexSlot) {
+	var buf bytes.Buffer
+	for _, b := range bs {
+		if _, err := b.WriteTo(&buf); err != nil {
+			return err, nil
+		}
+	}
+	if _, err := c.w.WriteAt(buf.Bytes(), c.maxOffset); err != nil {
+		return err, nil
+	}
+	return c.commitBlocks(bs)
+}
+
+// commitBlock accounts the block written at the end of the chunk in the
+// header and the merkle leaves, readers see it from here on
+func (c *Chunk) commitBlock(b *Block) (err error, slot *IndexSlot) {
+	err, slots := c.commitBlocks([]*Block{b})
+	if len(slots) == 0 {
+		return err, nil
+	}
+	return err, &slots[0]
+}
+
+// commitBlocks is commitBlock of blocks written one behind the other
+func (c *Chunk) commitBlocks(bs []*Block) (err error, slots []IndexSlot) {
+	unit, err := c.GetChunkUint()
+	if err != nil {
 		return err, nil
 	}
-	slot.fId = b.crc32
-	slot.offset = startOffset
+	slots = make([]IndexSlot, len(bs))
+	offsets := make([]int64, len(bs))
+	ids := make([]ObjectID, len(bs))
+
+	c.Lock()
+	for i, b := range bs {
+		c.blockIds = append(c.blockIds, b.crc32)
+		c.sum++
+		offsets[i] = c.maxOffset
+		ids[i] = b.ID()
+		slots[i] = IndexSlot{fId: ids[i], chunkFile: unit, offset: c.maxOffset}
+		c.maxOffset += b.OnDiskSize()
+		c.size += b.OnDiskSize()
+	}
 
 	// sync to file
 	e := c.WriteHeader()
+	c.Unlock()
 	if e != nil {
-		return e, slot
+		return e, slots
+	}
+	if e := c.addLeaves(offsets, ids); e != nil {
+		return e, slots
+	}
+	return nil, slots
+}
+
+// cut the chunk file at offset, used to undo a block append that did not
+// make it, offset must be the start of the last block
+func (c *Chunk) truncate(offset int64) error {
+	return c.truncateBlocks(offset, 1)
+}
+
+// truncateBlocks is truncate of the last n blocks, offset the start of the
+// first of them
+func (c *Chunk) truncateBlocks(offset int64, n int64) error {
+	if offset < ChunkHeaderSize {
+		return errors.New("truncate into chunk header")
+	}
+	c.Lock()
+	defer c.Unlock()
+	if err := c.unmap(); err != nil {
+		return err
+	}
+	if fi, err := c.w.Stat(); err != nil {
+		return err
+	} else if fi.Size() > offset {
+		if err := c.w.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	if offset < c.maxOffset {
+		c.size -= c.maxOffset - offset
+		c.sum -= n
+		c.maxOffset = offset
 	}
-	return nil, slot
+	// the space is written again
+	for o := range c.verified {
+		if o >= offset {
+			delete(c.verified, o)
+		}
+	}
+	if err := c.dropLeaves(); err != nil {
+		return err
+	}
+	return c.WriteHeader()
+}
+
+// flag the block at offset deleted in place, its flags byte sits right
+// behind the crc32
+func (c *Chunk) markDeleted(offset int64) error {
+	c.Lock()
+	defer c.Unlock()
+	flags := make([]byte, 1)
+	if _, err := c.w.ReadAt(flags, offset+4); err != nil {
+		return err
+	}
+	flags[0] |= FdDeleted
+	_, err := c.w.WriteAt(flags, offset+4)
+	return err
+}
+
+// flush the chunk file to disk
+func (c *Chunk) Sync() error {
+	if err := c.mf.Sync(); err != nil {
+		return err
+	}
+	return c.w.Sync()
 }
 
+// ReadBlock reads the block at offset and checks its payload against the
+// crc32. A mismatch is an *ErrCorrupt returned along with the block, so the
+// caller can still skip over it. The payload of a block of a sealed chunk
+// is a slice of its mapping, see Block.Release
 func (c *Chunk) ReadBlock(offset int64) (error, *Block) {
-	// seek to the start pos of the file
-	if _, err := c.w.Seek(offset, 0); err != nil {
+	c.RLock()
+	defer c.RUnlock()
+	if c.retired {
+		return errChunkRetired, nil
+	}
+	if c.m != nil && offset < int64(len(c.m.data)) {
+		return c.readMapped(offset)
+	}
+	// the header in one read, the name makes its size vary
+	const n = blockHeaderSz + maxBlockNameSize
+	err, b := c.readBlockHeader(bufio.NewReaderSize(io.NewSectionReader(c.w, offset, n), n), offset)
+	if err != nil {
 		return err, nil
 	}
-	return ReadBlock(c.w)
+	b.block = make([]byte, b.sSz)
+	if _, err := c.w.ReadAt(b.block, offset+b.OnDiskSize()-b.sSz); err != nil {
+		return c.corrupt(offset, err), nil
+	}
+	if crc32.ChecksumIEEE(b.block) != b.crc32 {
+		return c.corrupt(offset, nil), b
+	}
+	return nil, b
+}
+
+// read the header of the block at offset from r and check the block fits in
+// the chunk: below the max offset of the header or, for a block appended
+// behind it that is yet to be rolled forward, in the file
+func (c *Chunk) readBlockHeader(r io.Reader, offset int64) (error, *Block) {
+	err, b := readBlockHeader(r)
+	if err != nil {
+		return c.corrupt(offset, err), nil
+	}
+	limit := c.maxOffset
+	if offset >= c.maxOffset {
+		fi, err := os.Stat(c.path)
+		if err != nil {
+			return err, nil
+		}
+		limit = fi.Size()
+	}
+	if b.fSz < 0 || b.sSz < 0 || offset+b.OnDiskSize() > limit {
+		return c.corrupt(offset, nil), nil
+	}
+	return nil, b
+}
+
+// a short read is a torn block, other errors are passed on
+func (c *Chunk) corrupt(offset int64, err error) error {
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	u, _ := c.GetChunkUint()
+	return &ErrCorrupt{Chunk: u, Offset: offset}
+}
+
+// BlockReader streams the payload of a block through a handle of its own on
+// the chunk file, so it does not move the chunk's offset and keeps reading
+// after the chunk got compacted away. The payload is checked against its
+// crc32 as it goes, the last read fails with an *ErrCorrupt on a mismatch.
+// A compressed payload is decompressed on the way
+type BlockReader struct {
+	*io.LimitedReader
+	f *os.File
+	// the payload in the chunk file
+	start, size int64
+	crc         uint32
+	sum         hash.Hash32
+	err         *ErrCorrupt
+	// decompressing the stored payload, nil unless it is compressed
+	dec *decodeReader
+	// the chunk and offset of the block, for verify
+	c      *Chunk
+	offset int64
+}
+
+func (br *BlockReader) Read(p []byte) (int, error) {
+	if br.dec != nil {
+		n, err := br.dec.Read(p)
+		if err == errCorruptPayload {
+			err = br.err
+		}
+		return n, err
+	}
+	return br.readStored(p)
+}
+
+// read the payload as stored in the chunk file
+func (br *BlockReader) readStored(p []byte) (int, error) {
+	n, err := br.LimitedReader.Read(p)
+	if err == io.EOF && br.N > 0 {
+		// the file ends inside the payload
+		return n, br.err
+	}
+	if br.sum == nil {
+		return n, err
+	}
+	br.sum.Write(p[:n])
+	if br.N == 0 && br.sum.Sum32() != br.crc {
+		// the tail is held back so the reader never gets the whole payload
+		return 0, br.err
+	}
+	return n, err
+}
+
+// WriteTo sends the payload to w. Everything up to the last
+// transferVerifyTail bytes goes through the embedded *io.LimitedReader,
+// which an http response sends with sendfile, and is read back for the
+// crc32 from the page cache. The tail follows once the checksum matches
+func (br *BlockReader) WriteTo(w io.Writer) (n int64, err error) {
+	if br.dec != nil {
+		// decompressed, nothing to send with sendfile
+		return io.Copy(w, readerFunc(br.Read))
+	}
+	if br.sum == nil {
+		// a range, all of it goes with sendfile
+		n, err = io.Copy(w, br.LimitedReader)
+		if err == nil && br.N > 0 {
+			err = br.err
+		}
+		return n, err
+	}
+	if head := br.N - transferVerifyTail; head > 0 {
+		pos := br.start + br.size - br.N
+		lr := &io.LimitedReader{R: br.f, N: head}
+		n, err = io.Copy(w, lr)
+		br.N -= n
+		if err != nil {
+			return n, err
+		}
+		if lr.N > 0 {
+			return n, br.err
+		}
+		if _, err := io.Copy(br.sum, io.NewSectionReader(br.f, pos, head)); err != nil {
+			return n, err
+		}
+	}
+	tail := make([]byte, br.N)
+	if _, err := io.ReadFull(readerFunc(br.readStored), tail); err != nil {
+		return n, err
+	}
+	// the end of the payload, for the checksum of an empty one
+	if _, err := br.readStored(nil); err != io.EOF {
+		return n, err
+	}
+	m, err := w.Write(tail)
+	return n + int64(m), err
+}
+
+func (br *BlockReader) Close() error {
+	return br.f.Close()
+}
+
+// narrow the reader to n bytes of the payload from off on, before any is
+// read. A range has no checksum of its own, the crc32 covers the whole
+// payload, so the payload is verified in full first. The range of a
+// compressed payload is decompressed from its start, what comes before the
+// range is dropped
+func (br *BlockReader) narrow(off, n int64) error {
+	if err := br.c.verify(br.offset, br); err != nil {
+		return err
+	}
+	if br.dec != nil {
+		if off < 0 || n < 0 || off > br.dec.n {
+			return ErrInvalidRange
+		}
+		if n > br.dec.n-off {
+			n = br.dec.n - off
+		}
+		br.dec.skip, br.dec.n = off, n
+		br.dec.whole = false
+		br.sum = nil
+		return nil
+	}
+	if off < 0 || n < 0 || off > br.size {
+		return ErrInvalidRange
+	}
+	if n > br.size-off {
+		n = br.size - off
+	}
+	if _, err := br.f.Seek(br.start+off, io.SeekStart); err != nil {
+		return err
+	}
+	br.N = n
+	br.sum = nil
+	return nil
+}
+
+// TransferRange is TransferBlock over n bytes of the payload from off on,
+// cut at its end. The reader starts right at them in the chunk file once
+// the payload is verified, see narrow
+func (c *Chunk) TransferRange(offset, off, n int64) (error, *Block, *BlockReader) {
+	err, b, br := c.TransferBlock(offset)
+	if err != nil {
+		return err, nil, nil
+	}
+	if off == 0 && n >= b.fSz {
+		return nil, b, br
+	}
+	if err := br.narrow(off, n); err != nil {
+		br.Close()
+		return err, nil, nil
+	}
+	return nil, b, br
 }
 
 // transfer block transfer the reader to a sendfile syscall
-func (c *Chunk) TransferBlock(offset int64) (error, *Block, *io.Reader) {
+func (c *Chunk) TransferBlock(offset int64) (error, *Block, *BlockReader) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.retired {
+		return errChunkRetired, nil, nil
+	}
+	f, err := os.Open(c.path)
+	if err != nil {
+		return err, nil, nil
+	}
 	// seek to the start pos of the file
-	if _, err := c.w.Seek(offset, 0); err != nil {
+	if _, err := f.Seek(offset, 0); err != nil {
+		f.Close()
 		return err, nil, nil
 	}
-	return transferBlock(c.w)
+	err, b := c.readBlockHeader(f, offset)
+	if err != nil {
+		f.Close()
+		return err, nil, nil
+	}
+	br := &BlockReader{
+		LimitedReader: &io.LimitedReader{R: f, N: b.sSz},
+		f:             f,
+		start:         offset + b.OnDiskSize() - b.sSz,
+		size:          b.sSz,
+		crc:           b.crc32,
+		sum:           crc32.NewIEEE(),
+		err:           c.corrupt(offset, nil).(*ErrCorrupt),
+		c:             c,
+		offset:        offset,
+	}
+	if b.flags&FdCompressed != 0 {
+		br.dec = &decodeReader{src: readerFunc(br.readStored), n: b.fSz, whole: true}
+	}
+	return nil, b, br
+}
+
+// verify checks the payload of the block at offset against its crc32 before
+// a range of it is served, out of the mapping when the chunk is sealed and
+// through the reader's own handle otherwise. A block that matched is not
+// read again for the next range, committed blocks don't change
+func (c *Chunk) verify(offset int64, br *BlockReader) error {
+	c.RLock()
+	if c.verified[offset] {
+		c.RUnlock()
+		return nil
+	}
+	m := c.m
+	if m != nil && int64(len(m.data)) >= br.start+br.size {
+		m.acquire()
+	} else {
+		m = nil
+	}
+	c.RUnlock()
+
+	var sum uint32
+	if m != nil {
+		sum = crc32.ChecksumIEEE(m.data[br.start : br.start+br.size])
+		m.release()
+	} else {
+		h := crc32.NewIEEE()
+		if _, err := io.Copy(h, io.NewSectionReader(br.f, br.start, br.size)); err != nil {
+			return c.corrupt(offset, err)
+		}
+		sum = h.Sum32()
+	}
+	if sum != br.crc {
+		return br.err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.verified == nil {
+		c.verified = make(map[int64]bool)
+	}
+	c.verified[offset] = true
+	return nil
+}
+
+// close the chunk for good, readers still holding it get errChunkRetired
+func (c *Chunk) retire() error {
+	c.Lock()
+	defer c.Unlock()
+	c.retired = true
+	c.mf.Close()
+	// blocks still read from the mapping keep it until they are released
+	c.unmap()
+	return c.w.Close()
+}
+
+// walk the blocks of the chunk file at path through a handle of its own,
+// the payload is only loaded when asked for. A short block is an *ErrCorrupt
+func scanChunk(path string, payload bool, fn func(offset int64, b *Block) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c := &Chunk{path: path, w: f}
+	if err := c.ReadHeader(); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(f, ChunkHeaderSize, c.maxOffset-ChunkHeaderSize))
+	for offset := int64(ChunkHeaderSize); offset < c.maxOffset; {
+		var b *Block
+		if payload {
+			err, b = ReadBlock(r)
+		} else if err, b = readBlockHeader(r); err == nil {
+			_, err = r.Discard(int(b.sSz))
+		}
+		if err != nil {
+			return c.corrupt(offset, err)
+		}
+		if err := fn(offset, b); err != nil {
+			return err
+		}
+		offset += b.OnDiskSize()
+	}
+	return nil
 }
 
-func makeDir(path string) error {
-	i := strings.LastIndex(path, "/")
-	p := path[:i] // from i to end
+func makeDir(path string, perm os.FileMode) error {
+	p := filepath.Dir(path)
 	_, err := os.Stat(p)
 	if err != nil && os.IsNotExist(err) {
-		return os.MkdirAll(p, os.ModePerm)
+		return os.MkdirAll(p, perm)
 	} else {
 		return err
 	}
 }
 
+// fsync the parent dir of path so a create or rename in it is durable
+func syncDir(path string) error {
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// replace the file at path with data, written aside and renamed over it so
+// a crash leaves either the old or the new file intact
+func replaceFile(path string, data []byte, opts Options) error {
+	if err := makeDir(path, opts.DirMode); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, opts.FileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
 func (c *Chunk) getFName() string {
-	i := strings.LastIndex(c.path, "/")
-	return c.path[i+1:]
+	return filepath.Base(c.path)
 }
 
 func (c *Chunk) GetChunkUint() (uint32, error) {
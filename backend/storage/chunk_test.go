@@ -1,24 +1,65 @@
 package storage
 
 import (
+	"bytes"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
 )
 
+// tempOptions returns default options rooted at a fresh temp dir
+func tempOptions(tb testing.TB) Options {
+	dir, err := ioutil.TempDir("", "siloss")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+	return DefaultOptions(dir)
+}
+
 func TestChunk_Open(t *testing.T) {
-	c := NewChunk("/tmp/chunk/1.chunk")
+	opts := tempOptions(t)
+	c := NewChunk(ChunkPath(opts.DataDir, 1), opts)
 	if err := c.Open(); err != nil {
-		t.Log(err)
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// reopen reads the header back
+	c = NewChunk(ChunkPath(opts.DataDir, 1), opts)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.maxOffset != ChunkHeaderSize {
+		t.Fatalf("max offset %d, want %d", c.maxOffset, ChunkHeaderSize)
+	}
+	if fi, err := os.Stat(filepath.Join(opts.DataDir, "1.chunk")); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != opts.FileMode {
+		t.Fatalf("file mode %v, want %v", fi.Mode().Perm(), opts.FileMode)
+	}
+
+	// a chunk that fails to open keeps no file open
+	if err := ioutil.WriteFile(ChunkPath(opts.DataDir, 2), []byte("SILOSSX"), opts.FileMode); err != nil {
+		t.Fatal(err)
+	}
+	bad := NewChunk(ChunkPath(opts.DataDir, 2), opts)
+	if err := bad.Open(); err == nil || bad.w != nil || bad.mf != nil {
+		t.Fatalf("open of a bad header: %v, file %v", err, bad.w)
 	}
-	t.Logf("%#v", c)
 }
 
 func TestChunk_AppendBlock(t *testing.T) {
-	c := NewChunk("/tmp/chunk/1.chunk")
+	opts := tempOptions(t)
+	c := NewChunk(ChunkPath(opts.DataDir, 1), opts)
 	if err := c.Open(); err != nil {
-		t.Log(err)
+		t.Fatal(err)
 	}
-	t.Logf("%#v", c)
+	defer c.Close()
 
 	if bts, e := ioutil.ReadFile("testdata/test.txt"); e == nil {
 		block := NewBlock()
@@ -36,11 +77,48 @@ func TestChunk_AppendBlock(t *testing.T) {
 
 }
 
+func TestChunk_ReadBlock(t *testing.T) {
+	opts := tempOptions(t)
+	c := NewChunk(ChunkPath(opts.DataDir, 1), opts)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	bts, err := ioutil.ReadFile("testdata/test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := NewBlock()
+	block.SetBlock("test.txt", FdNullFlags, &bts)
+	err, slot := c.AppendBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slot.GetChunkUnit() != 1 || slot.GetOffset() != ChunkHeaderSize || slot.GetFileId() != block.ID() {
+		t.Fatalf("slot %+v", slot)
+	}
+	h := c.Header()
+	if h.Sum != 1 || h.MaxOffset != ChunkHeaderSize+block.OnDiskSize() {
+		t.Fatalf("header %+v", h)
+	}
+
+	err, b := c.ReadBlock(slot.GetOffset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Name() != "test.txt" || b.CRC32() != block.CRC32() || !bytes.Equal(b.Payload(), bts) {
+		t.Fatalf("read back %q %08x", b.Name(), b.CRC32())
+	}
+}
+
 func BenchmarkChunk_AppendBlock(b *testing.B) {
-	c := NewChunk("/tmp/chunk/1.chunk")
+	opts := tempOptions(b)
+	c := NewChunk(ChunkPath(opts.DataDir, 1), opts)
 	if err := c.Open(); err != nil {
-		b.Log(err)
+		b.Fatal(err)
 	}
+	defer c.Close()
 
 	if bts, e := ioutil.ReadFile("testdata/test.txt"); e == nil {
 		block := NewBlock()
@@ -55,3 +133,140 @@ func BenchmarkChunk_AppendBlock(b *testing.B) {
 		b.Fatal(e)
 	}
 }
+
+func TestChunk_ConcurrentRead(t *testing.T) {
+	opts := tempOptions(t)
+	c := NewChunk(ChunkPath(opts.DataDir, 1), opts)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	payloads := make([][]byte, 0)
+	offsets := make([]int64, 0)
+	for i := 0; i < 16; i++ {
+		bts := bytes.Repeat([]byte{byte(i)}, 100+i*37)
+		b := NewBlock()
+		b.SetBlock("b"+strconv.Itoa(i), FdNullFlags, &bts)
+		err, slot := c.AppendBlock(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, bts)
+		offsets = append(offsets, slot.GetOffset())
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	// the appender keeps the chunk growing under the readers
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			bts := bytes.Repeat([]byte{0xff}, 1+i%500)
+			b := NewBlock()
+			b.SetBlock("more", FdNullFlags, &bts)
+			if err, _ := c.AppendBlock(b); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	readers := sync.WaitGroup{}
+	for r := 0; r < 8; r++ {
+		readers.Add(1)
+		go func(r int) {
+			defer readers.Done()
+			for i := 0; i < 200; i++ {
+				j := (r + i) % len(offsets)
+				err, b := c.ReadBlock(offsets[j])
+				if err != nil || !bytes.Equal(b.Payload(), payloads[j]) {
+					t.Errorf("block %d read back wrong, %v", j, err)
+					return
+				}
+				err, _, br := c.TransferRange(offsets[j], 10, 50)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				f, err := ioutil.ReadAll(br)
+				br.Close()
+				if err != nil || !bytes.Equal(f, payloads[j][10:60]) {
+					t.Errorf("range of block %d read back wrong, %v", j, err)
+					return
+				}
+			}
+		}(r)
+	}
+	readers.Wait()
+	close(done)
+	wg.Wait()
+}
+
+func TestChunk_MappedRead(t *testing.T) {
+	opts := tempOptions(t)
+	c := NewChunk(ChunkPath(opts.DataDir, 1), opts)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	bts, err := ioutil.ReadFile("testdata/test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := NewBlock()
+	block.SetBlock("test.txt", FdNullFlags, &bts)
+	err, slot := c.AppendBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.seal(); err != nil {
+		t.Fatal(err)
+	}
+
+	err, b := c.ReadBlock(slot.GetOffset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.mapping != c.m || !bytes.Equal(b.Payload(), bts) {
+		t.Fatalf("mapped read %q", b.Payload())
+	}
+	// no copy, the payload is where the block sits in the file
+	start := slot.GetOffset() + b.OnDiskSize() - int64(len(bts))
+	if &b.Payload()[0] != &c.m.data[start] {
+		t.Fatal("payload copied out of the mapping")
+	}
+	if c.m.refs != 2 {
+		t.Fatalf("%d refs on the mapping", c.m.refs)
+	}
+	b.Release()
+	if c.m.refs != 1 || b.Payload() != nil {
+		t.Fatalf("%d refs after release", c.m.refs)
+	}
+
+	// a flip of the payload on disk shows through the mapping
+	f, err := os.OpenFile(c.path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{bts[0] ^ 0xff}, start)
+	f.Close()
+	err, b = c.ReadBlock(slot.GetOffset())
+	if _, ok := err.(*ErrCorrupt); !ok {
+		t.Fatalf("read of a corrupt mapped block: %v", err)
+	}
+	b.Release()
+	// a range of it is verified through the mapping
+	err, _, br := c.TransferRange(slot.GetOffset(), 10, 20)
+	if _, ok := err.(*ErrCorrupt); !ok {
+		t.Fatalf("range of a corrupt mapped block: %v", err)
+	}
+	if br != nil || c.m.refs != 1 {
+		t.Fatalf("%d refs after the range", c.m.refs)
+	}
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Codec is the compression a block payload is stored with. A payload
+// stored compressed has FdCompressed set and starts with the codec byte
+type Codec uint8
+
+const (
+	CodecNone Codec = 0
+	CodecGzip Codec = 1
+	CodecZstd Codec = 2
+	CodecLz4  Codec = 3
+
+	defaultCodec = CodecGzip
+)
+
+var ErrCodecUnsupported = errors.New("compression codec not supported")
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecGzip:
+		return "gzip"
+	case CodecZstd:
+		return "zstd"
+	case CodecLz4:
+		return "lz4"
+	}
+	return fmt.Sprintf("codec %d", uint8(c))
+}
+
+// ParseCodec returns the codec of the name String gives
+func ParseCodec(s string) (Codec, error) {
+	for c := CodecNone; c <= CodecLz4; c++ {
+		if c.String() == s {
+			return c, nil
+		}
+	}
+	return CodecNone, fmt.Errorf("%q: %w", s, ErrCodecUnsupported)
+}
+
+// check the build has an implementation of the codec
+func (c Codec) check() error {
+	switch c {
+	case CodecNone, CodecGzip, CodecZstd, CodecLz4:
+		return nil
+	}
+	return fmt.Errorf("%v: %w", c, ErrCodecUnsupported)
+}
+
+// writer compressing into w, the caller must close it to flush the end
+func (c Codec) writer(w io.Writer) (io.WriteCloser, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	switch c {
+	case CodecZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	case CodecLz4:
+		return lz4.NewWriter(w), nil
+	}
+	return gzip.NewWriter(w), nil
+}
+
+// bound is the most a payload of n bytes takes compressed, led by the
+// codec byte. Deflate stores what it can't compress in blocks of up to 64k
+// with 5 bytes each, counted here for every 16k to be safe and once more
+// for the empty final block, gzip adds a header and trailer of 18. Zstd
+// and lz4 store such blocks raw with a header of 3 and 4 bytes, counted
+// for every 64k, around a frame header and trailer of 22 and 27 at most
+func (c Codec) bound(n int64) int64 {
+	switch c {
+	case CodecZstd:
+		return 1 + 22 + n + (n/65536+2)*3
+	case CodecLz4:
+		return 1 + 27 + n + (n/65536+2)*4
+	}
+	return 1 + 18 + n + (n/16383+2)*5
+}
+
+// reader decompressing r
+func (c Codec) reader(r io.Reader) (io.Reader, error) {
+	if err := c.check(); err != nil || c == CodecNone {
+		return nil, errCorruptPayload
+	}
+	switch c {
+	case CodecZstd:
+		src := &srcReader{r: r}
+		// decoded in the reading goroutine, nothing to close
+		zr, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &streamReader{r: zr, src: src}, nil
+	case CodecLz4:
+		src := &srcReader{r: r}
+		return &streamReader{r: lz4.NewReader(src), src: src}, nil
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, corruptStream(err)
+	}
+	// a payload is a single member
+	zr.Multistream(false)
+	return zr, nil
+}
+
+// encode compresses the payload into what is stored, led by the codec byte
+func (c Codec) encode(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(c))
+	w, err := c.writer(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeStored decompresses a stored payload of size bytes
+func decodeStored(stored []byte, size int64) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, errCorruptPayload
+	}
+	r, err := Codec(stored[0]).reader(bytes.NewReader(stored[1:]))
+	if err != nil {
+		return nil, err
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(r, size+1))
+	if err != nil {
+		return nil, corruptStream(err)
+	}
+	if int64(len(payload)) != size {
+		return nil, errCorruptPayload
+	}
+	return payload, nil
+}
+
+var errCorruptPayload = errors.New("corrupt compressed payload")
+
+// corruptStream takes the errors of a decompressor on a damaged stream for
+// errCorruptPayload
+func corruptStream(err error) error {
+	var ce flate.CorruptInputError
+	if err == io.ErrUnexpectedEOF || err == gzip.ErrHeader || err == gzip.ErrChecksum || errors.As(err, &ce) {
+		return errCorruptPayload
+	}
+	return err
+}
+
+// srcReader keeps the first error of the stored bytes it reads besides
+// io.EOF, for streamReader
+type srcReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *srcReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF && s.err == nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// streamReader takes every error of a decompressor for errCorruptPayload
+// unless reading the stored bytes failed, the decompressors of zstd and
+// lz4 have too many to list
+type streamReader struct {
+	r   io.Reader
+	src *srcReader
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	if s.src.err != nil {
+		return n, s.src.err
+	}
+	return n, errCorruptPayload
+}
+
+// readerFunc is an io.Reader of its Read
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// decodeReader streams the payload of a compressed block out of the
+// stored bytes read from src. The decompressor is opened on the first
+// read, skip bytes of the payload are dropped and at most n read after
+type decodeReader struct {
+	src  io.Reader
+	r    io.Reader
+	skip int64
+	n    int64
+	// read up to the end, the size is checked and src drained so its
+	// checksum is
+	whole bool
+}
+
+func (d *decodeReader) Read(p []byte) (int, error) {
+	if d.r == nil {
+		var c [1]byte
+		if _, err := io.ReadFull(d.src, c[:]); err != nil {
+			return 0, err
+		}
+		r, err := Codec(c[0]).reader(d.src)
+		if err != nil {
+			return 0, err
+		}
+		d.r = r
+		if _, err := io.CopyN(ioutil.Discard, d.r, d.skip); err == io.EOF {
+			return 0, errCorruptPayload
+		} else if err != nil {
+			return 0, corruptStream(err)
+		}
+	}
+	if d.n <= 0 {
+		if !d.whole {
+			return 0, io.EOF
+		}
+		// nothing may follow the payload
+		if m, err := d.r.Read(make([]byte, 1)); m > 0 {
+			return 0, errCorruptPayload
+		} else if err != io.EOF {
+			return 0, corruptStream(err)
+		}
+		if _, err := io.Copy(ioutil.Discard, d.src); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > d.n {
+		p = p[:d.n]
+	}
+	m, err := d.r.Read(p)
+	d.n -= int64(m)
+	if err == io.EOF && d.n > 0 {
+		err = errCorruptPayload
+	} else if err == io.EOF {
+		err = nil
+	}
+	return m, corruptStream(err)
+}
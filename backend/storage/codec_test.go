@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+// a payload gzip gets well under its size
+func compressible(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < n; i++ {
+		fmt.Fprintf(&buf, "line %d of a log that repeats itself\n", i%50)
+	}
+	return buf.Bytes()[:n]
+}
+
+func TestStorage_Compressed(t *testing.T) {
+	opts := tempOptions(t)
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	text := compressible(3000)
+	err, id := s.Store("plain.log", text, FdNullFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same content compressed is the same object
+	if err, zid := s.StoreCodec("gzip.log", text, FdNullFlags, CodecGzip); err != nil || zid != id {
+		t.Fatalf("compressed id %s, want %s, %v", zid, id, err)
+	}
+	other := compressible(2000)
+	err, zid := s.StoreCodec("other.log", other, FdNullFlags, CodecGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, e := s.Stat("other.log"); err != nil || e.Size != int64(len(other)) || e.Flags&FdCompressed != 0 {
+		t.Fatalf("entry %+v, %v", e, err)
+	}
+
+	check := func(s *Storage) {
+		err, c := s.getChunk(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, slot := s.index.find(zid)
+		err, b := c.ReadBlock(slot.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.flags&FdCompressed == 0 || b.Size() != int64(len(other)) || b.StoredSize() >= b.Size() {
+			t.Fatalf("block of %d bytes stored in %d, flags %x", b.Size(), b.StoredSize(), b.flags)
+		}
+		b.Release()
+
+		if err, _, f := s.Read(zid); err != nil || !bytes.Equal(f, other) {
+			t.Fatalf("read: %v", err)
+		}
+		err, _, sz, r := s.Transfer(zid)
+		if err != nil || sz != int64(len(other)) {
+			t.Fatalf("transfer of %d bytes: %v", sz, err)
+		}
+		var buf bytes.Buffer
+		if _, err := r.WriteTo(&buf); err != nil || !bytes.Equal(buf.Bytes(), other) {
+			t.Fatalf("transfer: %v", err)
+		}
+		r.Close()
+		if err, f := s.ReadRange(zid, 1500, 1000); err != nil || !bytes.Equal(f, other[1500:]) {
+			t.Fatalf("range: %v", err)
+		}
+		if err, f := s.ReadRange(zid, 10, 20); err != nil || !bytes.Equal(f, other[10:30]) {
+			t.Fatalf("range: %v", err)
+		}
+	}
+	check(s)
+	if err := s.RegenerateIndex(); err != nil {
+		t.Fatal(err)
+	}
+	check(s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err, r := Fsck(opts, false); err != nil || len(r.Problems) != 0 {
+		t.Fatalf("fsck %+v, %v", r, err)
+	}
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	check(s)
+}
+
+func TestStorage_CompressedReader(t *testing.T) {
+	s := NewStorage(partOptions(t))
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.CreateBucket("logs", BucketConfig{DefaultFlags: FdCompressed, Codec: CodecGzip}); err != nil {
+		t.Fatal(err)
+	}
+	err, b := s.GetBucket("logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small, large := compressible(800), compressible(3500)
+	for key, f := range map[string][]byte{"small.log": small, "large.log": large} {
+		err, id := b.PutReader(key, bytes.NewReader(f), int64(len(f)), FdNullFlags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != HashSha256.Sum(f) {
+			t.Fatalf("%s: id %s", key, id)
+		}
+		err, e, got := b.Get(key)
+		if err != nil || !bytes.Equal(got, f) || e.Size != int64(len(f)) {
+			t.Fatalf("%s: entry %+v, %v", key, e, err)
+		}
+		err, r := s.ReadRange(id, 700, 200)
+		if err != nil || !bytes.Equal(r, f[700:900]) && !bytes.Equal(r, f[700:]) {
+			t.Fatalf("%s: range %v", key, err)
+		}
+	}
+	// the parts are compressed, the manifest is not
+	err, m := s.readManifest(HashSha256.Sum(large))
+	if err != nil || m == nil {
+		t.Fatalf("manifest %v, %v", m, err)
+	}
+	for _, p := range m.parts {
+		_, slot := s.index.find(p.id)
+		err, c := s.getChunk(slot.chunkFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err, pb := c.ReadBlock(slot.offset)
+		if err != nil || pb.flags&FdCompressed == 0 || pb.StoredSize() >= pb.Size() {
+			t.Fatalf("part %s of %d bytes stored in %d, %v", p.id, pb.Size(), pb.StoredSize(), err)
+		}
+		pb.Release()
+	}
+
+	if err, _ := s.StoreCodec("z.log", small, FdNullFlags, Codec(9)); !errors.Is(err, ErrCodecUnsupported) {
+		t.Fatalf("unknown codec: %v", err)
+	}
+	if err, _ := s.StoreReader("z.log", bytes.NewReader(small), int64(len(small)), FdCompressed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorage_Codecs(t *testing.T) {
+	opts := tempOptions(t)
+	opts.SmallObjectSize = 1000
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, codec := range []Codec{CodecGzip, CodecZstd, CodecLz4} {
+		// put whole and streamed into the chunk
+		for i, f := range [][]byte{compressible(900), compressible(5000 + int(codec))} {
+			f = append(f, byte(codec))
+			key := fmt.Sprintf("%v-%d.log", codec, i)
+			var err error
+			var id ObjectID
+			if i == 0 {
+				err, id = s.StoreCodec(key, f, FdNullFlags, codec)
+			} else {
+				err, id = s.putReader(defaultNamespace, key, bytes.NewReader(f), int64(len(f)), FdNullFlags, ObjectMeta{}, codec)
+			}
+			if err != nil || id != HashSha256.Sum(f) {
+				t.Fatalf("%s: id %s, %v", key, id, err)
+			}
+			_, slot := s.index.find(id)
+			err, c := s.getChunk(slot.chunkFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err, b := c.ReadBlock(slot.offset)
+			if err != nil || b.Payload()[0] != byte(codec) || b.StoredSize() >= b.Size() {
+				t.Fatalf("%s stored in %d bytes of %d, %v", key, b.StoredSize(), b.Size(), err)
+			}
+			b.Release()
+
+			if err, _, got := s.Read(id); err != nil || !bytes.Equal(got, f) {
+				t.Fatalf("%s: read %v", key, err)
+			}
+			err, _, sz, r := s.Transfer(id)
+			if err != nil || sz != int64(len(f)) {
+				t.Fatalf("%s: transfer of %d bytes, %v", key, sz, err)
+			}
+			got, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(got, f) {
+				t.Fatalf("%s: transfer %v", key, err)
+			}
+			if err, got := s.ReadRange(id, 300, 400); err != nil || !bytes.Equal(got, f[300:700]) {
+				t.Fatalf("%s: range %v", key, err)
+			}
+		}
+
+		// a stream that does not decompress though its crc32 holds
+		bad := []byte{byte(codec), 'n', 'o', 't', ' ', 'a', ' ', 's', 't', 'r', 'e', 'a', 'm'}
+		b := NewBlock()
+		b.SetBlock("bad.log", FdNullFlags, &bad)
+		b.flags |= FdCompressed
+		if err := s.storeBlock(b); err != nil {
+			t.Fatal(err)
+		}
+		var ec *ErrCorrupt
+		if err, _, _ := s.Read(b.ID()); !errors.As(err, &ec) {
+			t.Fatalf("%v: read of a bad stream: %v", codec, err)
+		}
+		err, _, _, r := s.Transfer(b.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(r); !errors.As(err, &ec) {
+			t.Fatalf("%v: transfer of a bad stream: %v", codec, err)
+		}
+		r.Close()
+	}
+}
+
+func TestStorage_CompressedCorrupt(t *testing.T) {
+	s := NewStorage(tempOptions(t))
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	text := compressible(2000)
+	err, id := s.StoreCodec("a.log", text, FdNullFlags, CodecGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptObject(t, s, id, 10)
+
+	var ec *ErrCorrupt
+	if err, _, _ := s.Read(id); !errors.As(err, &ec) {
+		t.Fatalf("read: %v", err)
+	}
+	err, _, _, r := s.Transfer(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); !errors.As(err, &ec) {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	// a stream that does not decompress though its crc32 holds
+	bad := []byte{byte(CodecGzip), 'n', 'o', 't', ' ', 'g', 'z', 'i', 'p'}
+	b := NewBlock()
+	b.SetBlock("bad.log", FdNullFlags, &bad)
+	b.flags |= FdCompressed
+	if err := s.storeBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	if err, _, _ := s.Read(b.ID()); !errors.As(err, &ec) || ec.Chunk != 1 {
+		t.Fatalf("read of a bad stream: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultCompactThreshold = 0.5
+
+// compactor runs compaction passes in the background
+type compactor struct {
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (s *Storage) startCompactor() {
+	cp := new(compactor)
+	cp.done = make(chan struct{})
+	cp.wg.Add(1)
+	go func() {
+		defer cp.wg.Done()
+		t := time.NewTicker(s.opts.CompactInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.Compact()
+			case <-cp.done:
+				return
+			}
+		}
+	}()
+	s.compactor = cp
+}
+
+func (s *Storage) stopCompactor() {
+	if s.compactor == nil {
+		return
+	}
+	close(s.compactor.done)
+	s.compactor.wg.Wait()
+	s.compactor = nil
+}
+
+// Compact rewrites every sealed chunk whose live ratio dropped under the
+// threshold, reads and transfers keep working while it runs
+func (s *Storage) Compact() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	if s.isClosed() {
+		return ErrClosed
+	}
+
+	err, units := ListChunkUnits(s.opts.DataDir)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	curr, err := s.currChunk.GetChunkUint()
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	compacted := false
+	for _, u := range units {
+		if u == curr {
+			continue
+		}
+		err, ratio := s.LiveRatio(u)
+		if err != nil {
+			return err
+		}
+		if ratio < s.opts.CompactThreshold {
+			if err := s.compactChunk(u); err != nil {
+				return err
+			}
+			compacted = true
+		}
+	}
+	if compacted {
+		// the moved blocks left superseded slots behind
+		return s.RebuildIndex()
+	}
+	return nil
+}
+
+// LiveRatio returns the share of block bytes in the chunk the index still
+// points at, an empty chunk counts as fully live
+func (s *Storage) LiveRatio(unit uint32) (error, float64) {
+	var live, total int64
+	slots := s.index.liveSlots(unit)
+	err := scanChunk(ChunkPath(s.opts.DataDir, unit), false, func(offset int64, b *Block) error {
+		total += b.OnDiskSize()
+		if _, ok := slots[offset]; ok && b.flags&FdDeleted == 0 {
+			live += b.OnDiskSize()
+		}
+		return nil
+	})
+	if err != nil {
+		return err, 0
+	}
+	if total == 0 {
+		return nil, 1
+	}
+	return nil, float64(live) / float64(total)
+}
+
+type movedBlock struct {
+	from IndexSlot
+	to   IndexSlot
+}
+
+// copy the live blocks of the chunk into a fresh one, switch their slots over
+// and remove the old file
+func (s *Storage) compactChunk(unit uint32) error {
+	path := ChunkPath(s.opts.DataDir, unit)
+	var dst *Chunk
+	moved := make([]movedBlock, 0)
+	start := time.Now()
+	var copied int64
+
+	slots := s.index.liveSlots(unit)
+	err := scanChunk(path, true, func(offset int64, b *Block) error {
+		from, ok := slots[offset]
+		if !ok || b.flags&FdDeleted != 0 {
+			return nil
+		}
+		if dst == nil {
+			var err error
+			if err, dst = s.createChunk(); err != nil {
+				return err
+			}
+		}
+		b.file = b.block
+		err, slot := dst.AppendBlock(b)
+		if err != nil {
+			return err
+		}
+		moved = append(moved, movedBlock{from: from, to: *slot})
+
+		copied += b.OnDiskSize()
+		s.throttle(start, copied)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if dst != nil {
+		if err := dst.Sync(); err != nil {
+			return err
+		}
+		if err := s.seal(dst); err != nil {
+			return err
+		}
+	}
+
+	// switch the slots over, a block deleted or stored again meanwhile is
+	// left alone and its copy is dead data in the new chunk. The wal is
+	// checkpointed before the chunk goes, a replay of its records would
+	// open the chunk file again
+	if err := func() error {
+		s.wmu.Lock()
+		defer s.wmu.Unlock()
+		for _, m := range moved {
+			if find, slot := s.index.find(m.from.fId); find && *slot == m.from {
+				if err := s.index.Insert(m.to); err != nil {
+					return err
+				}
+			}
+		}
+		return s.checkpoint()
+	}(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	old := s.chunkMap[unit]
+	delete(s.chunkMap, unit)
+	s.retired[unit] = true
+	s.mu.Unlock()
+	if old != nil {
+		if err := old.retire(); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if err := os.Remove(NewChunk(path, s.opts).merklePath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDir(path)
+}
+
+// sleep as long as copying ran ahead of the throttle
+func (s *Storage) throttle(start time.Time, copied int64) {
+	if s.opts.CompactThrottle <= 0 {
+		return
+	}
+	want := time.Duration(float64(copied) / float64(s.opts.CompactThrottle) * float64(time.Second))
+	if d := want - time.Since(start); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// store n distinct files into a storage with tiny segments
+func fillStorage(t *testing.T, s *Storage, n int) [][]byte {
+	files := make([][]byte, n)
+	for i := range files {
+		files[i] = bytes.Repeat([]byte(fmt.Sprintf("file %03d ", i)), 20)
+		if err, _ := s.Store(fmt.Sprintf("%d.txt", i), files[i], FdNullFlags); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
+
+func TestStorage_Compact(t *testing.T) {
+	opts := tempOptions(t)
+	opts.SegmentSize = 2048
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	files := fillStorage(t, s, 30)
+	if _, err := os.Stat(ChunkPath(opts.DataDir, 2)); err != nil {
+		t.Fatal("no rotation happened")
+	}
+
+	// kill most of the first chunk
+	deleted := make(map[int]bool)
+	for i, f := range files {
+		id := HashSha256.Sum(f)
+		if _, slot := s.index.find(id); slot.chunkFile == 1 && i%4 != 0 {
+			if err := s.Delete(id); err != nil {
+				t.Fatal(err)
+			}
+			deleted[i] = true
+		}
+	}
+	if err, ratio := s.LiveRatio(1); err != nil {
+		t.Fatal(err)
+	} else if ratio >= opts.CompactThreshold {
+		t.Fatalf("live ratio %f", ratio)
+	}
+
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(ChunkPath(opts.DataDir, 1)); !os.IsNotExist(err) {
+		t.Fatalf("compacted chunk still there: %v", err)
+	}
+	check := func(s *Storage) {
+		for i, f := range files {
+			err, _, got := s.Read(HashSha256.Sum(f))
+			if deleted[i] {
+				if err == nil {
+					t.Fatalf("file %d came back", i)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("file %d: %v", i, err)
+			}
+			if !bytes.Equal(got, f) {
+				t.Fatalf("file %d: read %q", i, got)
+			}
+		}
+	}
+	check(s)
+
+	// new files go to a chunk numbered above the compacted one
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	check(s)
+}
+
+func TestStorage_CompactCrash(t *testing.T) {
+	opts := tempOptions(t)
+	opts.SegmentSize = 2048
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	files := fillStorage(t, s, 30)
+	for _, f := range files {
+		id := HashSha256.Sum(f)
+		if _, slot := s.index.find(id); slot.chunkFile == 1 {
+			if err := s.Delete(id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// the records of the chunk are not replayed into a new empty one
+	crash(s)
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := os.Stat(ChunkPath(opts.DataDir, 1)); !os.IsNotExist(err) {
+		t.Fatalf("compacted chunk back after a crash: %v", err)
+	}
+}
+
+func TestStorage_CompactConcurrentReads(t *testing.T) {
+	opts := tempOptions(t)
+	opts.SegmentSize = 2048
+	opts.CompactThrottle = 64 * 1024
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	files := fillStorage(t, s, 30)
+	var live [][]byte
+	for i, f := range files {
+		id := HashSha256.Sum(f)
+		if _, slot := s.index.find(id); slot.chunkFile == 1 && i%3 != 0 {
+			if err := s.Delete(id); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			live = append(live, f)
+		}
+	}
+
+	// a transfer started before compaction reads on from the removed file
+	err, _, _, r := s.Transfer(HashSha256.Sum(live[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				f := live[i%len(live)]
+				if err, _, got := s.Read(HashSha256.Sum(f)); err != nil || !bytes.Equal(got, f) {
+					t.Errorf("read during compaction: %v", err)
+					return
+				}
+				err, _, _, r := s.Transfer(HashSha256.Sum(f))
+				if err != nil {
+					t.Errorf("transfer during compaction: %v", err)
+					return
+				}
+				got, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil || !bytes.Equal(got, f) {
+					t.Errorf("transfer during compaction: %v", err)
+					return
+				}
+			}
+		}(g)
+	}
+	err = s.Compact()
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, live[0]) {
+		t.Fatalf("transfer across compaction: %v %q", err, got)
+	}
+}
+
+func TestStorage_CompactMappedBlock(t *testing.T) {
+	opts := tempOptions(t)
+	opts.SegmentSize = 2048
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	files := fillStorage(t, s, 30)
+	err, c := s.getChunk(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.m == nil {
+		t.Fatal("full chunk not mapped")
+	}
+	m := c.m
+
+	// a block read before compaction keeps the mapping of the removed file
+	_, slot := s.index.find(HashSha256.Sum(files[0]))
+	err, b := c.ReadBlock(slot.offset)
+	if err != nil || b.mapping != m {
+		t.Fatalf("read of a mapped block: %v", err)
+	}
+	for i, f := range files {
+		if _, slot := s.index.find(HashSha256.Sum(f)); slot.chunkFile == 1 && i > 0 {
+			if err := s.Delete(HashSha256.Sum(f)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(ChunkPath(opts.DataDir, 1)); !os.IsNotExist(err) {
+		t.Fatalf("compacted chunk still there: %v", err)
+	}
+	if m.data == nil || !bytes.Equal(b.Payload(), files[0]) {
+		t.Fatal("mapping gone under a block")
+	}
+	b.Release()
+	if m.data != nil || m.refs != 0 {
+		t.Fatalf("mapping kept after the last release, %d refs", m.refs)
+	}
+	if err, _, f := s.Read(HashSha256.Sum(files[0])); err != nil || !bytes.Equal(f, files[0]) {
+		t.Fatalf("read after compaction: %v", err)
+	}
+}
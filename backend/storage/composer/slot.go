@@ -1,24 +1,41 @@
 package composer
 
-import "silOSS/backend/storage"
-
+// ListNode is an entry in the chain of a key hash
 type ListNode struct {
 	// key hash
 	key uint32
-	// index slot
-	value storage.IndexSlot
+	// position of the index slot
+	value int
 	// separate chaining
 	next *ListNode
 }
 
+func (n *ListNode) Key() uint32 {
+	return n.key
+}
+
+func (n *ListNode) Value() int {
+	return n.value
+}
+
+func (n *ListNode) Next() *ListNode {
+	return n.next
+}
+
+// Append links node at the rear of the chain
 func (n *ListNode) Append(node *ListNode) {
-	for next := n.next; next.next != nil; next = next.next {
-		next.next = node
+	rear := n
+	for rear.next != nil {
+		rear = rear.next
 	}
+	rear.next = node
 }
 
+// Dirt is a chained hash table from a key hash to the positions of every
+// slot stored under it, in insertion order
 type Dirt struct {
 	m map[uint32]*ListNode
+	l int
 }
 
 func NewDirt() *Dirt {
@@ -27,19 +44,30 @@ func NewDirt() *Dirt {
 	return d
 }
 
-func (d *Dirt) add(slot storage.IndexSlot) {
+func (d *Dirt) Add(key uint32, value int) {
 
 	node := new(ListNode)
-	node.key = slot.GetFileId()
-	node.value = slot
+	node.key = key
+	node.value = value
 	node.next = nil
 
-	if d.m[slot.GetFileId()] == nil {
+	if d.m[key] == nil {
 		// insert directly
-		d.m[slot.GetFileId()] = node
+		d.m[key] = node
 	} else {
 		// append to the rear
-		d.m[slot.GetFileId()].Append(node)
+		d.m[key].Append(node)
 
 	}
+	d.l++
+}
+
+// Get returns the head of the chain of key, nil if nothing was added
+func (d *Dirt) Get(key uint32) *ListNode {
+	return d.m[key]
+}
+
+// Len returns the count of added values
+func (d *Dirt) Len() int {
+	return d.l
 }
@@ -1,19 +1,47 @@
 package composer
 
 import (
-	"silOSS/backend/storage"
 	"testing"
 )
 
 func TestNewDirt(t *testing.T) {
-	idx := storage.NewIndex("/tmp/index")
-	idx.Open()
-	defer idx.Close()
-
 	dirt := NewDirt()
+	dirt.Add(1, 0)
+	dirt.Add(2, 1)
+	dirt.Add(1, 2)
+	dirt.Add(1, 3)
 
-	for _, v := range idx.GetSlots() {
-		dirt.add(v)
+	if dirt.Len() != 4 {
+		t.Fatalf("len %d, want 4", dirt.Len())
+	}
+	var got []int
+	for n := dirt.Get(1); n != nil; n = n.Next() {
+		if n.Key() != 1 {
+			t.Fatalf("key %d in chain of 1", n.Key())
+		}
+		got = append(got, n.Value())
+	}
+	if len(got) != 3 || got[0] != 0 || got[1] != 2 || got[2] != 3 {
+		t.Fatalf("chain of 1 %v, want [0 2 3]", got)
+	}
+	if n := dirt.Get(3); n != nil {
+		t.Fatalf("chain of 3 %#v", n)
+	}
+}
+
+func TestListNode_Append(t *testing.T) {
+	head := &ListNode{key: 1, value: 0}
+	for i := 1; i < 5; i++ {
+		head.Append(&ListNode{key: 1, value: i})
+	}
+	i := 0
+	for n := head; n != nil; n = n.Next() {
+		if n.Value() != i {
+			t.Fatalf("node %d holds %d", i, n.Value())
+		}
+		i++
+	}
+	if i != 5 {
+		t.Fatalf("chain length %d, want 5", i)
 	}
-	t.Logf("%#v", dirt)
 }
@@ -2,10 +2,13 @@ package storage
 
 var Engine *Storage
 
-func init() {
-	Engine = NewStorage("/tmp/chunk/1.chunk", "/tmp/index")
-	err := Engine.Open()
-	if err != nil {
-		return
+// OpenEngine opens the package level Engine with given options, it used to be
+// opened on import from hard-coded paths
+func OpenEngine(opts Options) error {
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		return err
 	}
+	Engine = s
+	return nil
 }
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The errors of the storage come in kinds: a sentinel of a kind wraps the
+// kind, so errors.Is(err, ErrNotFound) holds for a missing key, object or
+// bucket alike, while errors.Is(err, ErrKeyNotFound) tells which one it
+// was. Errors of lower layers are wrapped with %w, corruption comes as an
+// *ErrCorrupt for errors.As.
+var (
+	// ErrNotFound is the kind of every missing object, key or bucket
+	ErrNotFound = errors.New("not found")
+	// ErrExists is the kind of everything created twice
+	ErrExists = errors.New("already exists")
+	// ErrVersionMismatch is returned for a file of a format version this
+	// build does not read
+	ErrVersionMismatch = errors.New("file version not match")
+	// ErrClosed is returned by a storage used after Close
+	ErrClosed = errors.New("storage closed")
+	// ErrInvalidRange is returned for a range starting past the end of
+	// an object or of a negative offset or length
+	ErrInvalidRange = errors.New("invalid range")
+
+	ErrObjectNotFound = kindError("object not found", ErrNotFound)
+)
+
+// ErrCorrupt is returned for a chunk header or block that does not match
+// its format or crc32, or runs past the end of its chunk
+type ErrCorrupt struct {
+	Chunk  uint32
+	Offset int64
+}
+
+func (e *ErrCorrupt) Error() string {
+	return fmt.Sprintf("chunk %d corrupt at offset %d", e.Chunk, e.Offset)
+}
+
+// a sentinel of its own errors.Is also matches against its kind
+type kindErr struct {
+	msg  string
+	kind error
+}
+
+func kindError(msg string, kind error) error {
+	return &kindErr{msg: msg, kind: kind}
+}
+
+func (e *kindErr) Error() string {
+	return e.msg
+}
+
+func (e *kindErr) Unwrap() error {
+	return e.kind
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestErrors_Kinds(t *testing.T) {
+	for _, err := range []error{ErrKeyNotFound, ErrBucketNotFound, ErrObjectNotFound} {
+		if !errors.Is(err, ErrNotFound) || errors.Is(err, ErrExists) {
+			t.Errorf("%v is not of the not found kind", err)
+		}
+	}
+	if !errors.Is(ErrBucketExists, ErrExists) || errors.Is(ErrBucketExists, ErrNotFound) {
+		t.Errorf("%v is not of the exists kind", ErrBucketExists)
+	}
+	if errors.Is(ErrKeyNotFound, ErrBucketNotFound) {
+		t.Error("a missing key taken for a missing bucket")
+	}
+
+	s := NewStorage(tempOptions(t))
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err, _, _ := s.Read(HashSha256.Sum([]byte("nope"))); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("read of a missing object: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != ErrClosed {
+		t.Fatalf("second close: %v", err)
+	}
+	if err, _ := s.Store("a", []byte("a"), FdNullFlags); err != ErrClosed {
+		t.Fatalf("store after close: %v", err)
+	}
+	if err, _ := s.Stat("a"); err != ErrClosed {
+		t.Fatalf("stat after close: %v", err)
+	}
+}
+
+func TestErrors_ChunkHeader(t *testing.T) {
+	opts := tempOptions(t)
+	p := ChunkPath(opts.DataDir, 1)
+	c := NewChunk(p, opts)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the version byte follows the magic
+	b[len(chunkMagic)] = chunkFileVersion + 1
+	if err := ioutil.WriteFile(p, b, opts.FileMode); err != nil {
+		t.Fatal(err)
+	}
+	s := NewStorage(opts)
+	if err := s.Open(); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("open of a newer chunk: %v", err)
+	}
+
+	copy(b, "SILOSSX")
+	if err := ioutil.WriteFile(p, b, opts.FileMode); err != nil {
+		t.Fatal(err)
+	}
+	var corrupt *ErrCorrupt
+	s = NewStorage(opts)
+	if err := s.Open(); !errors.As(err, &corrupt) || corrupt.Chunk != 1 || corrupt.Offset != 0 {
+		t.Fatalf("open of a chunk with a bad magic: %v", err)
+	}
+}
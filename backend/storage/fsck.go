@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+// FsckKind names the kind of a problem found by Fsck
+type FsckKind string
+
+const (
+	// the chunk header is unreadable, or has a wrong magic or version
+	FsckBadHeader FsckKind = "bad_header"
+	// a block below the max offset of the chunk header can't be read
+	FsckBadBlock FsckKind = "bad_block"
+	// the payload of a block does not match its crc32
+	FsckChecksum FsckKind = "checksum"
+	// bytes behind the last whole block of a chunk, or a header not
+	// matching the blocks
+	FsckTornTail FsckKind = "torn_tail"
+	// the index file can't be read
+	FsckBadIndex FsckKind = "bad_index"
+	// a live index slot not pointing at the start of a block of its id
+	FsckDanglingSlot FsckKind = "dangling_slot"
+	// a block of an id the index never heard of
+	FsckOrphan FsckKind = "orphan"
+)
+
+// FsckProblem is an inconsistency found by Fsck
+type FsckProblem struct {
+	Kind   FsckKind `json:"kind"`
+	Chunk  uint32   `json:"chunk,omitempty"`
+	Offset int64    `json:"offset,omitempty"`
+	ID     string   `json:"id,omitempty"`
+	Detail string   `json:"detail"`
+	// fixed by the repair mode
+	Repaired bool `json:"repaired"`
+}
+
+// FsckReport is the outcome of a Fsck run
+type FsckReport struct {
+	Chunks int `json:"chunks"`
+	Blocks int `json:"blocks"`
+	// ids with a live slot in the index
+	Objects  int           `json:"objects"`
+	Problems []FsckProblem `json:"problems"`
+}
+
+// Clean reports whether no problem is left unrepaired
+func (r *FsckReport) Clean() bool {
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *FsckReport) add(p FsckProblem) int {
+	r.Problems = append(r.Problems, p)
+	return len(r.Problems) - 1
+}
+
+// a block met walking a chunk
+type fsckBlock struct {
+	offset  int64
+	id      ObjectID
+	deleted bool
+	// problem of a checksum mismatch, -1 for a sound block
+	corrupt int
+}
+
+// Fsck checks the data files under opts.DataDir: the header of every chunk,
+// the crc32 of every block, every live index slot against a block start and
+// every block against the index. The files must not be in use by a Storage,
+// a check without repair writes nothing.
+//
+// With repair, torn chunk tails are cut off and the header set to the last
+// whole block, an unreadable index is regenerated from the chunks, and
+// orphaned blocks are indexed again. Corrupt blocks and dangling slots are
+// reported only.
+func Fsck(opts Options, repair bool) (error, *FsckReport) {
+	opts.normalize()
+	r := &FsckReport{Problems: make([]FsckProblem, 0)}
+
+	err, units := ListChunkUnits(opts.DataDir)
+	if err != nil {
+		return err, nil
+	}
+	// nil blocks for a chunk with an unreadable header
+	chunks := make(map[uint32][]fsckBlock, len(units))
+	for _, u := range units {
+		err, blocks := fsckChunk(ChunkPath(opts.DataDir, u), u, opts, repair, r)
+		if err != nil {
+			return err, nil
+		}
+		chunks[u] = blocks
+		r.Chunks++
+		r.Blocks += len(blocks)
+	}
+
+	// a check only reads the index, opening it would create a missing
+	// one, cut a torn tail and migrate an old version
+	var idx *Index
+	var indexed []IndexSlot
+	if !repair {
+		if indexed, err = readIndexSlots(opts.IndexPath); err != nil {
+			r.add(FsckProblem{Kind: FsckBadIndex, Detail: err.Error()})
+			return nil, r
+		}
+	} else {
+		idx = NewIndex(opts.IndexPath, opts)
+		if err := idx.Open(); err != nil {
+			p := FsckProblem{Kind: FsckBadIndex, Detail: err.Error()}
+			// keep the broken file aside and index every chunk again
+			if err := os.Rename(opts.IndexPath, opts.IndexPath+".corrupt"); err != nil {
+				return err, nil
+			}
+			idx = NewIndex(opts.IndexPath, opts)
+			if err := idx.Open(); err != nil {
+				return err, nil
+			}
+			// the objects behind an unreadable block are left out, the
+			// index is not repaired then
+			if err := idx.Regenerate(opts.DataDir); err != nil {
+				p.Detail += ", regenerate: " + err.Error()
+			} else {
+				p.Repaired = true
+			}
+			r.add(p)
+		}
+		defer idx.Close()
+		indexed = idx.GetSlots()
+	}
+
+	known := make(map[ObjectID]bool)
+	live := make(map[ObjectID]IndexSlot)
+	for _, s := range indexed {
+		known[s.fId] = true
+		if s.IsTombstone() {
+			delete(live, s.fId)
+		} else {
+			live[s.fId] = s
+		}
+	}
+	r.Objects = len(live)
+	slots := make([]IndexSlot, 0, len(live))
+	for _, s := range live {
+		slots = append(slots, s)
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		if slots[i].chunkFile != slots[j].chunkFile {
+			return slots[i].chunkFile < slots[j].chunkFile
+		}
+		return slots[i].offset < slots[j].offset
+	})
+
+	for _, s := range slots {
+		blocks, find := chunks[s.chunkFile]
+		var detail string
+		switch i := sort.Search(len(blocks), func(i int) bool { return blocks[i].offset >= s.offset }); {
+		case !find:
+			detail = "chunk file missing"
+		case blocks == nil:
+			detail = "chunk header unreadable"
+		case i == len(blocks) || blocks[i].offset != s.offset:
+			detail = "no block starts at the offset"
+		case blocks[i].corrupt >= 0:
+			// reported as a checksum mismatch already
+			r.Problems[blocks[i].corrupt].ID = s.fId.String()
+		case blocks[i].id != s.fId:
+			detail = "block of id " + blocks[i].id.String()
+		case blocks[i].deleted:
+			detail = "block flagged deleted"
+		}
+		if detail != "" {
+			r.add(FsckProblem{Kind: FsckDanglingSlot, Chunk: s.chunkFile, Offset: s.offset, ID: s.fId.String(), Detail: detail})
+		}
+	}
+
+	// the last copy of an orphan gets indexed, as Regenerate does
+	orphans := make(map[ObjectID][]int)
+	last := make(map[ObjectID]IndexSlot)
+	order := make([]ObjectID, 0)
+	for _, u := range units {
+		for _, b := range chunks[u] {
+			if b.deleted || b.corrupt >= 0 || known[b.id] {
+				continue
+			}
+			if _, ok := orphans[b.id]; !ok {
+				order = append(order, b.id)
+			}
+			orphans[b.id] = append(orphans[b.id], r.add(FsckProblem{
+				Kind: FsckOrphan, Chunk: u, Offset: b.offset, ID: b.id.String(), Detail: "block missing from the index",
+			}))
+			last[b.id] = IndexSlot{fId: b.id, chunkFile: u, offset: b.offset}
+		}
+	}
+	if repair {
+		for _, id := range order {
+			if err := idx.Insert(last[id]); err != nil {
+				return err, nil
+			}
+			for _, i := range orphans[id] {
+				r.Problems[i].Repaired = true
+			}
+		}
+		if len(order) > 0 {
+			if err := idx.Sync(); err != nil {
+				return err, nil
+			}
+		}
+	}
+	return nil, r
+}
+
+// walk the blocks of the chunk file at path up to the first one that can't
+// be read, checking each against its crc32
+func fsckChunk(path string, unit uint32, opts Options, repair bool, r *FsckReport) (error, []fsckBlock) {
+	flag := os.O_RDONLY
+	if repair {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flag, opts.FileMode)
+	if err != nil {
+		return err, nil
+	}
+	defer f.Close()
+	c := &Chunk{path: path, w: f, opts: opts}
+	if err := c.ReadHeader(); err != nil {
+		r.add(FsckProblem{Kind: FsckBadHeader, Chunk: unit, Detail: err.Error()})
+		return nil, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err, nil
+	}
+	size := fi.Size()
+
+	blocks := make([]fsckBlock, 0)
+	rd := bufio.NewReader(io.NewSectionReader(f, ChunkHeaderSize, size-ChunkHeaderSize))
+	offset, sum, blockSize := int64(ChunkHeaderSize), int64(0), int64(0)
+	var werr error
+	for offset < size {
+		err, b := readBlockHeader(rd)
+		if err == nil && (b.fSz < 0 || b.sSz < 0 || offset+b.OnDiskSize() > size) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			b.block = make([]byte, b.sSz)
+			_, err = io.ReadFull(rd, b.block)
+		}
+		if err != nil {
+			werr = err
+			break
+		}
+
+		fb := fsckBlock{offset: offset, deleted: b.flags&FdDeleted != 0, corrupt: -1}
+		if crc := crc32.ChecksumIEEE(b.block); crc != b.crc32 {
+			fb.corrupt = r.add(FsckProblem{
+				Kind: FsckChecksum, Chunk: unit, Offset: offset,
+				Detail: fmt.Sprintf("crc32 %08x, want %08x", crc, b.crc32),
+			})
+		} else {
+			fb.id = b.ID()
+		}
+		blocks = append(blocks, fb)
+		offset += b.OnDiskSize()
+		sum++
+		blockSize += b.OnDiskSize()
+	}
+
+	if werr != nil && offset < c.maxOffset && c.maxOffset <= size {
+		// inside the part the header vouches for, not a torn append
+		r.add(FsckProblem{Kind: FsckBadBlock, Chunk: unit, Offset: offset, Detail: werr.Error()})
+		return nil, blocks
+	}
+	if size == offset && c.maxOffset == offset {
+		return nil, blocks
+	}
+	p := FsckProblem{
+		Kind: FsckTornTail, Chunk: unit, Offset: offset,
+		Detail: fmt.Sprintf("%d bytes behind the last block, header max offset %d", size-offset, c.maxOffset),
+	}
+	if repair {
+		if err := f.Truncate(offset); err != nil {
+			return err, nil
+		}
+		c.sum, c.size, c.maxOffset = sum, blockSize, offset
+		if err := c.WriteHeader(); err != nil {
+			return err, nil
+		}
+		if err := f.Sync(); err != nil {
+			return err, nil
+		}
+		p.Repaired = true
+	}
+	r.add(p)
+	return nil, blocks
+}
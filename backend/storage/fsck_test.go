@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// a storage with three objects stored and closed again
+func fsckStorage(t *testing.T) (Options, []ObjectID) {
+	opts := tempOptions(t)
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]ObjectID, 0)
+	for _, k := range []string{"a", "b", "c"} {
+		err, id := s.Store(k, []byte("payload of "+k), FdNullFlags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return opts, ids
+}
+
+func fsck(t *testing.T, opts Options, repair bool) *FsckReport {
+	t.Helper()
+	err, r := Fsck(opts, repair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// the kinds of the problems in r
+func fsckKinds(r *FsckReport) []FsckKind {
+	kinds := make([]FsckKind, 0, len(r.Problems))
+	for _, p := range r.Problems {
+		kinds = append(kinds, p.Kind)
+	}
+	return kinds
+}
+
+func TestFsck_Clean(t *testing.T) {
+	opts, _ := fsckStorage(t)
+	r := fsck(t, opts, false)
+	if len(r.Problems) != 0 || r.Chunks != 1 || r.Blocks != 3 || r.Objects != 3 {
+		t.Fatalf("report %+v", r)
+	}
+}
+
+func TestFsck_TornTail(t *testing.T) {
+	opts, ids := fsckStorage(t)
+	p := ChunkPath(opts.DataDir, 1)
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// half a block header
+	f.Write([]byte{1, 2, 3, 4, 0, 0, 0})
+	f.Close()
+
+	r := fsck(t, opts, false)
+	if len(r.Problems) != 1 || r.Problems[0].Kind != FsckTornTail || r.Problems[0].Offset != fi.Size() {
+		t.Fatalf("problems %+v", r.Problems)
+	}
+	if r = fsck(t, opts, true); !r.Clean() || len(r.Problems) != 1 {
+		t.Fatalf("repair %+v", r.Problems)
+	}
+	if got, _ := os.Stat(p); got.Size() != fi.Size() {
+		t.Fatalf("chunk size %d after repair, want %d", got.Size(), fi.Size())
+	}
+	if r = fsck(t, opts, false); len(r.Problems) != 0 {
+		t.Fatalf("problems after repair %+v", r.Problems)
+	}
+
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err, _, f := s.Read(ids[2]); err != nil || string(f) != "payload of c" {
+		t.Fatalf("read %q, %v", f, err)
+	}
+}
+
+func TestFsck_Checksum(t *testing.T) {
+	opts, ids := fsckStorage(t)
+	p := ChunkPath(opts.DataDir, 1)
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xff
+	if err := ioutil.WriteFile(p, b, opts.FileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	r := fsck(t, opts, true)
+	if len(r.Problems) != 1 || r.Problems[0].Kind != FsckChecksum || r.Problems[0].ID != ids[2].String() || r.Clean() {
+		t.Fatalf("problems %+v", r.Problems)
+	}
+}
+
+func TestFsck_Orphan(t *testing.T) {
+	opts, _ := fsckStorage(t)
+	c := NewChunk(ChunkPath(opts.DataDir, 1), opts)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	bts := []byte("never indexed")
+	b := NewBlock()
+	b.SetBlock("orphan", FdIdSha256, &bts)
+	if err, _ := c.AppendBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	r := fsck(t, opts, false)
+	if len(r.Problems) != 1 || r.Problems[0].Kind != FsckOrphan || r.Problems[0].ID != b.ID().String() {
+		t.Fatalf("problems %+v", r.Problems)
+	}
+	if r = fsck(t, opts, true); !r.Clean() {
+		t.Fatalf("repair %+v", r.Problems)
+	}
+
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err, _, f := s.Read(b.ID()); err != nil || string(f) != "never indexed" {
+		t.Fatalf("read %q, %v", f, err)
+	}
+}
+
+func TestFsck_DanglingSlot(t *testing.T) {
+	opts, ids := fsckStorage(t)
+	idx := NewIndex(opts.IndexPath, opts)
+	if err := idx.Open(); err != nil {
+		t.Fatal(err)
+	}
+	// off by one into the first block, and into a chunk that is not there
+	if err := idx.Insert(IndexSlot{fId: ids[0], chunkFile: 1, offset: ChunkHeaderSize + 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Insert(IndexSlot{fId: testId(1), chunkFile: 9, offset: ChunkHeaderSize}); err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+
+	r := fsck(t, opts, true)
+	kinds := fsckKinds(r)
+	if len(kinds) != 2 || kinds[0] != FsckDanglingSlot || kinds[1] != FsckDanglingSlot || r.Clean() {
+		t.Fatalf("problems %+v", r.Problems)
+	}
+}
+
+func TestFsck_BadHeaderAndIndex(t *testing.T) {
+	opts, ids := fsckStorage(t)
+	c := NewChunk(ChunkPath(opts.DataDir, 2), opts)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if err := ioutil.WriteFile(ChunkPath(opts.DataDir, 2), []byte("SILOSSX"), opts.FileMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(opts.IndexPath, []byte("garbage of an index file"), opts.FileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	r := fsck(t, opts, false)
+	kinds := fsckKinds(r)
+	if len(kinds) != 2 || kinds[0] != FsckBadHeader || kinds[1] != FsckBadIndex {
+		t.Fatalf("problems %+v", r.Problems)
+	}
+
+	// the index comes back from the chunks, the bad chunk stays reported
+	// and so does the index, for what the chunk held is lost to it
+	r = fsck(t, opts, true)
+	if kinds = fsckKinds(r); len(kinds) != 2 || r.Problems[1].Repaired || r.Objects != 3 {
+		t.Fatalf("repair %+v", r)
+	}
+	if _, err := os.Stat(opts.IndexPath + ".corrupt"); err != nil {
+		t.Fatal(err)
+	}
+	idx := NewIndex(opts.IndexPath, opts)
+	if err := idx.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	for _, id := range ids {
+		if find, _ := idx.find(id); !find {
+			t.Fatalf("%s not indexed again", id)
+		}
+	}
+}
+
+func TestFsck_RegenerateShort(t *testing.T) {
+	opts, ids := fsckStorage(t)
+	breakBlock(t, opts, ids[1])
+	if err := ioutil.WriteFile(opts.IndexPath, []byte("garbage of an index file"), opts.FileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	// the objects behind the bad block are not indexed again
+	r := fsck(t, opts, true)
+	kinds := fsckKinds(r)
+	if len(kinds) != 2 || kinds[0] != FsckBadBlock || kinds[1] != FsckBadIndex || r.Problems[1].Repaired || r.Objects != 1 || r.Clean() {
+		t.Fatalf("repair %+v", r)
+	}
+}
+
+func TestFsck_CheckReadOnly(t *testing.T) {
+	opts, _ := fsckStorage(t)
+	// a torn slot at the tail of the index
+	f, err := os.OpenFile(opts.IndexPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+	before, err := ioutil.ReadFile(opts.IndexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := fsck(t, opts, false); len(r.Problems) != 0 || r.Objects != 3 {
+		t.Fatalf("report %+v", r)
+	}
+	if after, _ := ioutil.ReadFile(opts.IndexPath); !bytes.Equal(after, before) {
+		t.Fatal("check wrote to the index")
+	}
+
+	// a missing index is reported, not created
+	if err := os.Remove(opts.IndexPath); err != nil {
+		t.Fatal(err)
+	}
+	if kinds := fsckKinds(fsck(t, opts, false)); len(kinds) != 1 || kinds[0] != FsckBadIndex {
+		t.Fatalf("problems %v", kinds)
+	}
+	if _, err := os.Stat(opts.IndexPath); !os.IsNotExist(err) {
+		t.Fatalf("check created the index: %v", err)
+	}
+}
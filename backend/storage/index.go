@@ -6,13 +6,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"silOSS/backend/storage/composer"
 	"silOSS/backend/utils/mmap"
 	"sync"
 )
 
 const (
-	indexVersion    = 1
+	indexVersion    = 2
+	indexVersionV1  = 1
 	indexMagic      = "SILOSS"
 	indexHeaderSize = 0 +
 		6 + 1 + // magic &version
@@ -20,29 +23,43 @@ const (
 		8 + // total size
 		0
 	indexSlotSize = 0 +
+		1 + maxIdSize + // hash algorithm & id
+		4 + // chunkFile
+		8 + // offset
+		0
+	indexSlotSizeV1 = 0 +
 		4 + // fId
 		4 + // chunkFile
 		8 + // offset
 		0
+	// offset of a slot that shadows the earlier slots of its file id
+	tombstoneOffset = -1
 )
 
+var errIndexCorrupt = errors.New("invalid index file")
+
 type Index struct {
 	// path of index file
 	path string
 	// max offset in file
 	maxOffset int64
 	data      []byte
+	// the mapped region, data is moved to heap once slots get appended
+	mapped    []byte
 	slotBytes []byte
 	slots     []IndexSlot
-	w         *os.File
-	l         int64
-	v         uint8
+	// file id to positions in slots
+	table *composer.Dirt
+	w     *os.File
+	l     int64
+	v     uint8
+	opts  Options
 	sync.RWMutex
 }
 
-// 128bit or 16 byte
+// 360bit or 45 byte, a v1 slot had a 32bit crc32 id in 16 byte
 type IndexSlot struct {
-	fId       uint32
+	fId       ObjectID
 	chunkFile uint32
 	offset    int64
 }
@@ -53,20 +70,38 @@ type IndexHeader struct {
 	Len       int64
 }
 
-func (ids *IndexSlot) GetFileId() uint32 {
+func newTombstone(fId ObjectID, chunkFile uint32) IndexSlot {
+	return IndexSlot{fId: fId, chunkFile: chunkFile, offset: tombstoneOffset}
+}
+
+// IsTombstone reports whether the slot marks its file id as deleted
+func (ids *IndexSlot) IsTombstone() bool {
+	return ids.offset == tombstoneOffset
+}
+
+func (ids *IndexSlot) GetFileId() ObjectID {
 	return ids.fId
 }
-func (ids *IndexSlot) GetChunkFile() string {
-	return getChunkPath(ids.chunkFile)
+
+// GetChunkUnit returns the unit of the chunk holding the slot
+func (ids *IndexSlot) GetChunkUnit() uint32 {
+	return ids.chunkFile
+}
+
+// GetChunkFile returns the path of the chunk holding the slot under data dir
+func (ids *IndexSlot) GetChunkFile(dir string) string {
+	return ChunkPath(dir, ids.chunkFile)
 }
 func (ids *IndexSlot) GetOffset() int64 {
 	return ids.offset
 }
 
 // NewIndex returns a new instance of Index representing the index file of given path
-func NewIndex(path string) *Index {
+func NewIndex(path string, opts Options) *Index {
 	idx := new(Index)
 	idx.path = path
+	opts.normalize()
+	idx.opts = opts
 	return idx
 }
 
@@ -74,20 +109,39 @@ func (idx *Index) GetSlots() []IndexSlot {
 	return idx.slots
 }
 
+// Header returns the header of the opened index
+func (idx *Index) Header() IndexHeader {
+	idx.RLock()
+	defer idx.RUnlock()
+	return IndexHeader{Version: idx.v, MaxOffset: idx.maxOffset, Len: idx.l}
+}
+
 func (idx *Index) Close() (err error) {
-	if idx.data != nil {
-		return mmap.UnMap(idx.data)
+	if idx.w != nil {
+		if err := idx.w.Close(); err != nil {
+			return err
+		}
+		idx.w = nil
 	}
-	return nil
+	if idx.mapped != nil {
+		err = mmap.UnMap(idx.mapped)
+		idx.mapped = nil
+	}
+	return err
+}
+
+// flush the index file to disk
+func (idx *Index) Sync() error {
+	return idx.w.Sync()
 }
 
 func (idx *Index) Open() error {
 	//var err error
 	if _, err := os.Stat(idx.path); err != nil && os.IsNotExist(err) {
-		if err := makeDir(idx.path); err != nil {
+		if err := makeDir(idx.path, idx.opts.DirMode); err != nil {
 			return err
 		}
-		f, err := os.OpenFile(idx.path, os.O_RDWR|os.O_CREATE, 0644)
+		f, err := os.OpenFile(idx.path, os.O_RDWR|os.O_CREATE, idx.opts.FileMode)
 		if err != nil {
 			return err
 		} else {
@@ -98,7 +152,7 @@ func (idx *Index) Open() error {
 		}
 		idx.w = f
 	} else if _, err := os.Stat(idx.path); err == nil {
-		f, err := os.OpenFile(idx.path, os.O_RDWR, 0644)
+		f, err := os.OpenFile(idx.path, os.O_RDWR, idx.opts.FileMode)
 		if err != nil {
 			return err
 		}
@@ -108,45 +162,70 @@ func (idx *Index) Open() error {
 		return err
 	}
 
-	if err := func() error {
+	idx.Lock()
+	defer idx.Unlock()
+	if err := idx.load(); err != nil {
+		idx.Close()
+		return err
+	}
+	return nil
+}
 
-		if _, err := os.Stat(idx.path); err != nil && !os.IsNotExist(err) {
-			return err
-		} else if err == nil {
-			// map data
-			if idx.data, err = mmap.RWMap(idx.path, 0); err != nil {
-				return err
-			}
-			// read header
+// map the index file and read its header and slots
+func (idx *Index) load() (err error) {
+	// map data
+	if idx.data, err = mmap.RWMap(idx.path, 0); err != nil {
+		return err
+	}
+	idx.mapped = idx.data
 
-			idh, err := ReadIndexHeader(idx.data)
-			if err != nil {
-				return err
-			}
+	if len(idx.data) < indexHeaderSize {
+		return errIndexCorrupt
+	}
 
-			idx.maxOffset = idh.MaxOffset
-			idx.l = idh.Len
-			idx.v = idh.Version
-
-			// read data
-			switch idx.v {
-			case indexVersion:
-				s, err := readIndexSlotsV1(idx)
-				if err != nil {
-					return err
-				}
-				idx.slots = s
-				break
-			default:
-				return errors.New("index file version not match")
-			}
-		}
+	// read header
+	idh, err := ReadIndexHeader(idx.data)
+	if err != nil {
+		return err
+	}
 
-		return nil
+	idx.maxOffset = idh.MaxOffset
+	idx.l = idh.Len
+	idx.v = idh.Version
 
-	}(); err != nil {
-		idx.Close()
-		return err
+	slotSize := indexSlotSize
+	if idx.v == indexVersionV1 {
+		slotSize = indexSlotSizeV1
+	}
+	// a crash in the middle of an insert leaves a torn slot at the tail
+	if torn := (len(idx.data) - indexHeaderSize) % slotSize; torn != 0 {
+		if err := idx.w.Truncate(int64(len(idx.data) - torn)); err != nil {
+			return err
+		}
+		idx.data = idx.data[:len(idx.data)-torn]
+	}
+
+	// read data
+	switch idx.v {
+	case indexVersion:
+		s, err := readIndexSlotsV2(idx)
+		if err != nil {
+			return err
+		}
+		idx.slots = s
+		idx.table = composer.NewDirt()
+		for i, v := range s {
+			idx.table.Add(v.fId.key(), i)
+		}
+	case indexVersionV1:
+		s, err := readIndexSlotsV1(idx)
+		if err != nil {
+			return err
+		}
+		// migrate to the current version
+		return idx.rewrite(s)
+	default:
+		return fmt.Errorf("index file version %d: %w", idx.v, ErrVersionMismatch)
 	}
 	return nil
 }
@@ -159,7 +238,7 @@ func ReadIndexHeader(data []byte) (h IndexHeader, err error) {
 	if _, err := io.ReadFull(r, magic); err != nil {
 		return h, err
 	} else if !bytes.Equal([]byte(indexMagic), magic) {
-		return h, errors.New("invalid index file")
+		return h, errIndexCorrupt
 	}
 
 	//version
@@ -214,31 +293,172 @@ func (idx *Index) Insert(slot IndexSlot) (err error) {
 
 func (idx *Index) insert(slot IndexSlot) (err error) {
 	idx.slots = append(idx.slots, slot)
+	idx.table.Add(slot.fId.key(), len(idx.slots)-1)
 	return idx.updateIndexData(slot)
 }
 
-// rebuild compact the index file
+// InsertBatch inserts the slots with one header update and one append to
+// the index file. The slots are only looked up once they are written, on
+// failure the index is left as it was, the caller cuts their blocks off
+// the chunk again
+func (idx *Index) InsertBatch(slots []IndexSlot) (err error) {
+	idx.Lock()
+	defer idx.Unlock()
+	n := len(idx.data)
+	header := append([]byte(nil), idx.data[:indexHeaderSize]...)
+	if err := idx.updateIndexData(slots...); err != nil {
+		idx.data = idx.data[:n]
+		copy(idx.data, header)
+		// whatever part of the header and slots made it to the file
+		idx.w.WriteAt(header, 0)
+		idx.w.Truncate(int64(n))
+		idx.w.Seek(0, io.SeekEnd)
+		return err
+	}
+	for _, slot := range slots {
+		idx.slots = append(idx.slots, slot)
+		idx.table.Add(slot.fId.key(), len(idx.slots)-1)
+	}
+	return nil
+}
+
+// Rebuild compacts the index file, only the last slot of every file id is
+// kept and ids whose last slot is a tombstone are dropped altogether
 func (idx *Index) Rebuild() (err error) {
-	// todo:compact index file
-	panic("not implemented")
+	idx.Lock()
+	defer idx.Unlock()
+
+	last := make(map[ObjectID]int, len(idx.slots))
+	for i, s := range idx.slots {
+		last[s.fId] = i
+	}
+	slots := make([]IndexSlot, 0, len(last))
+	for i, s := range idx.slots {
+		if last[s.fId] == i && !s.IsTombstone() {
+			slots = append(slots, s)
+		}
+	}
+	if len(slots) == len(idx.slots) {
+		return nil
+	}
+	return idx.rewrite(slots)
 }
 
-func readIndexSlotsV1(idx *Index) (slots []IndexSlot, err error) {
+// Regenerate throws the slots away and indexes again every block in the
+// chunk files of dir that is not flagged deleted, for when the index file
+// got lost or corrupt. A chunk is read up to its first unreadable block,
+// the index is written with what was read and the error of the first chunk
+// read short is returned: objects behind it are missing from the index.
+func (idx *Index) Regenerate(dir string) (err error) {
 	idx.Lock()
 	defer idx.Unlock()
+
+	err, units := ListChunkUnits(dir)
+	if err != nil {
+		return err
+	}
+	var serr error
+	last := make(map[ObjectID]int)
+	slots := make([]IndexSlot, 0)
+	for _, u := range units {
+		err := scanChunk(ChunkPath(dir, u), true, func(offset int64, b *Block) error {
+			if b.flags&FdDeleted != 0 {
+				return nil
+			}
+			slot := IndexSlot{fId: b.ID(), chunkFile: u, offset: offset}
+			// the copy a compaction left behind wins over the original
+			if i, ok := last[slot.fId]; ok {
+				slots[i] = slot
+				return nil
+			}
+			last[slot.fId] = len(slots)
+			slots = append(slots, slot)
+			return nil
+		})
+		if err != nil && serr == nil {
+			serr = err
+		}
+	}
+	if err := idx.rewrite(slots); err != nil {
+		return err
+	}
+	return serr
+}
+
+// readIndexSlots reads the slots of the index file at path without opening
+// it, the file is left as it is: a torn slot at the tail is skipped rather
+// than cut off and a v1 file is not migrated
+func readIndexSlots(path string) ([]IndexSlot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < indexHeaderSize {
+		return nil, errIndexCorrupt
+	}
+	h, err := ReadIndexHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	idx := &Index{data: data}
+	switch h.Version {
+	case indexVersion:
+		idx.data = data[:len(data)-(len(data)-indexHeaderSize)%indexSlotSize]
+		return readIndexSlotsV2(idx)
+	case indexVersionV1:
+		idx.data = data[:len(data)-(len(data)-indexHeaderSize)%indexSlotSizeV1]
+		return readIndexSlotsV1(idx)
+	}
+	return nil, fmt.Errorf("index file version %d: %w", h.Version, ErrVersionMismatch)
+}
+
+func readIndexSlotsV1(idx *Index) (slots []IndexSlot, err error) {
+	data := idx.data
+	r := bytes.NewReader(data)
+	// skip header
+	sz := len(data) - indexHeaderSize
+	sr := io.NewSectionReader(r, indexHeaderSize, int64(sz))
+	if sr.Size()%indexSlotSizeV1 != 0 {
+		return slots, errIndexCorrupt
+	}
+	slots = make([]IndexSlot, sr.Size()/indexSlotSizeV1)
+	sl := len(slots)
+	for i := 0; i < sl; i++ {
+		s := new(IndexSlot)
+		var crc uint32
+		if err := binary.Read(sr, binary.BigEndian, &crc); err != nil {
+			return nil, err
+		}
+		s.fId = crc32Id(crc)
+		if err := binary.Read(sr, binary.BigEndian, &s.chunkFile); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(sr, binary.BigEndian, &s.offset); err != nil {
+			return nil, err
+		}
+		slots[i] = *s
+	}
+
+	return slots, nil
+}
+
+func readIndexSlotsV2(idx *Index) (slots []IndexSlot, err error) {
 	data := idx.data
 	r := bytes.NewReader(data)
 	// skip header
 	sz := len(data) - indexHeaderSize
 	sr := io.NewSectionReader(r, indexHeaderSize, int64(sz))
 	if sr.Size()%indexSlotSize != 0 {
-		return slots, errors.New("invalid index size")
+		return slots, errIndexCorrupt
 	}
 	slots = make([]IndexSlot, sr.Size()/indexSlotSize)
 	sl := len(slots)
 	for i := 0; i < sl; i++ {
 		s := new(IndexSlot)
-		if err := binary.Read(sr, binary.BigEndian, &s.fId); err != nil {
+		if err := binary.Read(sr, binary.BigEndian, &s.fId.Algo); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(sr, s.fId.Sum[:]); err != nil {
 			return nil, err
 		}
 		if err := binary.Read(sr, binary.BigEndian, &s.chunkFile); err != nil {
@@ -253,19 +473,15 @@ func readIndexSlotsV1(idx *Index) (slots []IndexSlot, err error) {
 	return slots, nil
 }
 
-// append new slot to data
-func (idx *Index) updateIndexData(s IndexSlot) (err error) {
+// append new slots to data
+func (idx *Index) updateIndexData(slots ...IndexSlot) (err error) {
 	var buf bytes.Buffer
 	var wBuf bytes.Buffer
-	// write slot to []byte
-	if err := binary.Write(&buf, binary.BigEndian, s.fId); err != nil {
-		return err
-	}
-	if err := binary.Write(&buf, binary.BigEndian, s.chunkFile); err != nil {
-		return err
-	}
-	if err := binary.Write(&buf, binary.BigEndian, s.offset); err != nil {
-		return err
+	// write slots to []byte
+	for _, s := range slots {
+		if err := writeSlot(&buf, s); err != nil {
+			return err
+		}
 	}
 	// append slot bytes to file bytes
 	b := buf.Bytes()
@@ -273,10 +489,10 @@ func (idx *Index) updateIndexData(s IndexSlot) (err error) {
 	// read and update index
 	h, err := ReadIndexHeader(idx.data)
 	if err != nil {
-		return nil
+		return err
 	}
-	h.Len++
-	h.MaxOffset += indexSlotSize
+	h.Len += int64(len(slots))
+	h.MaxOffset += int64(len(slots)) * indexSlotSize
 
 	if err := binary.Write(&wBuf, binary.BigEndian, h.MaxOffset); err != nil {
 		return err
@@ -286,11 +502,8 @@ func (idx *Index) updateIndexData(s IndexSlot) (err error) {
 	}
 	wbs := wBuf.Bytes()
 
-	// update in memory data
-	for i := 6; i < indexHeaderSize-1; i++ {
-		fmt.Printf("idx.data[%d],wbs[%d]\n", i, i-6)
-		idx.data[i] = wbs[i-6]
-	}
+	// update in memory data, right behind magic and version
+	copy(idx.data[7:indexHeaderSize], wbs)
 
 	if _, err := idx.w.Seek(7, 0); err != nil {
 		return err
@@ -308,19 +521,131 @@ func (idx *Index) updateIndexData(s IndexSlot) (err error) {
 	return nil
 }
 
-func (idx *Index) find(crc32 uint32) (find bool, slot *IndexSlot) {
-	for _, v := range idx.slots {
-		if v.fId == crc32 {
-			return true, &v
+func writeSlot(w io.Writer, s IndexSlot) error {
+	if err := binary.Write(w, binary.BigEndian, s.fId.Algo); err != nil {
+		return err
+	}
+	if _, err := w.Write(s.fId.Sum[:]); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, s.chunkFile); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, s.offset)
+}
+
+// replace the index file with the given slots, the new file is written aside
+// and renamed over the old one so a crash leaves either of them intact
+func (idx *Index) rewrite(slots []IndexSlot) error {
+	var buf bytes.Buffer
+	h := NewIndexHeader()
+	h.Len = int64(len(slots))
+	h.MaxOffset = h.Len * indexSlotSize
+	if _, err := h.WriteTo(&buf); err != nil {
+		return err
+	}
+	for _, s := range slots {
+		if err := writeSlot(&buf, s); err != nil {
+			return err
+		}
+	}
+
+	tmp := idx.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, idx.opts.FileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := buf.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := idx.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, idx.path); err != nil {
+		return err
+	}
+	if err := syncDir(idx.path); err != nil {
+		return err
+	}
+	if idx.w, err = os.OpenFile(idx.path, os.O_RDWR, idx.opts.FileMode); err != nil {
+		return err
+	}
+	return idx.load()
+}
+
+// drop every slot matched by fn from the index file
+func (idx *Index) drop(fn func(s IndexSlot) bool) error {
+	idx.Lock()
+	defer idx.Unlock()
+	kept := make([]IndexSlot, 0, len(idx.slots))
+	for _, s := range idx.slots {
+		if !fn(s) {
+			kept = append(kept, s)
+		}
+	}
+	if len(kept) == len(idx.slots) {
+		return nil
+	}
+	return idx.rewrite(kept)
+}
+
+// whether the exact slot is in the index
+func (idx *Index) contains(slot IndexSlot) bool {
+	idx.RLock()
+	defer idx.RUnlock()
+	for n := idx.table.Get(slot.fId.key()); n != nil; n = n.Next() {
+		if idx.slots[n.Value()] == slot {
+			return true
 		}
 	}
-	return false, nil
+	return false
+}
+
+// find the live slot of the file id through the hash table, slots are
+// append only so the last one of an id wins and a tombstone there means the
+// file is deleted
+func (idx *Index) find(id ObjectID) (find bool, slot *IndexSlot) {
+	idx.RLock()
+	defer idx.RUnlock()
+	last := idx.lastOf(id)
+	if last < 0 || idx.slots[last].IsTombstone() {
+		return false, nil
+	}
+	v := idx.slots[last]
+	return true, &v
 }
 
-func (idx *Index) FindByMerkle(crc32 uint32) (find bool) {
-	//todo:write this
-	b, _ := idx.find(crc32)
-	return b
+// position of the last slot of id, -1 if there is none
+func (idx *Index) lastOf(id ObjectID) int {
+	last := -1
+	for n := idx.table.Get(id.key()); n != nil; n = n.Next() {
+		if idx.slots[n.Value()].fId == id {
+			last = n.Value()
+		}
+	}
+	return last
+}
+
+// the live slots pointing into the chunk, by offset
+func (idx *Index) liveSlots(unit uint32) map[int64]IndexSlot {
+	idx.RLock()
+	defer idx.RUnlock()
+	live := make(map[int64]IndexSlot)
+	for i, s := range idx.slots {
+		if s.chunkFile == unit && !s.IsTombstone() && idx.lastOf(s.fId) == i {
+			live[s.offset] = s
+		}
+	}
+	return live
 }
 
 func NewIndexHeader() (h *IndexHeader) {
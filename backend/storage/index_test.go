@@ -1,21 +1,39 @@
 package storage
 
 import (
-	"hash/crc32"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
 	"os"
+	"strconv"
 	"testing"
 )
 
+func testId(i int) ObjectID {
+	return HashSha256.Sum([]byte(strconv.Itoa(i)))
+}
+
 func TestNewIndexHeader(t *testing.T) {
 	h := NewIndexHeader()
 
-	f, _ := os.Create("/tmp/index")
-	h.WriteTo(f)
+	opts := tempOptions(t)
+	f, err := os.Create(opts.IndexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if n, err := h.WriteTo(f); err != nil {
+		t.Fatal(err)
+	} else if n != indexHeaderSize {
+		t.Fatalf("header size %d, want %d", n, indexHeaderSize)
+	}
 
 }
 
 func TestIndex_Open(t *testing.T) {
-	idx := NewIndex("/tmp/index")
+	opts := tempOptions(t)
+	idx := NewIndex(opts.IndexPath, opts)
 	err := idx.Open()
 	defer idx.Close()
 	if err != nil {
@@ -26,28 +44,333 @@ func TestIndex_Open(t *testing.T) {
 	t.Logf("max offset: %#v", idx.maxOffset)
 }
 
+func TestIndex_OpenEmpty(t *testing.T) {
+	opts := tempOptions(t)
+	idx := NewIndex(opts.IndexPath, opts)
+	if err := idx.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if h := idx.Header(); h.Version != indexVersion || h.Len != 0 || h.MaxOffset != 0 {
+		t.Fatalf("header %+v", h)
+	}
+	if len(idx.GetSlots()) != 0 {
+		t.Fatalf("slots %v", idx.GetSlots())
+	}
+}
+
 func TestIndex_Insert(t *testing.T) {
-	idx := NewIndex("/tmp/index")
+	opts := tempOptions(t)
+	idx := NewIndex(opts.IndexPath, opts)
 	err := idx.Open()
 	defer idx.Close()
 	if err != nil {
 		t.Fatal(err)
 	}
 	s := new(IndexSlot)
-	s.fId = crc32.ChecksumIEEE([]byte("hello"))
+	s.fId = HashSha256.Sum([]byte("hello"))
 	s.offset = int64(123)
 	s.chunkFile = uint32(1)
-	idx.Insert(*s)
+	if err := idx.Insert(*s); err != nil {
+		t.Fatal(err)
+	}
+	if find, _ := idx.find(s.fId); !find {
+		t.Fatal("inserted slot not found")
+	}
+}
+
+func TestIndex_InsertBatchFailed(t *testing.T) {
+	opts := tempOptions(t)
+	idx := NewIndex(opts.IndexPath, opts)
+	if err := idx.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	first := IndexSlot{fId: HashSha256.Sum([]byte("first")), chunkFile: 1, offset: ChunkHeaderSize}
+	if err := idx.InsertBatch([]IndexSlot{first}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file turns read only under the batch
+	w := idx.w
+	ro, err := os.Open(opts.IndexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.w = ro
+	lost := IndexSlot{fId: HashSha256.Sum([]byte("lost")), chunkFile: 1, offset: 200}
+	if err := idx.InsertBatch([]IndexSlot{lost}); err == nil {
+		t.Fatal("batch written to a read only file")
+	}
+	idx.w = w
+	ro.Close()
+	if find, _ := idx.find(lost.fId); find || idx.InMemoryCount() != 1 {
+		t.Fatalf("slot of a failed batch published, %d slots", idx.InMemoryCount())
+	}
+	if h, _ := ReadIndexHeader(idx.data); h.Len != 1 || len(idx.data) != indexHeaderSize+indexSlotSize {
+		t.Fatalf("header %+v over %d bytes", h, len(idx.data))
+	}
 }
 
 func TestNewIndex(t *testing.T) {
 }
 
 func TestReadIndex(t *testing.T) {
-	idx := NewIndex("/tmp/index")
+	opts := tempOptions(t)
+	idx := NewIndex(opts.IndexPath, opts)
 	err := idx.Open()
 	defer idx.Close()
 	if err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestIndex_Rebuild(t *testing.T) {
+	opts := tempOptions(t)
+	idx := NewIndex(opts.IndexPath, opts)
+	if err := idx.Open(); err != nil {
+		t.Fatal(err)
+	}
+	slots := []IndexSlot{
+		{fId: testId(1), chunkFile: 1, offset: 100},
+		{fId: testId(2), chunkFile: 1, offset: 200},
+		{fId: testId(1), chunkFile: 2, offset: 100}, // supersedes the first
+		newTombstone(testId(2), 1),                  // deletes 2
+		{fId: testId(3), chunkFile: 2, offset: 300},
+	}
+	for _, s := range slots {
+		if err := idx.Insert(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := idx.Rebuild(); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	idx = NewIndex(opts.IndexPath, opts)
+	if err := idx.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	want := []IndexSlot{slots[2], slots[4]}
+	if got := idx.GetSlots(); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("slots %#v, want %#v", got, want)
+	}
+	if idx.OnDiskCount() != 2 {
+		t.Fatalf("on disk count %d", idx.OnDiskCount())
+	}
+}
+
+func TestIndex_MigrateV1(t *testing.T) {
+	opts := tempOptions(t)
+
+	// an index from before ids were hashes, slots keyed by crc32
+	h := NewIndexHeader()
+	h.Version = indexVersionV1
+	h.Len = 3
+	h.MaxOffset = h.Len * indexSlotSizeV1
+	var buf bytes.Buffer
+	h.WriteTo(&buf)
+	for i := uint32(0); i < 3; i++ {
+		binary.Write(&buf, binary.BigEndian, 100+i)
+		binary.Write(&buf, binary.BigEndian, uint32(1))
+		binary.Write(&buf, binary.BigEndian, int64(i*10))
+	}
+	if err := ioutil.WriteFile(opts.IndexPath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := NewIndex(opts.IndexPath, opts)
+	if err := idx.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if idx.v != indexVersion {
+		t.Fatalf("index version %d after migration", idx.v)
+	}
+	for i := uint32(0); i < 3; i++ {
+		if find, slot := idx.find(crc32Id(100 + i)); !find || slot.offset != int64(i*10) {
+			t.Fatalf("slot %d lost in migration", i)
+		}
+	}
+	data, err := ioutil.ReadFile(opts.IndexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != indexHeaderSize+3*indexSlotSize {
+		t.Fatalf("migrated index size %d", len(data))
+	}
+}
+
+func TestStorage_RegenerateIndex(t *testing.T) {
+	opts := tempOptions(t)
+	opts.SegmentSize = 2048
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	files := fillStorage(t, s, 20)
+	gone := HashSha256.Sum(files[3])
+	if err := s.Delete(gone); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		s := NewStorage(opts)
+		if err := s.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		for i, f := range files {
+			err, _, got := s.Read(HashSha256.Sum(f))
+			if i == 3 {
+				if err == nil {
+					t.Fatal("deleted file came back")
+				}
+				continue
+			}
+			if err != nil || !bytes.Equal(got, f) {
+				t.Fatalf("file %d: %v %q", i, err, got)
+			}
+		}
+	}
+
+	// lost index
+	if err := os.Remove(opts.IndexPath); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// corrupt index
+	if err := ioutil.WriteFile(opts.IndexPath, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	if _, err := os.Stat(opts.IndexPath + ".corrupt"); err != nil {
+		t.Fatal("corrupt index not kept aside")
+	}
+}
+
+// breakBlock makes the block of id in a closed storage unreadable: its name
+// size runs past the end of the chunk
+func breakBlock(t *testing.T, opts Options, id ObjectID) {
+	t.Helper()
+	idx := NewIndex(opts.IndexPath, opts)
+	if err := idx.Open(); err != nil {
+		t.Fatal(err)
+	}
+	_, slot := idx.find(id)
+	idx.Close()
+	f, err := os.OpenFile(ChunkPath(opts.DataDir, slot.chunkFile), os.O_RDWR, opts.FileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte{0xff}, slot.offset+13); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorage_RegenerateShort(t *testing.T) {
+	opts := tempOptions(t)
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]ObjectID, 0)
+	for _, k := range []string{"a", "b", "c"} {
+		err, id := s.Store(k, []byte("payload of "+k), FdNullFlags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	breakBlock(t, opts, ids[1])
+	if err := os.Remove(opts.IndexPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// an open regenerating the index fails and leaves no index behind
+	s = NewStorage(opts)
+	if err := s.Open(); !errors.As(err, new(*ErrCorrupt)) {
+		t.Fatalf("open %v", err)
+	}
+	if _, err := os.Stat(opts.IndexPath); !os.IsNotExist(err) {
+		t.Fatalf("index file left, %v", err)
+	}
+
+	// what was read before the bad block is indexed all the same
+	idx := NewIndex(opts.IndexPath, opts)
+	if err := idx.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if err := idx.Regenerate(opts.DataDir); !errors.As(err, new(*ErrCorrupt)) {
+		t.Fatalf("regenerate %v", err)
+	}
+	if find, _ := idx.find(ids[0]); !find {
+		t.Fatal("object before the bad block not indexed")
+	}
+	if find, _ := idx.find(ids[2]); find {
+		t.Fatal("object behind the bad block indexed")
+	}
+}
+
+func TestIndex_Find(t *testing.T) {
+	opts := tempOptions(t)
+	idx := NewIndex(opts.IndexPath, opts)
+	if err := idx.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	for i := 0; i < 100; i++ {
+		if err := idx.Insert(IndexSlot{fId: testId(i % 10), chunkFile: 1, offset: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the last slot of an id wins
+	for i := 0; i < 10; i++ {
+		if find, slot := idx.find(testId(i)); !find || slot.offset != int64(90+i) {
+			t.Fatalf("find %d: %v %#v", i, find, slot)
+		}
+	}
+	if err := idx.Insert(newTombstone(testId(3), 1)); err != nil {
+		t.Fatal(err)
+	}
+	if find, _ := idx.find(testId(3)); find {
+		t.Fatal("found a deleted id")
+	}
+	if find, _ := idx.find(testId(10)); find {
+		t.Fatal("found an id never inserted")
+	}
+	if !idx.contains(IndexSlot{fId: testId(5), chunkFile: 1, offset: 15}) {
+		t.Fatal("superseded slot not contained")
+	}
+}
+
+func BenchmarkIndex_Find(b *testing.B) {
+	opts := tempOptions(b)
+	idx := NewIndex(opts.IndexPath, opts)
+	if err := idx.Open(); err != nil {
+		b.Fatal(err)
+	}
+	defer idx.Close()
+	ids := make([]ObjectID, 10000)
+	for i := range ids {
+		ids[i] = testId(i)
+		idx.insert(IndexSlot{fId: ids[i], chunkFile: 1, offset: int64(i)})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.find(ids[i%len(ids)])
+	}
+}
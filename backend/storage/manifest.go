@@ -0,0 +1,362 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// An object bigger than a part is split into parts of Options.PartSize,
+// each stored as an object of its own, and a manifest listing them. The
+// manifest block is flagged FdManifest and records the id of the whole
+// content, which it is indexed under, so the object is addressed like one
+// held in a single block and Read and Transfer put the parts back together.
+//
+// Parts are content addressed like any object, so two large objects may
+// share one. The storage counts the manifests listing each part and keeps
+// a part as long as a manifest or a key references it.
+const manifestVersion = 1
+
+var (
+	errInvalidManifest = errors.New("invalid manifest")
+	errPartInUse       = errors.New("object is a part of a larger object")
+)
+
+// a part of a large object, at offset of the whole content
+type manifestPart struct {
+	id     ObjectID
+	offset int64
+	size   int64
+}
+
+type manifest struct {
+	id    ObjectID
+	size  int64
+	parts []manifestPart
+}
+
+func writeManifestId(buf *bytes.Buffer, id ObjectID) {
+	buf.WriteByte(byte(id.Algo))
+	buf.Write(id.Sum[:])
+}
+
+func readManifestId(r io.Reader) (id ObjectID, err error) {
+	var algo [1]byte
+	if _, err := io.ReadFull(r, algo[:]); err != nil {
+		return id, err
+	}
+	id.Algo = HashAlgo(algo[0])
+	_, err = io.ReadFull(r, id.Sum[:])
+	return id, err
+}
+
+func (m *manifest) bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(manifestVersion)
+	writeManifestId(&buf, m.id)
+	binary.Write(&buf, binary.BigEndian, m.size)
+	binary.Write(&buf, binary.BigEndian, uint32(len(m.parts)))
+	for _, p := range m.parts {
+		writeManifestId(&buf, p.id)
+		binary.Write(&buf, binary.BigEndian, p.offset)
+		binary.Write(&buf, binary.BigEndian, p.size)
+	}
+	return buf.Bytes()
+}
+
+func readManifest(data []byte) (*manifest, error) {
+	r := bytes.NewReader(data)
+	if v, err := r.ReadByte(); err != nil || v != manifestVersion {
+		return nil, errInvalidManifest
+	}
+	m := new(manifest)
+	var err error
+	if m.id, err = readManifestId(r); err != nil {
+		return nil, errInvalidManifest
+	}
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &m.size); err != nil {
+		return nil, errInvalidManifest
+	}
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, errInvalidManifest
+	}
+	// every part takes 49 bytes, a count the data can't hold is corrupt
+	if int64(n)*(1+maxIdSize+16) != int64(r.Len()) {
+		return nil, errInvalidManifest
+	}
+	m.parts = make([]manifestPart, n)
+	var offset int64
+	for i := range m.parts {
+		p := &m.parts[i]
+		if p.id, err = readManifestId(r); err != nil {
+			return nil, errInvalidManifest
+		}
+		if err := binary.Read(r, binary.BigEndian, &p.offset); err != nil {
+			return nil, errInvalidManifest
+		}
+		if err := binary.Read(r, binary.BigEndian, &p.size); err != nil {
+			return nil, errInvalidManifest
+		}
+		if p.offset != offset || p.size <= 0 {
+			return nil, errInvalidManifest
+		}
+		offset += p.size
+	}
+	if offset != m.size {
+		return nil, errInvalidManifest
+	}
+	return m, nil
+}
+
+// storeParts streams size bytes from r into parts and stores the manifest
+// listing them, the id of the whole content is returned. Parts stored on
+// the way are deleted again when it fails. The parts are compressed by the
+// codec, the manifest never is. Called under wmu
+func (s *Storage) storeParts(name string, r io.Reader, size int64, flags int8, codec Codec) (error, ObjectID) {
+	algo := algoOfFlags(flags)
+	crc := crc32.NewIEEE()
+	var w io.Writer = crc
+	h := algo.hasher()
+	if h != nil {
+		w = io.MultiWriter(crc, h)
+	}
+	tee := io.TeeReader(r, w)
+
+	m := &manifest{size: size}
+	// parts new to the storage, no other object references them
+	stored := make([]ObjectID, 0)
+	drop := func() {
+		for _, id := range stored {
+			s.deleteObject(id)
+		}
+	}
+	for offset := int64(0); offset < size; {
+		n := size - offset
+		if n > s.opts.PartSize {
+			n = s.opts.PartSize
+		}
+		b := NewBlock()
+		b.setStream(name, flags&FdIdMask, n)
+		b.setCodec(codec)
+		err, fresh := s.streamBlock(b, tee)
+		if err != nil {
+			drop()
+			return err, ObjectID{}
+		}
+		if fresh {
+			stored = append(stored, b.ID())
+		}
+		m.parts = append(m.parts, manifestPart{id: b.ID(), offset: offset, size: n})
+		offset += n
+	}
+	m.id = algo.sumOf(h, crc.Sum32())
+
+	// stored before, maybe split at another part size: the parts new to
+	// the storage are left to nobody
+	if find, _ := s.index.find(m.id); find {
+		drop()
+		return nil, m.id
+	}
+	bts := m.bytes()
+	b := NewBlock()
+	b.SetBlock(name, flags|FdManifest, &bts)
+	if err := s.storeBlock(b); err != nil {
+		drop()
+		return err, ObjectID{}
+	}
+	return nil, m.id
+}
+
+// the manifest of the object of id, nil when it is held in a single block
+func (s *Storage) readManifest(id ObjectID) (error, *manifest) {
+	err, b, br := s.openBlock(id)
+	if err != nil {
+		return err, nil
+	}
+	defer br.Close()
+	if b.flags&FdManifest == 0 {
+		return nil, nil
+	}
+	data, err := ioutil.ReadAll(br)
+	if err != nil {
+		return err, nil
+	}
+	m, err := readManifest(data)
+	if err != nil {
+		return fmt.Errorf("object %s: %w", id, err), nil
+	}
+	return nil, m
+}
+
+// count the parts of the manifests keys reference, called once the index
+// and names are open
+func (s *Storage) loadParts() error {
+	s.parts = make(map[ObjectID]int)
+	for _, id := range s.names.flagged(FdManifest) {
+		err, m := s.readManifest(id)
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			s.addParts(m)
+		}
+	}
+	return nil
+}
+
+func (s *Storage) addParts(m *manifest) {
+	for _, p := range m.parts {
+		s.parts[p.id]++
+	}
+}
+
+// drop the parts of a manifest about to go, counted tells whether its
+// parts were counted, which they are while a key references it. A part
+// goes once nothing references it any more
+func (s *Storage) dropParts(m *manifest, counted bool) error {
+	if counted {
+		for _, p := range m.parts {
+			if s.parts[p.id]--; s.parts[p.id] <= 0 {
+				delete(s.parts, p.id)
+			}
+		}
+	}
+	for _, p := range m.parts {
+		// a part listed twice is gone the second time
+		if err := s.release(p.id, false); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ObjectReader streams an object, the payload of its block or one part
+// after the other for an object split into parts. A part is only opened
+// once the one before it went through. The caller must close it
+type ObjectReader struct {
+	s *Storage
+	// the block or part being read, nil between two parts
+	br *BlockReader
+	// parts left to open and the range of the whole content they are
+	// read in
+	parts    []manifestPart
+	off, end int64
+	// size of the whole object
+	size int64
+}
+
+// Narrow cuts the reader to length bytes of the object from off on, cut at
+// its end, before any is read. A single block is verified in full first,
+// see BlockReader.narrow, parts are verified as they are opened
+func (r *ObjectReader) Narrow(off, length int64) error {
+	if off < 0 || length < 0 || off > r.size {
+		return ErrInvalidRange
+	}
+	if length > r.size-off {
+		length = r.size - off
+	}
+	if r.br != nil {
+		if off == 0 && length == r.size {
+			return nil
+		}
+		return r.br.narrow(off, length)
+	}
+	r.off, r.end = off, off+length
+	parts := r.parts[:0]
+	for _, p := range r.parts {
+		if p.offset+p.size > r.off && p.offset < r.end {
+			parts = append(parts, p)
+		}
+	}
+	r.parts = parts
+	return nil
+}
+
+// open the next part, io.EOF when there is none left
+func (r *ObjectReader) next() error {
+	if len(r.parts) == 0 {
+		return io.EOF
+	}
+	p := r.parts[0]
+	err, b, br := r.s.openBlock(p.id)
+	if err != nil {
+		return fmt.Errorf("part %s: %w", p.id, err)
+	}
+	if b.fSz != p.size || b.flags&FdManifest != 0 {
+		br.Close()
+		return fmt.Errorf("part %s: %w", p.id, errInvalidManifest)
+	}
+	// the first and the last part may be cut by the range
+	from, to := r.off-p.offset, r.end-p.offset
+	if from < 0 {
+		from = 0
+	}
+	if to > p.size {
+		to = p.size
+	}
+	if from > 0 || to < p.size {
+		if err := br.narrow(from, to-from); err != nil {
+			br.Close()
+			return err
+		}
+	}
+	r.parts = r.parts[1:]
+	r.br = br
+	return nil
+}
+
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	for {
+		if r.br == nil {
+			if err := r.next(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.br.Read(p)
+		if err == io.EOF {
+			r.br.Close()
+			r.br = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// WriteTo hands every part to the block reader's WriteTo, so each goes to
+// the writer with sendfile where it can
+func (r *ObjectReader) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		if r.br == nil {
+			if err := r.next(); err == io.EOF {
+				return n, nil
+			} else if err != nil {
+				return n, err
+			}
+		}
+		m, err := r.br.WriteTo(w)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		r.br.Close()
+		r.br = nil
+	}
+}
+
+func (r *ObjectReader) Close() error {
+	r.parts = nil
+	if r.br == nil {
+		return nil
+	}
+	err := r.br.Close()
+	r.br = nil
+	return err
+}
@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// options of small segments, objects over a part are split
+func partOptions(t *testing.T) Options {
+	opts := tempOptions(t)
+	opts.SegmentSize = 4096
+	opts.PartSize = 1000
+	return opts
+}
+
+func partPayload(n int, seed byte) []byte {
+	bts := make([]byte, n)
+	for i := range bts {
+		bts[i] = byte(i*7) + seed
+	}
+	return bts
+}
+
+func TestManifest_Bytes(t *testing.T) {
+	m := &manifest{id: testId(1), size: 30, parts: []manifestPart{
+		{id: testId(2), offset: 0, size: 20},
+		{id: testId(3), offset: 20, size: 10},
+	}}
+	got, err := readManifest(m.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.id != m.id || got.size != m.size || len(got.parts) != 2 || got.parts[1] != m.parts[1] {
+		t.Fatalf("read back %+v", got)
+	}
+	// parts not adding up to the size
+	m.size = 31
+	if _, err := readManifest(m.bytes()); err != errInvalidManifest {
+		t.Fatalf("manifest of a wrong size: %v", err)
+	}
+}
+
+func TestStorage_LargeObject(t *testing.T) {
+	opts := partOptions(t)
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	bts := partPayload(10500, 0)
+	err, id := s.StoreReader("video.mp4", bytes.NewReader(bts), int64(len(bts)), FdNullFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != HashSha256.Sum(bts) {
+		t.Fatalf("id %s, want the id of the whole content", id)
+	}
+	// the same content stored from memory is the same object
+	if err, got := s.Store("copy.mp4", bts, FdNullFlags); err != nil || got != id {
+		t.Fatalf("store of a copy %s, %v", got, err)
+	}
+	if err, e := s.Stat("video.mp4"); err != nil || e.Size != int64(len(bts)) || e.Flags&FdManifest == 0 {
+		t.Fatalf("stat %+v, %v", e, err)
+	}
+	if err, units := ListChunkUnits(opts.DataDir); err != nil || len(units) < 3 {
+		t.Fatalf("chunks %v, %v", units, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err, name, f := s.Read(id); err != nil || name != "video.mp4" || !bytes.Equal(f, bts) {
+		t.Fatalf("read %q %d bytes, %v", name, len(f), err)
+	}
+	// both paths of the object reader
+	err, _, sz, r := s.Transfer(id)
+	if err != nil || sz != int64(len(bts)) {
+		t.Fatalf("transfer of %d bytes, %v", sz, err)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil || !bytes.Equal(buf.Bytes(), bts) {
+		t.Fatalf("transfer %d bytes, %v", buf.Len(), err)
+	}
+	r.Close()
+	err, _, _, r = s.Transfer(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(f, bts) {
+		t.Fatalf("read all %d bytes, %v", len(f), err)
+	}
+	r.Close()
+
+	// the manifest is indexed under the whole content again
+	if err := s.RegenerateIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if err, _, f := s.Read(id); err != nil || !bytes.Equal(f, bts) {
+		t.Fatalf("read after regenerating the index %d bytes, %v", len(f), err)
+	}
+}
+
+func TestStorage_SharedParts(t *testing.T) {
+	s := NewStorage(partOptions(t))
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	a := partPayload(3500, 0)
+	// the first three parts of b are those of a
+	b := append(append([]byte{}, a[:3000]...), partPayload(1200, 1)...)
+	err, ida := s.Store("a", a, FdNullFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, idb := s.Store("b", b, FdNullFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := HashSha256.Sum(a[1000:2000])
+	if err := s.Delete(shared); err != errPartInUse {
+		t.Fatalf("delete of a part: %v", err)
+	}
+
+	if err := s.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if find, _ := s.index.find(ida); find {
+		t.Fatal("manifest of a kept")
+	}
+	if find, _ := s.index.find(HashSha256.Sum(a[3000:])); find {
+		t.Fatal("last part of a kept")
+	}
+	if err, f := s.Get("b"); err != nil || !bytes.Equal(f, b) {
+		t.Fatalf("read b %d bytes, %v", len(f), err)
+	}
+
+	if err := s.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []ObjectID{idb, shared, HashSha256.Sum(b[3000:4000])} {
+		if find, _ := s.index.find(id); find {
+			t.Fatalf("%s kept with nothing referencing it", id)
+		}
+	}
+}
+
+func TestStorage_PartSizeChanged(t *testing.T) {
+	opts := partOptions(t)
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	split, whole := partPayload(3500, 3), partPayload(3000, 4)
+	err, splitId := s.Store("split", split, FdNullFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.PartSize = 4096
+	s.Close()
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	err, wholeId := s.Store("whole", whole, FdNullFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// the content of split fits a part now and that of whole no longer does
+	opts.PartSize = 1000
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err, id := s.StoreReader("whole copy", bytes.NewReader(whole), int64(len(whole)), FdNullFlags); err != nil || id != wholeId {
+		t.Fatalf("store onto a single block %s, %v", id, err)
+	}
+	if err, e := s.Stat("whole copy"); err != nil || e.Flags&FdManifest != 0 {
+		t.Fatalf("entry %+v, %v", e, err)
+	}
+	s.opts.PartSize = 4096
+	if err, id := s.Store("split copy", split, FdNullFlags); err != nil || id != splitId {
+		t.Fatalf("store onto a manifest %s, %v", id, err)
+	}
+	if err, e := s.Stat("split copy"); err != nil || e.Flags&FdManifest == 0 {
+		t.Fatalf("entry %+v, %v", e, err)
+	}
+
+	// the parts go with the last key of the manifest
+	for _, k := range []string{"split", "split copy", "whole", "whole copy"} {
+		if err := s.Remove(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []ObjectID{splitId, wholeId, HashSha256.Sum(split[:1000]), HashSha256.Sum(split[3000:])} {
+		if find, _ := s.index.find(id); find {
+			t.Fatalf("%s kept with nothing referencing it", id)
+		}
+	}
+}
+
+func TestStorage_ReadRange(t *testing.T) {
+	s := NewStorage(partOptions(t))
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	small := partPayload(600, 2)
+	large := partPayload(3500, 3)
+	err, ids := s.Store("small", small, FdNullFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, idl := s.Store("large", large, FdNullFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		id          ObjectID
+		bts         []byte
+		off, length int64
+	}{
+		{ids, small, 0, 600},
+		{ids, small, 10, 20},
+		{ids, small, 590, 100},
+		{ids, small, 600, 10},
+		// within a part, across parts and up to the end
+		{idl, large, 1200, 300},
+		{idl, large, 900, 2200},
+		{idl, large, 3000, 1000},
+		{idl, large, 0, 3500},
+	} {
+		end := c.off + c.length
+		if end > int64(len(c.bts)) {
+			end = int64(len(c.bts))
+		}
+		err, f := s.ReadRange(c.id, c.off, c.length)
+		if err != nil || !bytes.Equal(f, c.bts[c.off:end]) {
+			t.Fatalf("range %d+%d of %s: %d bytes, %v", c.off, c.length, c.id, len(f), err)
+		}
+	}
+	if err, _ := s.ReadRange(ids, 601, 1); err != ErrInvalidRange {
+		t.Fatalf("range past the end: %v", err)
+	}
+	if err, _ := s.ReadRange(idl, 3501, 1); err != ErrInvalidRange {
+		t.Fatalf("range past the end of a manifest: %v", err)
+	}
+
+	// the chunk reader starts right at the range
+	find, slot := s.index.find(ids)
+	if !find {
+		t.Fatal("small not indexed")
+	}
+	err, c := s.getChunk(slot.chunkFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, _, br := c.TransferRange(slot.offset, 100, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+	if f, err := ioutil.ReadAll(br); err != nil || !bytes.Equal(f, small[100:150]) {
+		t.Fatalf("chunk range %d bytes, %v", len(f), err)
+	}
+}
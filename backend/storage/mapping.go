@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"bytes"
+	"hash/crc32"
+	"sync/atomic"
+
+	"silOSS/backend/utils/mmap"
+)
+
+// chunkMapping is the read only mapping of a sealed chunk file. The chunk
+// holds a reference until it is retired or closed and every block read
+// out of the mapping holds one until it is released, the memory is only
+// unmapped once the last reference is gone, so a compaction or close never
+// pulls it from under a reader
+type chunkMapping struct {
+	data []byte
+	refs int32
+}
+
+func newChunkMapping(data []byte) *chunkMapping {
+	return &chunkMapping{data: data, refs: 1}
+}
+
+// take a reference, only while the chunk still holds its own
+func (m *chunkMapping) acquire() {
+	atomic.AddInt32(&m.refs, 1)
+}
+
+func (m *chunkMapping) release() error {
+	if atomic.AddInt32(&m.refs, -1) > 0 {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return mmap.UnMap(data)
+}
+
+// seal maps the chunk read only, blocks are then read straight out of the
+// mapping. Only a chunk that is no longer appended to is sealed, the
+// mapping covers the blocks up to maxOffset
+func (c *Chunk) seal() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.m != nil || c.retired || c.maxOffset <= ChunkHeaderSize {
+		return nil
+	}
+	data, err := mmap.ReadOnlyMap(c.path, c.maxOffset)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		c.m = newChunkMapping(data)
+	}
+	return nil
+}
+
+// drop the reference of the chunk on its mapping, called under the lock
+func (c *Chunk) unmap() error {
+	if c.m == nil {
+		return nil
+	}
+	m := c.m
+	c.m = nil
+	return m.release()
+}
+
+// readMapped is ReadBlock out of the mapping, the payload of the block is
+// a slice of it and holds a reference until the block is released. Called
+// under the read lock
+func (c *Chunk) readMapped(offset int64) (error, *Block) {
+	err, b := c.readBlockHeader(bytes.NewReader(c.m.data[offset:]), offset)
+	if err != nil {
+		return err, nil
+	}
+	start := offset + b.OnDiskSize() - b.sSz
+	c.m.acquire()
+	b.mapping = c.m
+	b.block = c.m.data[start : start+b.sSz : start+b.sSz]
+	if crc32.ChecksumIEEE(b.block) != b.crc32 {
+		return c.corrupt(offset, nil), b
+	}
+	return nil, b
+}
+
+// Release gives the payload of a block read from a sealed chunk back to
+// its mapping, the payload must not be used after. It does nothing for
+// any other block
+func (b *Block) Release() {
+	if b.mapping == nil {
+		return
+	}
+	b.mapping.release()
+	b.mapping = nil
+	b.block = nil
+}
@@ -0,0 +1,379 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Every chunk keeps a Merkle tree over its blocks, in append order, and the
+// store one over the roots of its chunks, in unit order. Both are built the
+// RFC 6962 way: leaves and inner nodes are hashed with sha256 under distinct
+// prefixes and a tree of n leaves splits at the largest power of two below n.
+//
+// The leaf of a block commits to its offset and object id, so a proof ties
+// the content to its place in the store. The leaves of a chunk are kept in a
+// sidecar file next to it, rebuilt from the chunk when it does not match.
+const (
+	merkleFileSuffix = ".merkle"
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+	// offset and leaf hash
+	merkleEntrySize = 8 + sha256.Size
+)
+
+var errMerkleUnavailable = errors.New("merkle leaves of the chunk unavailable")
+
+// MerkleHash is a node of a Merkle tree
+type MerkleHash [sha256.Size]byte
+
+func (h MerkleHash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+func (h MerkleHash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h *MerkleHash) UnmarshalText(text []byte) error {
+	if hex.DecodedLen(len(text)) != len(h) {
+		return errors.New("invalid merkle hash")
+	}
+	_, err := hex.Decode(h[:], text)
+	return err
+}
+
+// a leaf of a chunk tree
+type merkleLeaf struct {
+	offset int64
+	hash   MerkleHash
+}
+
+func blockLeafHash(offset int64, id ObjectID) MerkleHash {
+	var buf bytes.Buffer
+	buf.WriteByte(merkleLeafPrefix)
+	binary.Write(&buf, binary.BigEndian, offset)
+	buf.WriteByte(byte(id.Algo))
+	buf.Write(id.Sum[:])
+	return sha256.Sum256(buf.Bytes())
+}
+
+func chunkLeafHash(unit uint32, root MerkleHash) MerkleHash {
+	var buf bytes.Buffer
+	buf.WriteByte(merkleLeafPrefix)
+	binary.Write(&buf, binary.BigEndian, unit)
+	buf.Write(root[:])
+	return sha256.Sum256(buf.Bytes())
+}
+
+func merkleNode(l, r MerkleHash) MerkleHash {
+	buf := make([]byte, 0, 1+2*sha256.Size)
+	buf = append(buf, merkleNodePrefix)
+	buf = append(buf, l[:]...)
+	buf = append(buf, r[:]...)
+	return sha256.Sum256(buf)
+}
+
+// the largest power of two below n, n > 1
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// root of the tree over the leaves, the hash of nothing for no leaves
+func merkleRoot(leaves []MerkleHash) MerkleHash {
+	switch len(leaves) {
+	case 0:
+		return sha256.Sum256(nil)
+	case 1:
+		return leaves[0]
+	}
+	k := merkleSplit(len(leaves))
+	return merkleNode(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// the sibling hashes from leaf m up to the root, bottom first
+func merkleAuditPath(m int, leaves []MerkleHash) []MerkleHash {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := merkleSplit(len(leaves))
+	if m < k {
+		return append(merkleAuditPath(m, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+	return append(merkleAuditPath(m-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
+
+// the root the audit path leads to from leaf m of a tree of n leaves, false
+// when the path can't belong to such a tree
+func merkleRootFromPath(leaf MerkleHash, m, n int, path []MerkleHash) (MerkleHash, bool) {
+	if m < 0 || m >= n {
+		return leaf, false
+	}
+	fn, sn := m, n-1
+	r := leaf
+	for _, p := range path {
+		if sn == 0 {
+			return r, false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNode(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNode(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return r, sn == 0
+}
+
+// MerkleProof proves a block is part of its chunk tree and the chunk part of
+// the store tree
+type MerkleProof struct {
+	ID     ObjectID `json:"id"`
+	Chunk  uint32   `json:"chunk"`
+	Offset int64    `json:"offset"`
+	// the leaf of the block in its chunk tree of Leaves leaves
+	Leaf      int          `json:"leaf"`
+	Leaves    int          `json:"leaves"`
+	ChunkPath []MerkleHash `json:"chunk_path"`
+	// the leaf of the chunk in the store tree of Chunks leaves
+	ChunkLeaf int          `json:"chunk_leaf"`
+	Chunks    int          `json:"chunks"`
+	StorePath []MerkleHash `json:"store_path"`
+}
+
+// Verify reports whether the proof leads from its block to the store root.
+// The id commits to the content, an auditor holding the payload checks it
+// hashes to the id first
+func (p *MerkleProof) Verify(root MerkleHash) bool {
+	chunkRoot, ok := merkleRootFromPath(blockLeafHash(p.Offset, p.ID), p.Leaf, p.Leaves, p.ChunkPath)
+	if !ok {
+		return false
+	}
+	got, ok := merkleRootFromPath(chunkLeafHash(p.Chunk, chunkRoot), p.ChunkLeaf, p.Chunks, p.StorePath)
+	return ok && got == root
+}
+
+// path of the leaves file of the chunk
+func (c *Chunk) merklePath() string {
+	return strings.TrimSuffix(c.path, chunkFileSuffix) + merkleFileSuffix
+}
+
+// open the leaves file of the chunk, it is rebuilt from the blocks when it
+// does not hold a leaf for each of them. A chunk that can't be read through
+// stays usable, only without a tree. Called under the chunk lock
+func (c *Chunk) openLeaves(created bool) error {
+	p := c.merklePath()
+	flags := os.O_RDWR | os.O_CREATE
+	if created {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(p, flags, c.opts.FileMode)
+	if err != nil {
+		return err
+	}
+	c.mf = f
+	c.leaves, c.root = nil, nil
+	if created {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if len(data)%merkleEntrySize == 0 && int64(len(data)/merkleEntrySize) == c.sum {
+		c.leaves = make([]merkleLeaf, 0, len(data)/merkleEntrySize)
+		for i := 0; i < len(data); i += merkleEntrySize {
+			l := merkleLeaf{offset: int64(binary.BigEndian.Uint64(data[i:]))}
+			copy(l.hash[:], data[i+8:i+merkleEntrySize])
+			c.leaves = append(c.leaves, l)
+		}
+		return nil
+	}
+
+	leaves := make([]merkleLeaf, 0, c.sum)
+	err = scanChunk(c.path, true, func(offset int64, b *Block) error {
+		leaves = append(leaves, merkleLeaf{offset: offset, hash: blockLeafHash(offset, b.ID())})
+		return nil
+	})
+	if err != nil {
+		c.merkleErr = err
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, l := range leaves {
+		writeMerkleLeaf(&buf, l)
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(buf.Bytes(), 0); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	c.leaves = leaves
+	return nil
+}
+
+func writeMerkleLeaf(buf *bytes.Buffer, l merkleLeaf) {
+	binary.Write(buf, binary.BigEndian, l.offset)
+	buf.Write(l.hash[:])
+}
+
+// add the leaf of the block appended at offset
+func (c *Chunk) addLeaf(offset int64, id ObjectID) error {
+	return c.addLeaves([]int64{offset}, []ObjectID{id})
+}
+
+// add the leaves of the blocks appended at offsets in one write
+func (c *Chunk) addLeaves(offsets []int64, ids []ObjectID) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.merkleErr != nil {
+		return nil
+	}
+	leaves := make([]merkleLeaf, len(offsets))
+	var buf bytes.Buffer
+	for i, offset := range offsets {
+		leaves[i] = merkleLeaf{offset: offset, hash: blockLeafHash(offset, ids[i])}
+		writeMerkleLeaf(&buf, leaves[i])
+	}
+	if _, err := c.mf.WriteAt(buf.Bytes(), int64(len(c.leaves))*merkleEntrySize); err != nil {
+		return err
+	}
+	c.leaves = append(c.leaves, leaves...)
+	c.root = nil
+	return nil
+}
+
+// drop the leaves of blocks cut off the chunk
+func (c *Chunk) dropLeaves() error {
+	if c.merkleErr != nil || int64(len(c.leaves)) <= c.sum {
+		return nil
+	}
+	c.leaves = c.leaves[:c.sum]
+	c.root = nil
+	return c.mf.Truncate(c.sum * merkleEntrySize)
+}
+
+func (c *Chunk) leafHashes() []MerkleHash {
+	hashes := make([]MerkleHash, len(c.leaves))
+	for i, l := range c.leaves {
+		hashes[i] = l.hash
+	}
+	return hashes
+}
+
+// MerkleRoot returns the root of the tree over the blocks of the chunk
+func (c *Chunk) MerkleRoot() (error, MerkleHash) {
+	c.Lock()
+	defer c.Unlock()
+	if c.merkleErr != nil {
+		return errMerkleUnavailable, MerkleHash{}
+	}
+	if c.root == nil {
+		r := merkleRoot(c.leafHashes())
+		c.root = &r
+	}
+	return nil, *c.root
+}
+
+// the leaf of the block at offset, the size of the tree and the audit path
+func (c *Chunk) merkleProof(offset int64) (err error, leaf, leaves int, path []MerkleHash) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.merkleErr != nil {
+		return errMerkleUnavailable, 0, 0, nil
+	}
+	i := sort.Search(len(c.leaves), func(i int) bool { return c.leaves[i].offset >= offset })
+	if i == len(c.leaves) || c.leaves[i].offset != offset {
+		return errors.New("no merkle leaf for the block"), 0, 0, nil
+	}
+	return nil, i, len(c.leaves), merkleAuditPath(i, c.leafHashes())
+}
+
+// the units and roots of every chunk in the store, called under wmu so no
+// block gets appended meanwhile
+func (s *Storage) chunkRoots() (err error, units []uint32, leaves []MerkleHash) {
+	err, all := ListChunkUnits(s.opts.DataDir)
+	if err != nil {
+		return err, nil, nil
+	}
+	for _, u := range all {
+		err, c := s.getChunk(u)
+		if err == errChunkRetired {
+			continue
+		} else if err != nil {
+			return err, nil, nil
+		}
+		err, root := c.MerkleRoot()
+		if err != nil {
+			return err, nil, nil
+		}
+		units = append(units, u)
+		leaves = append(leaves, chunkLeafHash(u, root))
+	}
+	return nil, units, leaves
+}
+
+// MerkleRoot returns the root of the store tree over the roots of every
+// chunk. It changes with every block appended and when a compaction moves
+// blocks to a new chunk
+func (s *Storage) MerkleRoot() (error, MerkleHash) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.isClosed() {
+		return ErrClosed, MerkleHash{}
+	}
+	err, _, leaves := s.chunkRoots()
+	if err != nil {
+		return err, MerkleHash{}
+	}
+	return nil, merkleRoot(leaves)
+}
+
+// Prove returns the inclusion proof of the object of id and the store root
+// it leads to
+func (s *Storage) Prove(id ObjectID) (error, *MerkleProof, MerkleHash) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.isClosed() {
+		return ErrClosed, nil, MerkleHash{}
+	}
+	find, slot := s.index.find(id)
+	if !find {
+		return ErrObjectNotFound, nil, MerkleHash{}
+	}
+	err, units, leaves := s.chunkRoots()
+	if err != nil {
+		return err, nil, MerkleHash{}
+	}
+	err, c := s.getChunk(slot.chunkFile)
+	if err != nil {
+		return err, nil, MerkleHash{}
+	}
+	p := &MerkleProof{ID: id, Chunk: slot.chunkFile, Offset: slot.offset, Chunks: len(units)}
+	if err, p.Leaf, p.Leaves, p.ChunkPath = c.merkleProof(slot.offset); err != nil {
+		return err, nil, MerkleHash{}
+	}
+	p.ChunkLeaf = sort.Search(len(units), func(i int) bool { return units[i] >= slot.chunkFile })
+	p.StorePath = merkleAuditPath(p.ChunkLeaf, leaves)
+	return nil, p, merkleRoot(leaves)
+}
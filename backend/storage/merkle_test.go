@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestMerkle_AuditPath(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		leaves := make([]MerkleHash, n)
+		for i := range leaves {
+			leaves[i] = blockLeafHash(int64(i), testId(i))
+		}
+		root := merkleRoot(leaves)
+		for m := 0; m < n; m++ {
+			path := merkleAuditPath(m, leaves)
+			if got, ok := merkleRootFromPath(leaves[m], m, n, path); !ok || got != root {
+				t.Fatalf("leaf %d of %d does not lead to the root", m, n)
+			}
+			if got, ok := merkleRootFromPath(leaves[(m+1)%n], m, n, path); n > 1 && ok && got == root {
+				t.Fatalf("leaf %d of %d proven with the wrong leaf", m, n)
+			}
+			if got, ok := merkleRootFromPath(leaves[m], (m+1)%n, n, path); n > 1 && ok && got == root {
+				t.Fatalf("leaf %d of %d proven at the wrong index", m, n)
+			}
+		}
+	}
+}
+
+func TestStorage_Prove(t *testing.T) {
+	opts := tempOptions(t)
+	opts.SegmentSize = 256
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]ObjectID, 0)
+	for i := 0; i < 12; i++ {
+		err, id := s.Store("f"+strconv.Itoa(i), []byte("merkle payload "+strconv.Itoa(i)), FdNullFlags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	err, root := s.MerkleRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, units := ListChunkUnits(opts.DataDir); err != nil || len(units) < 2 {
+		t.Fatalf("objects in %d chunks, %v", len(units), err)
+	}
+
+	for _, id := range ids {
+		err, p, r := s.Prove(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != root || !p.Verify(root) {
+			t.Fatalf("proof of %s does not verify", id)
+		}
+		// the proof survives a trip through json
+		bts, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var q MerkleProof
+		if err := json.Unmarshal(bts, &q); err != nil {
+			t.Fatal(err)
+		}
+		if !q.Verify(root) {
+			t.Fatalf("proof of %s does not verify after json", id)
+		}
+		q.ID = ids[0]
+		if id != ids[0] && q.Verify(root) {
+			t.Fatal("proof verifies for another id")
+		}
+	}
+	if err, _, _ := s.Prove(testId(99)); err == nil {
+		t.Fatal("proof of an unknown id")
+	}
+
+	// a new block changes the root
+	if err, _ := s.Store("late", []byte("late payload"), FdNullFlags); err != nil {
+		t.Fatal(err)
+	}
+	if _, newRoot := s.MerkleRoot(); newRoot == root {
+		t.Fatal("root unchanged by an append")
+	}
+	_, root = s.MerkleRoot()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same root after a restart, from the leaves files and, when they
+	// are lost, from the chunks
+	for _, lose := range []bool{false, true} {
+		if lose {
+			os.Remove(NewChunk(ChunkPath(opts.DataDir, 1), opts).merklePath())
+		}
+		s = NewStorage(opts)
+		if err := s.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if _, got := s.MerkleRoot(); got != root {
+			t.Fatalf("root %s after reopen, want %s", got, root)
+		}
+		if err, p, _ := s.Prove(ids[0]); err != nil || !p.Verify(root) {
+			t.Fatalf("proof after reopen: %v", err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	namesFileName = "names"
+	// longest key a name can have
+	maxKeySize = 1024
+	// longest file name a block header can keep
+	maxBlockNameSize = 255
+	// rewrite the names file on open once it holds this many records and
+	// more than half of them are dead
+	namesCompactMin = 1024
+	// namespace of the keys stored without one
+	defaultNamespace = ""
+)
+
+// names record types
+const (
+	nameRecordPut    = 0x1 // a key maps to an object
+	nameRecordDelete = 0x2 // a key is removed
+)
+
+var (
+	ErrKeyNotFound = kindError("key not found", ErrNotFound)
+	ErrInvalidKey  = errors.New("invalid key")
+)
+
+// ObjectMeta is what a client tells about an object beside its content
+type ObjectMeta struct {
+	ContentType string
+	// entity tag handed out by the client protocol, the id when empty
+	ETag string
+}
+
+// NameEntry is what a key in a namespace maps to
+type NameEntry struct {
+	Namespace string
+	Key       string
+	ID        ObjectID
+	// size of the object payload
+	Size    int64
+	Flags   int8
+	ModTime time.Time
+	ObjectMeta
+}
+
+// Names is the persistent mapping of keys to object ids, kept beside the
+// slot index as an append only log of puts and deletes framed like the wal,
+// the live mapping is held in memory
+type Names struct {
+	path string
+	opts Options
+	w    *os.File
+	// live entries by namespace and key
+	m map[string]*NameEntry
+	// keys referencing each object
+	refs map[ObjectID]int
+	// what the objects of each namespace take up
+	usages map[string]*Usage
+	// records in the file, live or dead
+	records int
+	seq     uint64
+	size    int64
+
+	sync.RWMutex
+}
+
+func NewNames(path string, opts Options) *Names {
+	n := new(Names)
+	n.path = path
+	opts.normalize()
+	n.opts = opts
+	return n
+}
+
+// Open loads or creates the names file, a torn record at the tail is cut
+// off and a file mostly made of dead records is rewritten
+func (n *Names) Open() error {
+	n.Lock()
+	defer n.Unlock()
+
+	if err := makeDir(n.path, n.opts.DirMode); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(n.path, os.O_RDWR|os.O_CREATE, n.opts.FileMode)
+	if err != nil {
+		return err
+	}
+	n.w = f
+	if err := n.load(); err != nil {
+		f.Close()
+		return err
+	}
+	if n.records >= namesCompactMin && n.records > 2*len(n.m) {
+		return n.rewrite()
+	}
+	return nil
+}
+
+func (n *Names) load() error {
+	n.m = make(map[string]*NameEntry)
+	n.refs = make(map[ObjectID]int)
+	n.usages = make(map[string]*Usage)
+	n.records, n.seq, n.size = 0, 0, 0
+
+	r := bufio.NewReader(n.w)
+	for {
+		rec, err := readFrame(r)
+		if err == io.EOF || err == errWALTorn {
+			break
+		} else if err != nil {
+			return err
+		}
+		e, err := readNameEntry(rec.data, rec.typ == nameRecordPut)
+		if err != nil {
+			return err
+		}
+		switch rec.typ {
+		case nameRecordPut:
+			n.set(e)
+		case nameRecordDelete:
+			n.unset(e.Namespace, e.Key)
+		default:
+			return errors.New("unknown names record type")
+		}
+		n.records++
+		n.seq = rec.seq
+		n.size += walFrameHeaderSize + int64(len(rec.data))
+	}
+	if err := n.w.Truncate(n.size); err != nil {
+		return err
+	}
+	_, err := n.w.Seek(n.size, 0)
+	return err
+}
+
+func nameKey(ns, key string) string {
+	return ns + "\x00" + key
+}
+
+func (n *Names) set(e *NameEntry) (old *NameEntry) {
+	k := nameKey(e.Namespace, e.Key)
+	if old = n.m[k]; old != nil {
+		n.deref(old)
+	}
+	n.m[k] = e
+	n.refs[e.ID]++
+	u := n.usages[e.Namespace]
+	if u == nil {
+		u = new(Usage)
+		n.usages[e.Namespace] = u
+	}
+	u.Objects++
+	u.Bytes += e.Size
+	return old
+}
+
+func (n *Names) unset(ns, key string) (old *NameEntry) {
+	k := nameKey(ns, key)
+	if old = n.m[k]; old != nil {
+		delete(n.m, k)
+		n.deref(old)
+	}
+	return old
+}
+
+func (n *Names) deref(e *NameEntry) {
+	if n.refs[e.ID]--; n.refs[e.ID] <= 0 {
+		delete(n.refs, e.ID)
+	}
+	u := n.usages[e.Namespace]
+	u.Objects--
+	u.Bytes -= e.Size
+	if u.Objects <= 0 {
+		delete(n.usages, e.Namespace)
+	}
+}
+
+func (n *Names) append(typ uint8, e *NameEntry) error {
+	return n.appendAll(typ, []*NameEntry{e})
+}
+
+// append a record of the type for each entry in one write and one sync
+func (n *Names) appendAll(typ uint8, es []*NameEntry) error {
+	var buf bytes.Buffer
+	for i, e := range es {
+		rec := walRecord{typ: typ, seq: n.seq + uint64(i) + 1, data: e.bytes(typ == nameRecordPut)}
+		writeFrame(&buf, &rec)
+	}
+	sz, err := n.w.Write(buf.Bytes())
+	if err != nil {
+		// drop whatever part of the frames made it to the file
+		n.w.Truncate(n.size)
+		n.w.Seek(n.size, 0)
+		return err
+	}
+	n.seq += uint64(len(es))
+	n.size += int64(sz)
+	n.records += len(es)
+	if n.opts.WALSync == SyncAlways {
+		return n.w.Sync()
+	}
+	return nil
+}
+
+// put maps the key of e to its object, the entry it replaced is returned
+func (n *Names) put(e NameEntry) (old *NameEntry, err error) {
+	n.Lock()
+	defer n.Unlock()
+	if err := n.append(nameRecordPut, &e); err != nil {
+		return nil, err
+	}
+	return n.set(&e), nil
+}
+
+// putAll is put of every entry in order with one write to the names file,
+// the entries they replaced are returned in the same order
+func (n *Names) putAll(es []NameEntry) (olds []*NameEntry, err error) {
+	n.Lock()
+	defer n.Unlock()
+	ptrs := make([]*NameEntry, len(es))
+	for i := range es {
+		ptrs[i] = &es[i]
+	}
+	if err := n.appendAll(nameRecordPut, ptrs); err != nil {
+		return nil, err
+	}
+	olds = make([]*NameEntry, len(es))
+	for i, e := range ptrs {
+		olds[i] = n.set(e)
+	}
+	return olds, nil
+}
+
+// remove unmaps the key and returns the entry it had
+func (n *Names) remove(ns, key string) (old *NameEntry, err error) {
+	n.Lock()
+	defer n.Unlock()
+	e := n.m[nameKey(ns, key)]
+	if e == nil {
+		return nil, ErrKeyNotFound
+	}
+	if err := n.append(nameRecordDelete, e); err != nil {
+		return nil, err
+	}
+	return n.unset(ns, key), nil
+}
+
+// removeID unmaps every key referencing the object
+func (n *Names) removeID(id ObjectID) error {
+	n.Lock()
+	defer n.Unlock()
+	if n.refs[id] == 0 {
+		return nil
+	}
+	for _, e := range n.m {
+		if e.ID != id {
+			continue
+		}
+		if err := n.append(nameRecordDelete, e); err != nil {
+			return err
+		}
+		n.unset(e.Namespace, e.Key)
+	}
+	return nil
+}
+
+func (n *Names) get(ns, key string) (e NameEntry, find bool) {
+	n.RLock()
+	defer n.RUnlock()
+	if v := n.m[nameKey(ns, key)]; v != nil {
+		return *v, true
+	}
+	return e, false
+}
+
+// number of keys referencing the object
+func (n *Names) refCount(id ObjectID) int {
+	n.RLock()
+	defer n.RUnlock()
+	return n.refs[id]
+}
+
+// the ids the entries with flag set map to, each once
+func (n *Names) flagged(flag int8) []ObjectID {
+	n.RLock()
+	defer n.RUnlock()
+	ids := make([]ObjectID, 0)
+	seen := make(map[ObjectID]bool)
+	for _, e := range n.m {
+		if e.Flags&flag != 0 && !seen[e.ID] {
+			seen[e.ID] = true
+			ids = append(ids, e.ID)
+		}
+	}
+	return ids
+}
+
+// what the objects of the namespace take up
+func (n *Names) usage(ns string) Usage {
+	n.RLock()
+	defer n.RUnlock()
+	if u := n.usages[ns]; u != nil {
+		return *u
+	}
+	return Usage{}
+}
+
+// list the entries of the namespace whose key starts with prefix, ordered
+// by key
+func (n *Names) list(ns, prefix string) []NameEntry {
+	n.RLock()
+	entries := make([]NameEntry, 0)
+	for _, e := range n.m {
+		if e.Namespace == ns && strings.HasPrefix(e.Key, prefix) {
+			entries = append(entries, *e)
+		}
+	}
+	n.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+func (n *Names) Sync() error {
+	n.Lock()
+	defer n.Unlock()
+	return n.w.Sync()
+}
+
+func (n *Names) Close() error {
+	n.Lock()
+	defer n.Unlock()
+	if n.w == nil {
+		return nil
+	}
+	err := n.w.Sync()
+	if e := n.w.Close(); err == nil {
+		err = e
+	}
+	n.w = nil
+	return err
+}
+
+// replace the names file with one put record per live key, written aside
+// and renamed over the old one
+func (n *Names) rewrite() error {
+	keys := make([]string, 0, len(n.m))
+	for k := range n.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for i, k := range keys {
+		rec := walRecord{typ: nameRecordPut, seq: uint64(i + 1), data: n.m[k].bytes(true)}
+		if _, err := writeFrame(&buf, &rec); err != nil {
+			return err
+		}
+	}
+
+	if err := replaceFile(n.path, buf.Bytes(), n.opts); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(n.path, os.O_RDWR, n.opts.FileMode)
+	if err != nil {
+		return err
+	}
+	n.w.Close()
+	n.w = f
+	return n.load()
+}
+
+// a record is namespace | key, a put goes on with id | size | flags | mtime
+// | content type | etag
+func (e *NameEntry) bytes(put bool) []byte {
+	var buf bytes.Buffer
+	writeNameString(&buf, e.Namespace)
+	writeNameString(&buf, e.Key)
+	if put {
+		writeWALId(&buf, e.ID)
+		binary.Write(&buf, binary.BigEndian, e.Size)
+		binary.Write(&buf, binary.BigEndian, e.Flags)
+		binary.Write(&buf, binary.BigEndian, e.ModTime.UnixNano())
+		writeNameString(&buf, e.ContentType)
+		writeNameString(&buf, e.ETag)
+	}
+	return buf.Bytes()
+}
+
+func readNameEntry(data []byte, put bool) (e *NameEntry, err error) {
+	r := bytes.NewReader(data)
+	e = new(NameEntry)
+	if e.Namespace, err = readNameString(r); err != nil {
+		return nil, err
+	}
+	if e.Key, err = readNameString(r); err != nil {
+		return nil, err
+	}
+	if !put {
+		return e, nil
+	}
+	if e.ID, err = readWALId(r, false); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &e.Size); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &e.Flags); err != nil {
+		return nil, err
+	}
+	var mtime int64
+	if err := binary.Read(r, binary.BigEndian, &mtime); err != nil {
+		return nil, err
+	}
+	e.ModTime = time.Unix(0, mtime)
+	if r.Len() == 0 {
+		// written before entries had metadata
+		return e, nil
+	}
+	if e.ContentType, err = readNameString(r); err != nil {
+		return nil, err
+	}
+	if e.ETag, err = readNameString(r); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func writeNameString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+func readNameString(r io.Reader) (string, error) {
+	var l uint16
+	if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+		return "", err
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func validKey(key string) bool {
+	return key != "" && len(key) <= maxKeySize && !strings.ContainsRune(key, 0)
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestStorage_Get(t *testing.T) {
+	opts := tempOptions(t)
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	bts := []byte("a photo")
+	err, id := s.Store("photos/2024/a.jpg", bts, FdNullFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != HashSha256.Sum(bts) {
+		t.Fatalf("store returned id %s", id)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err, f := s.Get("photos/2024/a.jpg"); err != nil || !bytes.Equal(f, bts) {
+		t.Fatalf("get after reopen: %v %q", err, f)
+	}
+	if err, e := s.Stat("photos/2024/a.jpg"); err != nil || e.ID != id || e.Size != int64(len(bts)) {
+		t.Fatalf("stat: %v %#v", err, e)
+	}
+	if err, _ := s.Get("photos/2024/b.jpg"); err != ErrKeyNotFound {
+		t.Fatalf("get a missing key: %v", err)
+	}
+	if err, _ := s.Store("", bts, FdNullFlags); err != ErrInvalidKey {
+		t.Fatalf("store an empty key: %v", err)
+	}
+}
+
+func TestStorage_Overwrite(t *testing.T) {
+	s := NewStorage(tempOptions(t))
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	err, first := s.Store("a.txt", []byte("first"), FdNullFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, second := s.Store("a.txt", []byte("second"), FdNullFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, f := s.Get("a.txt"); err != nil || string(f) != "second" {
+		t.Fatalf("get after overwrite: %v %q", err, f)
+	}
+	if find, _ := s.index.find(first); find {
+		t.Fatal("overwritten object still live")
+	}
+
+	// an object shared by two keys outlives the overwrite of one of them
+	if err, _ := s.Store("b.txt", []byte("second"), FdNullFlags); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.index.liveSlots(1)) != 1 {
+		t.Fatal("same content stored twice")
+	}
+	if err, _ := s.Store("a.txt", []byte("third"), FdNullFlags); err != nil {
+		t.Fatal(err)
+	}
+	if err, f := s.Get("b.txt"); err != nil || string(f) != "second" {
+		t.Fatalf("get shared object: %v %q", err, f)
+	}
+
+	if err := s.Remove("b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if find, _ := s.index.find(second); find {
+		t.Fatal("object of a removed key still live")
+	}
+	if err := s.Remove("b.txt"); err != ErrKeyNotFound {
+		t.Fatalf("remove twice: %v", err)
+	}
+
+	// deleting by id drops the keys pointing at it
+	err, third := s.Store("c.txt", []byte("third"), FdNullFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(third); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.List("")) != 0 {
+		t.Fatalf("keys left after delete: %v", s.List(""))
+	}
+}
+
+func TestStorage_List(t *testing.T) {
+	s := NewStorage(tempOptions(t))
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, k := range []string{"b/2", "a/1", "b/1", "c"} {
+		if err, _ := s.Store(k, []byte(k), FdNullFlags); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := s.List("b/")
+	if len(entries) != 2 || entries[0].Key != "b/1" || entries[1].Key != "b/2" {
+		t.Fatalf("list: %v", entries)
+	}
+}
+
+func TestNames_TornTail(t *testing.T) {
+	opts := tempOptions(t)
+	n := NewNames(opts.NamesPath, opts)
+	if err := n.Open(); err != nil {
+		t.Fatal(err)
+	}
+	n.put(NameEntry{Key: "a", ID: testId(1)})
+	n.put(NameEntry{Key: "b", ID: testId(2)})
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(opts.NamesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(opts.NamesPath, fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	n = NewNames(opts.NamesPath, opts)
+	if err := n.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	if _, find := n.get(defaultNamespace, "a"); !find {
+		t.Fatal("complete record lost")
+	}
+	if _, find := n.get(defaultNamespace, "b"); find {
+		t.Fatal("torn record loaded")
+	}
+	if _, err := n.put(NameEntry{Key: "c", ID: testId(3)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNames_Compact(t *testing.T) {
+	opts := tempOptions(t)
+	n := NewNames(opts.NamesPath, opts)
+	if err := n.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < namesCompactMin; i++ {
+		n.put(NameEntry{Key: "a", ID: testId(i)})
+	}
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	n = NewNames(opts.NamesPath, opts)
+	if err := n.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	if n.records != 1 {
+		t.Fatalf("%d records after compaction", n.records)
+	}
+	if e, _ := n.get(defaultNamespace, "a"); e.ID != testId(namesCompactMin-1) {
+		t.Fatalf("compaction kept %s", e.ID)
+	}
+}
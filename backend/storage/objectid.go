@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+)
+
+// HashAlgo is the algorithm an object id is calculated by, it is kept in
+// the FdIdMask bits of the file flags
+type HashAlgo uint8
+
+const (
+	// blocks written before ids had an algorithm, their id is the crc32
+	HashNone   HashAlgo = 0
+	HashMd5    HashAlgo = FdIdMd5 >> 3
+	HashCrc32  HashAlgo = FdIdCrc32 >> 3
+	HashSha256 HashAlgo = FdIdSha256 >> 3
+
+	defaultHashAlgo = HashSha256
+	maxIdSize       = sha256.Size
+)
+
+// ObjectID addresses an object by the hash of its content, the digest is
+// left aligned in Sum
+type ObjectID struct {
+	Algo HashAlgo
+	Sum  [maxIdSize]byte
+}
+
+func algoOfFlags(flags int8) HashAlgo {
+	if a := HashAlgo(flags&FdIdMask) >> 3; a != HashNone {
+		return a
+	}
+	return HashCrc32
+}
+
+// flags returns the file flags bits of the algorithm
+func (a HashAlgo) flags() int8 {
+	return int8(a << 3)
+}
+
+// Size returns the digest size in bytes
+func (a HashAlgo) Size() int {
+	switch a {
+	case HashMd5:
+		return md5.Size
+	case HashCrc32, HashNone:
+		return crc32.Size
+	default:
+		return sha256.Size
+	}
+}
+
+func (a HashAlgo) String() string {
+	switch a {
+	case HashMd5:
+		return "md5"
+	case HashCrc32, HashNone:
+		return "crc32"
+	default:
+		return "sha256"
+	}
+}
+
+// Sum returns the id of data
+func (a HashAlgo) Sum(data []byte) ObjectID {
+	id := ObjectID{Algo: a}
+	switch a {
+	case HashMd5:
+		s := md5.Sum(data)
+		copy(id.Sum[:], s[:])
+	case HashCrc32, HashNone:
+		id.Algo = HashCrc32
+		binary.BigEndian.PutUint32(id.Sum[:], crc32.ChecksumIEEE(data))
+	default:
+		s := sha256.Sum256(data)
+		copy(id.Sum[:], s[:])
+	}
+	return id
+}
+
+// hasher returns the hash calculating the id of a payload streamed through
+// it, nil for crc32 whose id is the crc32 of the block
+func (a HashAlgo) hasher() hash.Hash {
+	switch a {
+	case HashMd5:
+		return md5.New()
+	case HashCrc32, HashNone:
+		return nil
+	default:
+		return sha256.New()
+	}
+}
+
+// the id of a payload streamed through the hasher of a, crc being its crc32
+func (a HashAlgo) sumOf(h hash.Hash, crc uint32) ObjectID {
+	if h == nil {
+		return crc32Id(crc)
+	}
+	id := ObjectID{Algo: a}
+	copy(id.Sum[:], h.Sum(nil))
+	return id
+}
+
+// ParseObjectID parses the hex form of an id, the algorithm is told apart
+// by the digest length
+func ParseObjectID(s string) (id ObjectID, err error) {
+	bts, err := hex.DecodeString(s)
+	if err != nil {
+		return id, err
+	}
+	switch len(bts) {
+	case crc32.Size:
+		id.Algo = HashCrc32
+	case md5.Size:
+		id.Algo = HashMd5
+	case sha256.Size:
+		id.Algo = HashSha256
+	default:
+		return id, errors.New("invalid object id")
+	}
+	copy(id.Sum[:], bts)
+	return id, nil
+}
+
+func crc32Id(crc uint32) ObjectID {
+	id := ObjectID{Algo: HashCrc32}
+	binary.BigEndian.PutUint32(id.Sum[:], crc)
+	return id
+}
+
+func (id ObjectID) String() string {
+	return hex.EncodeToString(id.Sum[:id.Algo.Size()])
+}
+
+func (id ObjectID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *ObjectID) UnmarshalText(text []byte) (err error) {
+	*id, err = ParseObjectID(string(text))
+	return err
+}
+
+func (id ObjectID) IsZero() bool {
+	return id == ObjectID{}
+}
+
+// key of the id in the index hash table
+func (id ObjectID) key() uint32 {
+	return binary.BigEndian.Uint32(id.Sum[:4])
+}
@@ -0,0 +1,35 @@
+package storage
+
+import "testing"
+
+func TestParseObjectID(t *testing.T) {
+	for _, a := range []HashAlgo{HashCrc32, HashMd5, HashSha256} {
+		id := a.Sum([]byte("hello"))
+		got, err := ParseObjectID(id.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != id {
+			t.Fatalf("%s: parsed %s, want %s", a, got, id)
+		}
+	}
+	if _, err := ParseObjectID("abc"); err == nil {
+		t.Fatal("odd length id parsed")
+	}
+	if _, err := ParseObjectID("0102"); err == nil {
+		t.Fatal("short id parsed")
+	}
+}
+
+func TestBlock_ID(t *testing.T) {
+	bts := []byte("hello")
+	b := NewBlock()
+	b.SetBlock("a.txt", HashSha256.flags(), &bts)
+	if b.ID() != HashSha256.Sum(bts) {
+		t.Fatalf("block id %s", b.ID())
+	}
+	b.SetBlock("a.txt", FdNullFlags, &bts)
+	if b.ID().Algo != HashCrc32 {
+		t.Fatalf("legacy block id algo %s", b.ID().Algo)
+	}
+}
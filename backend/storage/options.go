@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// file in the data dir every process working on it holds an flock on,
+	// silossd keeps its pid in it
+	LockFileName = "silossd.pid"
+
+	defaultIndexName = "index"
+	defaultFileMode  = 0644
+	defaultDirMode   = 0755
+)
+
+// Options holds everything a Storage needs to know about where and how its
+// files live on disk, so several instances can share one host
+type Options struct {
+	// directory holding the chunk segments
+	DataDir string
+	// path of the index file, <DataDir>/index when empty
+	IndexPath string
+	// path of the key to object mapping, <DataDir>/names when empty
+	NamesPath string
+	// path of the bucket catalog, <DataDir>/buckets when empty
+	BucketsPath string
+	// directory streamed puts are spooled to, <DataDir>/spool when empty
+	SpoolDir string
+	// max size of a chunk segment before rotating to a new one
+	SegmentSize int64
+	// max payload of a block, a bigger object is split into parts of this
+	// size listed by a manifest. SegmentSize when 0 and at most that
+	PartSize int64
+	// permission of created chunk and index files
+	FileMode os.FileMode
+	// permission of created directories
+	DirMode os.FileMode
+	// algorithm object ids are calculated by
+	HashAlgo HashAlgo
+
+	// path of the write-ahead log, <DataDir>/wal when empty
+	WALPath string
+	// when the write-ahead log is flushed to disk
+	WALSync SyncPolicy
+	// records between two flushes with SyncBatch
+	WALBatchSize int
+	// time between two flushes with SyncInterval
+	WALSyncInterval time.Duration
+
+	// compact a sealed chunk once its live bytes drop under this ratio
+	CompactThreshold float64
+	// time between two background compaction passes, 0 disables them
+	CompactInterval time.Duration
+	// max bytes copied per second while compacting, 0 for no limit
+	CompactThrottle int64
+
+	// read sealed chunks through the file instead of mapping them
+	DisableMmap bool
+
+	// puts of small objects coalesced into one group commit, every put is
+	// written on its own when 1 or less
+	BatchSize int
+	// longest a put waits for others to join its batch
+	BatchLatency time.Duration
+	// streamed puts of up to this size are read into memory and put like
+	// any other small object, so they are batched, bigger ones are spooled
+	// to disk. At most PartSize
+	SmallObjectSize int64
+
+	// codec objects put with FdCompressed are compressed by unless their
+	// bucket has one, gzip when CodecNone
+	Codec Codec
+}
+
+// DefaultOptions returns the default options rooted at dir
+func DefaultOptions(dir string) Options {
+	o := Options{DataDir: dir}
+	o.normalize()
+	return o
+}
+
+// fill the zero fields with defaults
+func (o *Options) normalize() {
+	if o.IndexPath == "" {
+		o.IndexPath = filepath.Join(o.DataDir, defaultIndexName)
+	}
+	if o.NamesPath == "" {
+		o.NamesPath = filepath.Join(o.DataDir, namesFileName)
+	}
+	if o.BucketsPath == "" {
+		o.BucketsPath = filepath.Join(o.DataDir, bucketsFileName)
+	}
+	if o.SpoolDir == "" {
+		o.SpoolDir = filepath.Join(o.DataDir, spoolDirName)
+	}
+	if o.SegmentSize <= 0 {
+		o.SegmentSize = defaultSegmentSize
+	}
+	if o.PartSize <= 0 || o.PartSize > o.SegmentSize {
+		o.PartSize = o.SegmentSize
+	}
+	if o.HashAlgo == HashNone {
+		o.HashAlgo = defaultHashAlgo
+	}
+	if o.FileMode == 0 {
+		o.FileMode = defaultFileMode
+	}
+	if o.DirMode == 0 {
+		o.DirMode = defaultDirMode
+	}
+	if o.WALPath == "" {
+		o.WALPath = filepath.Join(o.DataDir, walFileName)
+	}
+	if o.WALBatchSize <= 0 {
+		o.WALBatchSize = defaultWALBatchSize
+	}
+	if o.WALSyncInterval <= 0 {
+		o.WALSyncInterval = defaultWALSyncInterval
+	}
+	if o.CompactThreshold <= 0 {
+		o.CompactThreshold = defaultCompactThreshold
+	}
+	if o.BatchLatency <= 0 {
+		o.BatchLatency = defaultBatchLatency
+	}
+	if o.SmallObjectSize <= 0 {
+		o.SmallObjectSize = defaultSmallObjectSize
+	}
+	if o.SmallObjectSize > o.PartSize {
+		o.SmallObjectSize = o.PartSize
+	}
+	if o.Codec == CodecNone {
+		o.Codec = defaultCodec
+	}
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	spoolDirName = "spool"
+
+	defaultSmallObjectSize = 64 * 1024
+)
+
+// spool copies size bytes of r into a temp file of the spool dir before
+// the write lock is taken, so a slow client holds up nobody but itself.
+// The file is left at its start, the caller unspools it
+func (s *Storage) spool(r io.Reader, size int64) (error, *os.File) {
+	f, err := ioutil.TempFile(s.opts.SpoolDir, "put")
+	if err != nil {
+		return err, nil
+	}
+	n, err := io.CopyN(f, r, size)
+	if err == io.EOF {
+		err = fmt.Errorf("payload of %d bytes short of %d: %w", n, size, io.ErrUnexpectedEOF)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		s.unspool(f)
+		return err, nil
+	}
+	return nil, f
+}
+
+// Spool copies r up to its end into a temp file of the spool dir, for a
+// payload whose size is not known up front. The file is left at its start
+// to be handed to PutReader with its size, the caller removes it with
+// Unspool
+func (s *Storage) Spool(r io.Reader) (err error, f *os.File, size int64) {
+	f, err = ioutil.TempFile(s.opts.SpoolDir, "put")
+	if err != nil {
+		return err, nil, 0
+	}
+	size, err = io.Copy(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		s.unspool(f)
+		return err, nil, 0
+	}
+	return nil, f, size
+}
+
+// Unspool closes and removes a file of Spool
+func (s *Storage) Unspool(f *os.File) {
+	s.unspool(f)
+}
+
+func (s *Storage) unspool(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// empty the spool dir, files left in it belong to puts a crash cut short
+func (s *Storage) openSpool() error {
+	if err := os.RemoveAll(s.opts.SpoolDir); err != nil {
+		return err
+	}
+	return os.MkdirAll(s.opts.SpoolDir, s.opts.DirMode)
+}
+
+// readSmall reads the size bytes of a small streamed put into memory
+func readSmall(r io.Reader, size int64) (error, []byte) {
+	bts := make([]byte, size)
+	if n, err := io.ReadFull(r, bts); err == io.ErrUnexpectedEOF || err == io.EOF {
+		return fmt.Errorf("payload of %d bytes short of %d: %w", n, size, io.ErrUnexpectedEOF), nil
+	} else if err != nil {
+		return err, nil
+	}
+	return nil, bts
+}
+
+// local tells whether r is in memory or a regular file, read from without
+// waiting on anyone
+func local(r io.Reader) bool {
+	switch r := r.(type) {
+	case *bytes.Reader, *bytes.Buffer, *strings.Reader:
+		return true
+	case *os.File:
+		fi, err := r.Stat()
+		return err == nil && fi.Mode().IsRegular()
+	}
+	return false
+}
@@ -1,144 +1,1132 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// attempts of a read racing compaction before giving up
+const readRetries = 3
+
 type Storage struct {
+	opts      Options
 	index     *Index
+	names     *Names
+	catalog   *catalog
+	wal       *WAL
 	currChunk *Chunk
-	chunkList []Chunk
 	// chunk map of chunk name and chunk instance
 	chunkMap map[uint32]*Chunk
+	// chunks compacted away, never to be opened again
+	retired map[uint32]bool
+	// guards chunkMap, retired and the currChunk switch
+	mu sync.RWMutex
+	// serialize writers so the logged offset is the one appended at
+	wmu sync.Mutex
+
+	compactor *compactor
+	batcher   *batcher
+	// one compaction pass at a time
+	compactMu sync.Mutex
+	// set once by Close, read with atomic
+	closed int32
+	// manifests listing each part, of the manifests keys reference.
+	// Guarded by wmu
+	parts map[ObjectID]int
 }
 
-func NewStorage(pChunk string, pIndex string) *Storage {
+// NewStorage returns a storage laid out by opts, nothing is touched on disk
+// until Open is called
+func NewStorage(opts Options) *Storage {
+	opts.normalize()
 	s := new(Storage)
-	s.index = NewIndex(pIndex)
-	s.currChunk = NewChunk(pChunk)
-	s.chunkList = make([]Chunk, 0)
-	s.chunkList = append(s.chunkList, *s.currChunk)
+	s.opts = opts
+	s.index = NewIndex(opts.IndexPath, opts)
+	s.names = NewNames(opts.NamesPath, opts)
+	s.catalog = newCatalog(opts.BucketsPath, opts)
+	s.wal = NewWAL(opts.WALPath, opts)
+	s.chunkMap = make(map[uint32]*Chunk)
+	s.retired = make(map[uint32]bool)
 	return s
 }
 
+func (s *Storage) Options() Options {
+	return s.opts
+}
+
 func (s *Storage) Open() error {
-	if err := s.index.Open(); err != nil {
+	if err := s.openIndex(); err != nil {
+		return fmt.Errorf("index: %w", err)
+	}
+	if err := s.openSpool(); err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+	if err := s.names.Open(); err != nil {
+		return fmt.Errorf("names: %w", err)
+	}
+	if err := s.catalog.open(); err != nil {
+		return fmt.Errorf("buckets: %w", err)
+	}
+	if err := s.openChunks(); err != nil {
 		return err
 	}
-	if err := s.currChunk.Open(); err != nil {
+	if err := s.wal.Open(); err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	if err := s.replay(); err != nil {
+		return fmt.Errorf("replay: %w", err)
+	}
+	// only once replay is done with them, it may cut chunks short
+	if err := s.sealChunks(); err != nil {
 		return err
 	}
-	if unit, err := s.currChunk.GetChunkUint(); err == nil {
-		s.chunkMap = make(map[uint32]*Chunk)
-		s.chunkMap[unit] = s.currChunk
-	} else {
+	if err := s.loadParts(); err != nil {
+		return fmt.Errorf("parts: %w", err)
+	}
+	if s.opts.CompactInterval > 0 {
+		s.startCompactor()
+	}
+	if s.opts.BatchSize > 1 {
+		s.startBatcher()
+	}
+	return nil
+}
+
+// open every chunk file in the data dir, checking its header, and take the
+// highest numbered one with room left as the writer. When all of them are
+// full the highest is taken and the next store rolls over to a new chunk, a
+// fresh data dir starts with chunk 1
+func (s *Storage) openChunks() error {
+	err, units := ListChunkUnits(s.opts.DataDir)
+	if err != nil {
 		return err
 	}
+	if len(units) == 0 {
+		units = []uint32{1}
+	}
+	for _, u := range units {
+		c := NewChunk(ChunkPath(s.opts.DataDir, u), s.opts)
+		if err := c.Open(); err != nil {
+			for _, c := range s.chunkMap {
+				c.Close()
+			}
+			s.chunkMap = make(map[uint32]*Chunk)
+			return fmt.Errorf("chunk %d: %w", u, err)
+		}
+		s.chunkMap[u] = c
+	}
+
+	s.currChunk = s.chunkMap[units[len(units)-1]]
+	for i := len(units) - 1; i >= 0; i-- {
+		if c := s.chunkMap[units[i]]; c.maxOffset < s.opts.SegmentSize {
+			s.currChunk = c
+			break
+		}
+	}
+	return nil
+}
+
+// map every chunk but the current one, see Chunk.seal
+func (s *Storage) sealChunks() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for u, c := range s.chunkMap {
+		if c != s.currChunk {
+			if err := s.seal(c); err != nil {
+				return fmt.Errorf("chunk %d: %w", u, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Storage) seal(c *Chunk) error {
+	if s.opts.DisableMmap {
+		return nil
+	}
+	return c.seal()
+}
+
+// open the index, a lost or corrupt index file is regenerated from chunks
+func (s *Storage) openIndex() error {
+	_, statErr := os.Stat(s.opts.IndexPath)
+	err := s.index.Open()
+	if err == errIndexCorrupt {
+		// keep the broken file around for inspection
+		if err := os.Rename(s.opts.IndexPath, s.opts.IndexPath+".corrupt"); err != nil {
+			return err
+		}
+		return s.regenerateIndex()
+	} else if err != nil {
+		return err
+	}
+	if os.IsNotExist(statErr) {
+		err, units := ListChunkUnits(s.opts.DataDir)
+		if err != nil {
+			return err
+		}
+		if len(units) > 0 {
+			return s.regenerateIndex()
+		}
+	}
 	return nil
 }
 
+// regenerate the index on open, an index missing objects is not left behind
+// for the next open to trust: it regenerates again, or fsck repairs it
+func (s *Storage) regenerateIndex() error {
+	if err := s.index.Regenerate(s.opts.DataDir); err != nil {
+		s.index.Close()
+		os.Remove(s.opts.IndexPath)
+		return err
+	}
+	return nil
+}
+
+// RebuildIndex compacts the index file down to the live slots
+func (s *Storage) RebuildIndex() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.isClosed() {
+		return ErrClosed
+	}
+	return s.index.Rebuild()
+}
+
+// RegenerateIndex indexes the chunk files from scratch
+func (s *Storage) RegenerateIndex() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.isClosed() {
+		return ErrClosed
+	}
+	return s.index.Regenerate(s.opts.DataDir)
+}
+
+// Close flushes the storage to disk and closes its files, every call after
+// it returns ErrClosed
 func (s *Storage) Close() error {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return ErrClosed
+	}
+	s.stopCompactor()
+	s.stopBatcher()
+	// let a compaction and writers in flight finish, the ones waiting find
+	// it closed
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := s.checkpoint(); err != nil {
+		return err
+	}
+	if err := s.wal.Close(); err != nil {
+		return err
+	}
 	if err := s.index.Close(); err != nil {
 		return err
 	}
-	if err := s.currChunk.Close(); err != nil {
+	if err := s.names.Close(); err != nil {
 		return err
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.chunkMap {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (s *Storage) Store(name string, bts []byte, flags int8) error {
+func (s *Storage) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) != 0
+}
+
+// Store stores the file under the name in the default namespace and
+// returns its object id, see put
+func (s *Storage) Store(name string, bts []byte, flags int8) (error, ObjectID) {
+	return s.put(defaultNamespace, name, bts, flags, ObjectMeta{}, CodecNone)
+}
+
+// StoreCodec is Store with the payload compressed by the codec
+func (s *Storage) StoreCodec(name string, bts []byte, flags int8, codec Codec) (error, ObjectID) {
+	return s.put(defaultNamespace, name, bts, flags, ObjectMeta{}, codec)
+}
+
+// put maps the key to the content, content already stored is shared
+// instead of appended again. A key in use is overwritten, the object it
+// pointed at is deleted once no key references it any more. Content
+// bigger than a part is split into parts, see putReader. The payload is
+// stored compressed by the codec, see codecOf
+func (s *Storage) put(ns, key string, bts []byte, flags int8, meta ObjectMeta, codec Codec) (error, ObjectID) {
+	if !validKey(key) {
+		return ErrInvalidKey, ObjectID{}
+	}
+	if int64(len(bts)) > s.opts.PartSize {
+		return s.putReader(ns, key, bytes.NewReader(bts), int64(len(bts)), flags, meta, codec)
+	}
+	codec, flags = s.codecOf(ns, flags, codec)
+	flags &^= FdManifest
 	b := NewBlock()
-	b.SetBlock(name, flags, &bts)
-	// if already has one
+	b.SetBlock(blockName(key), flags&^FdIdMask|s.opts.HashAlgo.flags(), &bts)
+	id := b.ID()
+	if err := b.compress(codec); err != nil {
+		return err, ObjectID{}
+	}
+	e := NameEntry{Namespace: ns, Key: key, ID: id, Size: b.fSz, Flags: flags, ObjectMeta: meta}
+	if s.batcher != nil {
+		if err := s.batcher.put(e, b); err != nil {
+			return err, ObjectID{}
+		}
+		return nil, id
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.isClosed() {
+		return ErrClosed, ObjectID{}
+	}
+
+	if err := s.checkQuota(ns, key, b.fSz, nil); err != nil {
+		return err, ObjectID{}
+	}
+	if find, _ := s.index.find(id); !find {
+		if err := s.storeBlock(b); err != nil {
+			return err, ObjectID{}
+		}
+	} else if err := s.storedAs(&e); err != nil {
+		return err, ObjectID{}
+	}
+	return s.mapKey(e)
+}
+
+// StoreReader stores size bytes read from r under the name in the default
+// namespace, see putReader
+func (s *Storage) StoreReader(name string, r io.Reader, size int64, flags int8) (error, ObjectID) {
+	return s.putReader(defaultNamespace, name, r, size, flags, ObjectMeta{}, CodecNone)
+}
 
-	if find := s.index.FindByMerkle(b.crc32); find {
-		return errors.New("already has one")
+// putReader is put with the payload streamed from r straight into the
+// chunk rather than held in memory, exactly size bytes are read. When r
+// fails or ends early the block is cut off the chunk again and nothing is
+// stored. Content bigger than a part is streamed into parts listed by a
+// manifest, see storeParts. A streamed payload is compressed on its way
+// into the chunk and kept compressed even when it does not get smaller.
+//
+// The write lock is not held while r is read, a payload of up to
+// SmallObjectSize is read into memory and put like any other, so it joins
+// a batch, a bigger one is spooled to disk first unless r is local already
+func (s *Storage) putReader(ns, key string, r io.Reader, size int64, flags int8, meta ObjectMeta, codec Codec) (error, ObjectID) {
+	if !validKey(key) {
+		return ErrInvalidKey, ObjectID{}
+	}
+	if size < 0 {
+		return errors.New("negative object size"), ObjectID{}
+	}
+	if s.isClosed() {
+		return ErrClosed, ObjectID{}
+	}
+	if size <= s.opts.SmallObjectSize {
+		err, bts := readSmall(r, size)
+		if err != nil {
+			return err, ObjectID{}
+		}
+		return s.put(ns, key, bts, flags, meta, codec)
+	}
+	codec, flags = s.codecOf(ns, flags, codec)
+	if err := codec.check(); err != nil {
+		return err, ObjectID{}
+	}
+	flags &^= FdManifest
+	bflags := flags&^FdIdMask | s.opts.HashAlgo.flags()
+
+	// turned away before the payload is read, and checked again once it is
+	s.wmu.Lock()
+	err := s.checkQuota(ns, key, size, nil)
+	s.wmu.Unlock()
+	if err != nil {
+		return err, ObjectID{}
+	}
+	if !local(r) {
+		err, f := s.spool(r, size)
+		if err != nil {
+			return err, ObjectID{}
+		}
+		defer s.unspool(f)
+		r = f
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.isClosed() {
+		return ErrClosed, ObjectID{}
+	}
+
+	if err := s.checkQuota(ns, key, size, nil); err != nil {
+		return err, ObjectID{}
+	}
+	if size > s.opts.PartSize {
+		err, id := s.storeParts(blockName(key), r, size, bflags, codec)
+		if err != nil {
+			return err, ObjectID{}
+		}
+		e := NameEntry{Namespace: ns, Key: key, ID: id, Size: size, Flags: flags, ObjectMeta: meta}
+		if err := s.storedAs(&e); err != nil {
+			return err, ObjectID{}
+		}
+		return s.mapKey(e)
+	}
+	b := NewBlock()
+	b.setStream(blockName(key), bflags, size)
+	b.setCodec(codec)
+	err, stored := s.streamBlock(b, r)
+	if err != nil {
+		return err, ObjectID{}
+	}
+	e := NameEntry{Namespace: ns, Key: key, ID: b.ID(), Size: size, Flags: flags, ObjectMeta: meta}
+	if !stored {
+		if err := s.storedAs(&e); err != nil {
+			return err, ObjectID{}
+		}
+	}
+	return s.mapKey(e)
+}
+
+// codecOf resolves the codec an object is stored with: the one asked for,
+// else with FdCompressed in the flags that of the bucket of the namespace
+// or Options.Codec. FdCompressed is taken out of the flags, the block only
+// gets it when its payload is actually stored compressed
+func (s *Storage) codecOf(ns string, flags int8, codec Codec) (Codec, int8) {
+	if codec == CodecNone && flags&FdCompressed != 0 {
+		codec = s.opts.Codec
+		if b, find := s.catalog.get(ns); find && b.Codec != CodecNone {
+			codec = b.Codec
+		}
+	}
+	return codec, flags &^ FdCompressed
+}
+
+// the block keeps the name only as a hint of what it holds
+func blockName(key string) string {
+	if len(key) > maxBlockNameSize {
+		return key[:maxBlockNameSize]
+	}
+	return key
+}
+
+// storedAs sets FdManifest of the entry as the stored object has it. The
+// content of a put may already be stored the other way round than the put
+// would have, in a single block or in parts listed by a manifest, when the
+// part size changed in between. Called under wmu
+func (s *Storage) storedAs(e *NameEntry) error {
+	err, b, br := s.openBlock(e.ID)
+	if err != nil {
+		return err
+	}
+	br.Close()
+	e.Flags = e.Flags&^FdManifest | b.flags&FdManifest
+	return nil
+}
+
+// map the key of e to its stored object, a key in use is overwritten and
+// the object it pointed at released. Called under wmu
+func (s *Storage) mapKey(e NameEntry) (error, ObjectID) {
+	e.ModTime = time.Now()
+	old, err := s.names.put(e)
+	if err != nil {
+		return err, ObjectID{}
+	}
+	if err := s.remapped(e, old); err != nil {
+		return err, ObjectID{}
+	}
+	return nil, e.ID
+}
+
+// account the key of e mapped over old, nil for a new key. Called under wmu
+func (s *Storage) remapped(e NameEntry, old *NameEntry) error {
+	if old != nil && old.ID == e.ID {
+		return nil
+	}
+	// the parts of a manifest count from its first key on
+	if e.Flags&FdManifest != 0 && s.names.refCount(e.ID) == 1 {
+		err, m := s.readManifest(e.ID)
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			s.addParts(m)
+		}
+	}
+	if old != nil {
+		return s.release(old.ID, old.Flags&FdManifest != 0)
+	}
+	return nil
+}
+
+// delete the object of id once nothing references it any more, no key
+// and, for a part, no manifest. The parts of a manifest, which parts tells
+// it is, go with it. Called under wmu
+func (s *Storage) release(id ObjectID, parts bool) error {
+	if s.names.refCount(id) > 0 || s.parts[id] > 0 {
+		return nil
+	}
+	var m *manifest
+	if parts {
+		var err error
+		if err, m = s.readManifest(id); err != nil {
+			return err
+		}
+	}
+	if err := s.deleteObject(id); err != nil {
+		return err
+	}
+	if m != nil {
+		return s.dropParts(m, true)
+	}
+	return nil
+}
+
+// append the block to the current chunk and index it, the intent is logged
+// first so after a crash the block is either fully there or not at all
+func (s *Storage) storeBlock(b *Block) error {
+	s.decideChunk(b.OnDiskSize())
+	unit, err := s.currChunk.GetChunkUint()
+	if err != nil {
+		return err
+	}
+	e := walStoreEntry{chunk: unit, offset: s.currChunk.maxOffset, size: b.OnDiskSize(), fId: b.ID()}
+	seq, err := s.wal.Append(walRecordStore, e.bytes())
+	if err != nil {
+		return err
 	}
 
-	s.decideChunk()
 	err, slot := s.currChunk.AppendBlock(b)
 	if err != nil {
+		s.currChunk.truncate(e.offset)
 		return err
 	}
-	err = s.index.Insert(*slot)
+	return s.indexBlock(slot, seq)
+}
+
+// streamBlock is storeBlock with the payload streamed from r. The id is
+// only known once the payload went through, so the intent is logged
+// without it first, which a replay takes for a torn block, and again with
+// it before the block is committed. Content already stored is cut off the
+// chunk again rather than kept twice, stored tells whether the block is new
+func (s *Storage) streamBlock(b *Block, r io.Reader) (err error, stored bool) {
+	s.decideChunk(b.OnDiskSize())
+	c := s.currChunk
+	unit, err := c.GetChunkUint()
+	if err != nil {
+		return err, false
+	}
+	e := walStoreEntry{chunk: unit, offset: c.maxOffset, size: b.OnDiskSize()}
+	if _, err := s.wal.Append(walRecordStore, e.bytes()); err != nil {
+		return err, false
+	}
+	// a compressed payload has its stored size once it went through
+	if err := c.appendFrom(b, r); err != nil {
+		if e := c.truncate(e.offset); e != nil {
+			return e, false
+		}
+		return err, false
+	}
+	if find, _ := s.index.find(b.ID()); find {
+		return c.truncate(e.offset), false
+	}
+
+	e.fId, e.size = b.ID(), b.OnDiskSize()
+	seq, err := s.wal.Append(walRecordStore, e.bytes())
+	if err != nil {
+		c.truncate(e.offset)
+		return err, false
+	}
+	err, slot := c.commitBlock(b)
 	if err != nil {
+		c.truncate(e.offset)
+		return err, false
+	}
+	return s.indexBlock(slot, seq), true
+}
+
+// index the block just appended to the current chunk and commit its logged
+// store, the block is cut off again when it can't be indexed
+func (s *Storage) indexBlock(slot *IndexSlot, seq uint64) error {
+	if err := s.index.Insert(*slot); err != nil {
+		s.currChunk.truncate(slot.offset)
+		return err
+	}
+	if _, err := s.wal.Append(walRecordCommit, seqBytes(seq)); err != nil {
 		return err
 	}
+	if s.wal.Size() >= walCheckpointSize {
+		return s.checkpoint()
+	}
 	return nil
 }
 
-func (s *Storage) decideChunk() {
-	if s.currChunk.maxOffset >= defaultSegmentSize {
-		lastUnit, _ := s.currChunk.GetChunkUint()
-		unit := lastUnit + 1
-		path := getChunkPath(unit)
-		c := NewChunk(path)
-		err := c.Open()
+// Get reads the file stored under the key
+func (s *Storage) Get(key string) (err error, f []byte) {
+	err, e := s.stat(defaultNamespace, key)
+	if err != nil {
+		return err, nil
+	}
+	err, _, f = s.Read(e.ID)
+	return err, f
+}
+
+// Stat returns what the key maps to
+func (s *Storage) Stat(key string) (err error, e NameEntry) {
+	return s.stat(defaultNamespace, key)
+}
+
+func (s *Storage) stat(ns, key string) (err error, e NameEntry) {
+	if s.isClosed() {
+		return ErrClosed, e
+	}
+	e, find := s.names.get(ns, key)
+	if !find {
+		return ErrKeyNotFound, e
+	}
+	return nil, e
+}
+
+// List returns the entries whose key starts with prefix, ordered by key
+func (s *Storage) List(prefix string) []NameEntry {
+	return s.names.list(defaultNamespace, prefix)
+}
+
+// Remove unmaps the key, the object goes with it unless another key still
+// references it
+func (s *Storage) Remove(key string) error {
+	return s.remove(defaultNamespace, key)
+}
+
+func (s *Storage) remove(ns, key string) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.isClosed() {
+		return ErrClosed
+	}
+	old, err := s.names.remove(ns, key)
+	if err != nil {
+		return err
+	}
+	return s.release(old.ID, old.Flags&FdManifest != 0)
+}
+
+// flush chunks and index to disk, after which the log is no longer needed
+func (s *Storage) checkpoint() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, c := range s.chunkMap {
+		if err := c.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	if err := s.names.Sync(); err != nil {
+		return err
+	}
+	return s.wal.Checkpoint()
+}
+
+// replay the write-ahead log left by a crash, every logged store is checked
+// against the chunk: a complete block is rolled forward into the index and
+// a torn one is cut off the chunk. A stored object left without a key is
+// deleted again
+func (s *Storage) replay() error {
+	committed := make(map[uint64]bool)
+	records := make([]*walRecord, 0)
+	err := s.wal.Replay(func(rec *walRecord) error {
+		switch rec.typ {
+		case walRecordStore, walRecordDelete:
+			records = append(records, rec)
+		case walRecordCommit:
+			if len(rec.data) != 8 {
+				return errors.New("invalid wal commit record")
+			}
+			committed[binary.BigEndian.Uint64(rec.data)] = true
+		default:
+			return errors.New("unknown wal record type")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	stores := make(map[int]walStoreEntry)
+	// stores whose space was reused by a later append after they failed,
+	// the later stores of a batch go behind each other instead
+	reused := make(map[int]bool)
+	// lowest offset logged in each chunk from a record on
+	lowest := make(map[uint32]int64)
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].typ != walRecordStore {
+			continue
+		}
+		e, err := readWALStoreEntry(records[i].data)
+		if err != nil {
+			return err
+		}
+		stores[i] = e
+		if low, ok := lowest[e.chunk]; ok && low <= e.offset {
+			reused[i] = true
+		} else {
+			lowest[e.chunk] = e.offset
+		}
+	}
+	for i, rec := range records {
+		if rec.typ == walRecordStore {
+			e := stores[i]
+			if err := s.redoStore(e, committed[rec.seq], !reused[i]); err != nil {
+				return err
+			}
+			continue
+		}
+		e, err := readWALDeleteEntry(rec.data)
+		if err != nil {
+			return err
+		}
+		if err := s.redoDelete(e); err != nil {
+			return err
+		}
+	}
+
+	// a crash between a store and the put of its key leaves the object
+	// without one, it goes as it would with the remove of its last key
+	if err := s.loadParts(); err != nil {
+		return err
+	}
+	for i := range records {
+		if e, ok := stores[i]; ok && !e.fId.IsZero() {
+			if err := s.release(e.fId, false); err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+	}
+	return s.checkpoint()
+}
+
+// redoStore rolls a logged store forward when its block is complete and
+// back otherwise, unless rollBack is false because its space was reused
+func (s *Storage) redoStore(e walStoreEntry, committed bool, rollBack bool) error {
+	slot := IndexSlot{fId: e.fId, chunkFile: e.chunk, offset: e.offset}
+	if committed && s.index.contains(slot) {
+		return nil
+	}
+	err, c := s.getChunk(e.chunk)
+	if err != nil {
+		return err
+	}
+
+	fi, err := c.w.Stat()
+	if err != nil {
+		return err
+	}
+	if e.offset+e.size <= fi.Size() {
+		if err, b := c.ReadBlock(e.offset); err == nil && b.ID() == e.fId && b.OnDiskSize() == e.size {
+			// roll forward
+			if c.maxOffset < e.offset+e.size {
+				c.sum++
+				c.size += e.size
+				c.maxOffset = e.offset + e.size
+				if err := c.WriteHeader(); err != nil {
+					return err
+				}
+				if err := c.addLeaf(e.offset, e.fId); err != nil {
+					return err
+				}
+			}
+			if !s.index.contains(slot) {
+				return s.index.Insert(slot)
+			}
+			return nil
+		}
+	}
+	if !rollBack {
+		// the space was taken over by a later logged store
+		return nil
+	}
+
+	// roll back
+	if err := s.index.drop(func(v IndexSlot) bool {
+		return v.chunkFile == e.chunk && v.offset >= e.offset
+	}); err != nil {
+		return err
+	}
+	return c.truncate(e.offset)
+}
+
+// a logged delete is always rolled forward
+func (s *Storage) redoDelete(e walDeleteEntry) error {
+	err, c := s.getChunk(e.chunk)
+	if err != nil {
+		return err
+	}
+	if err, b := c.ReadBlock(e.offset); err == nil && b.ID() == e.fId && b.flags&FdDeleted == 0 {
+		if err := c.markDeleted(e.offset); err != nil {
+			return err
+		}
+	}
+	// shadow the slot unless a tombstone or a newer store already did
+	if find, slot := s.index.find(e.fId); find && slot.chunkFile == e.chunk && slot.offset == e.offset {
+		return s.index.Insert(newTombstone(e.fId, e.chunk))
+	}
+	return nil
+}
+
+// get the opened chunk of unit, open it on first use
+func (s *Storage) getChunk(unit uint32) (error, *Chunk) {
+	s.mu.RLock()
+	c, retired := s.chunkMap[unit], s.retired[unit]
+	s.mu.RUnlock()
+	if retired {
+		return errChunkRetired, nil
+	} else if c != nil {
+		return nil, c
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.retired[unit] {
+		return errChunkRetired, nil
+	} else if c := s.chunkMap[unit]; c != nil {
+		return nil, c
+	}
+	c = NewChunk(ChunkPath(s.opts.DataDir, unit), s.opts)
+	if err := c.Open(); err != nil {
+		return err, nil
+	}
+	// never the current chunk, that one is always open
+	if err := s.seal(c); err != nil {
+		c.Close()
+		return err, nil
+	}
+	s.chunkMap[unit] = c
+	return nil, c
+}
+
+// roll over to a new chunk when the current one is full or has no room left
+// for a block of size bytes, an empty chunk takes a block of any size
+func (s *Storage) decideChunk(size int64) {
+	c := s.currChunk
+	if c.maxOffset >= s.opts.SegmentSize || c.maxOffset > ChunkHeaderSize && c.maxOffset+size > s.opts.SegmentSize {
+		err, next := s.createChunk()
 		if err != nil {
 			return
 		}
-		s.currChunk = c
-		s.chunkMap[unit] = c
+		s.mu.Lock()
+		s.currChunk = next
+		s.mu.Unlock()
+		// reads of the full chunk go to its mapping from here on, a chunk
+		// that can't be mapped is still read through the file
+		s.seal(c)
+	}
+}
+
+// create and register a chunk numbered above every chunk there is, chunks
+// written by compaction take numbers from the same sequence
+func (s *Storage) createChunk() (error, *Chunk) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err, units := ListChunkUnits(s.opts.DataDir)
+	if err != nil {
+		return err, nil
+	}
+	var unit uint32
+	for _, u := range units {
+		if u > unit {
+			unit = u
+		}
+	}
+	for u := range s.chunkMap {
+		if u > unit {
+			unit = u
+		}
+	}
+	for u := range s.retired {
+		if u > unit {
+			unit = u
+		}
+	}
+	unit++
+
+	c := NewChunk(ChunkPath(s.opts.DataDir, unit), s.opts)
+	if err := c.Open(); err != nil {
+		return err, nil
 	}
+	s.chunkMap[unit] = c
+	return nil, c
 }
 
-func (s *Storage) Read(crc32 uint32) (err error, name string, f []byte) {
-	if find, slot := s.index.find(crc32); find == true {
+func (s *Storage) Read(id ObjectID) (err error, name string, f []byte) {
+	if s.isClosed() {
+		return ErrClosed, "", nil
+	}
+	// the chunk may get compacted away under the read, the index points at
+	// the new copy by then
+	for i := 0; i < readRetries; i++ {
+		find, slot := s.index.find(id)
+		if !find {
+			return ErrObjectNotFound, "", nil
+		}
 		//read from chunk file
-		if u, err := s.currChunk.GetChunkUint(); err == nil && u == slot.chunkFile {
-			// file in curr chunk file
-			_, b := s.currChunk.ReadBlock(slot.offset)
-			return nil, b.fileName, b.block
-		} else if s.chunkMap[slot.chunkFile] != nil {
-			// open mapped chunk
-			_, b := s.chunkMap[slot.chunkFile].ReadBlock(slot.offset)
-			return nil, b.fileName, b.block
-		} else {
-			// open chunk file
-			chunk := NewChunk(getChunkPath(slot.chunkFile))
-			if err := chunk.Open(); err != nil {
+		err, c := s.getChunk(slot.chunkFile)
+		if err == errChunkRetired {
+			continue
+		} else if err != nil {
+			return err, "", nil
+		}
+		err, b := c.ReadBlock(slot.offset)
+		if err == errChunkRetired {
+			continue
+		} else if err != nil {
+			if b != nil {
+				b.Release()
+			}
+			return err, "", nil
+		}
+		defer b.Release()
+		if b.flags&FdDeleted != 0 {
+			return ErrObjectNotFound, "", nil
+		}
+		if b.flags&FdManifest != 0 {
+			return s.readParts(id, b)
+		}
+		if b.flags&FdCompressed != 0 {
+			f, err := b.content()
+			if err == errCorruptPayload {
+				u, _ := c.GetChunkUint()
+				err = &ErrCorrupt{Chunk: u, Offset: slot.offset}
+			}
+			if err != nil {
 				return err, "", nil
 			}
-			// append to opened chunk map first
-			s.chunkMap[slot.chunkFile] = chunk
-			_, b := chunk.ReadBlock(slot.offset)
-			return nil, b.fileName, b.block
+			return nil, b.fileName, f
+		}
+		if b.mapping != nil {
+			// the mapping may go once the block is released
+			return nil, b.fileName, append(make([]byte, 0, len(b.block)), b.block...)
 		}
-	} else {
-		return errors.New("file not find in index"), "", nil
+		return nil, b.fileName, b.block
+	}
+	return errChunkRetired, "", nil
+}
+
+// read the parts the manifest block lists into one payload
+func (s *Storage) readParts(id ObjectID, b *Block) (err error, name string, f []byte) {
+	m, err := readManifest(b.block)
+	if err != nil {
+		return fmt.Errorf("object %s: %w", id, err), "", nil
+	}
+	f = make([]byte, 0, m.size)
+	for _, p := range m.parts {
+		err, _, part := s.Read(p.id)
+		if err != nil {
+			return fmt.Errorf("part %s: %w", p.id, err), "", nil
+		}
+		if int64(len(part)) != p.size {
+			return fmt.Errorf("part %s: %w", p.id, errInvalidManifest), "", nil
+		}
+		f = append(f, part...)
+	}
+	return nil, b.fileName, f
+}
+
+// Transfer returns a reader over the file payload, the caller must close
+// it. An object split into parts comes as one stream
+func (s *Storage) Transfer(id ObjectID) (err error, name string, sz int64, r *ObjectReader) {
+	return s.TransferRange(id, 0, math.MaxInt64)
+}
+
+// TransferRange is Transfer over length bytes of the payload from off on,
+// cut at the end of the object, sz is the size of the whole object. The
+// reader seeks right to the range in the chunk file, only the parts the
+// range covers are opened, see ObjectReader.Narrow
+func (s *Storage) TransferRange(id ObjectID, off, length int64) (err error, name string, sz int64, r *ObjectReader) {
+	if s.isClosed() {
+		return ErrClosed, "", 0, nil
+	}
+	if off < 0 || length < 0 {
+		return ErrInvalidRange, "", 0, nil
+	}
+	err, name, sz, r = s.openObject(id)
+	if err != nil {
+		return err, "", 0, nil
+	}
+	if err := r.Narrow(off, length); err != nil {
+		r.Close()
+		return err, "", 0, nil
+	}
+	return nil, name, sz, r
+}
+
+// openObject is Transfer over the whole object
+func (s *Storage) openObject(id ObjectID) (err error, name string, sz int64, r *ObjectReader) {
+	err, b, br := s.openBlock(id)
+	if err != nil {
+		return err, "", 0, nil
+	}
+	if b.flags&FdManifest == 0 {
+		return nil, b.fileName, b.fSz, &ObjectReader{s: s, br: br, size: b.fSz}
+	}
+
+	data, err := ioutil.ReadAll(br)
+	br.Close()
+	if err != nil {
+		return err, "", 0, nil
+	}
+	m, err := readManifest(data)
+	if err != nil {
+		return fmt.Errorf("object %s: %w", id, err), "", 0, nil
+	}
+	r = &ObjectReader{s: s, parts: m.parts, end: m.size, size: m.size}
+	return nil, b.fileName, m.size, r
+}
+
+// ReadRange reads length bytes of the object from off on, cut at its end,
+// see TransferRange
+func (s *Storage) ReadRange(id ObjectID, off, length int64) (error, []byte) {
+	err, _, sz, r := s.TransferRange(id, off, length)
+	if err != nil {
+		return err, nil
 	}
+	defer r.Close()
+	if length > sz-off {
+		length = sz - off
+	}
+	f := make([]byte, length)
+	if _, err := io.ReadFull(r, f); err != nil {
+		return err, nil
+	}
+	return nil, f
 }
 
-func (s *Storage) Transfer(crc32 uint32) (err error, name string, sz int64, r *io.Reader) {
-	if find, slot := s.index.find(crc32); find == true {
+// open a reader over the payload of the block of id
+func (s *Storage) openBlock(id ObjectID) (error, *Block, *BlockReader) {
+	for i := 0; i < readRetries; i++ {
+		find, slot := s.index.find(id)
+		if !find {
+			return ErrObjectNotFound, nil, nil
+		}
 		//read from chunk file
-		if u, err := s.currChunk.GetChunkUint(); err == nil && u == slot.chunkFile {
-			// file in curr chunk file
-			e, b, r := s.currChunk.TransferBlock(slot.offset)
-			return e, b.fileName, b.fSz, r
-		} else if s.chunkMap[slot.chunkFile] != nil {
-			// open mapped chunk
-			e, b, r := s.chunkMap[slot.chunkFile].TransferBlock(slot.offset)
-			return e, b.fileName, b.fSz, r
-		} else {
-			// open chunk file
-			chunk := NewChunk(getChunkPath(slot.chunkFile))
-			if err := chunk.Open(); err != nil {
-				return err, "", 0, nil
-			}
-			// append to opened chunk map first
-			s.chunkMap[slot.chunkFile] = chunk
-			e, b, r := chunk.TransferBlock(slot.offset)
-			return e, b.fileName, b.fSz, r
+		err, c := s.getChunk(slot.chunkFile)
+		if err == errChunkRetired {
+			continue
+		} else if err != nil {
+			return err, nil, nil
+		}
+		e, b, r := c.TransferBlock(slot.offset)
+		if e == errChunkRetired {
+			continue
+		} else if e != nil {
+			return e, nil, nil
 		}
-	} else {
-		return errors.New("file not find in index"), "", 0, nil
+		if b.flags&FdDeleted != 0 {
+			r.Close()
+			return ErrObjectNotFound, nil, nil
+		}
+		return nil, b, r
+	}
+	return errChunkRetired, nil, nil
+}
+
+// Delete logically removes the file, its block is flagged FdDeleted in the
+// chunk and a tombstone slot shadows it in the index. Every key mapped to
+// it is removed as well
+func (s *Storage) Delete(id ObjectID) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.isClosed() {
+		return ErrClosed
+	}
+	if s.parts[id] > 0 {
+		return errPartInUse
+	}
+	err, m := s.readManifest(id)
+	if err != nil {
+		return err
+	}
+	counted := s.names.refCount(id) > 0
+	if err := s.deleteObject(id); err != nil {
+		return err
+	}
+	if err := s.names.removeID(id); err != nil {
+		return err
+	}
+	if m != nil {
+		return s.dropParts(m, counted)
+	}
+	return nil
+}
+
+func (s *Storage) deleteObject(id ObjectID) error {
+	find, slot := s.index.find(id)
+	if !find {
+		return ErrObjectNotFound
+	}
+	err, c := s.getChunk(slot.chunkFile)
+	if err != nil {
+		return err
+	}
+
+	e := walDeleteEntry{chunk: slot.chunkFile, offset: slot.offset, fId: slot.fId}
+	seq, err := s.wal.Append(walRecordDelete, e.bytes())
+	if err != nil {
+		return err
+	}
+	if err := c.markDeleted(slot.offset); err != nil {
+		return err
+	}
+	if err := s.index.Insert(newTombstone(slot.fId, slot.chunkFile)); err != nil {
+		return err
+	}
+	if _, err := s.wal.Append(walRecordCommit, seqBytes(seq)); err != nil {
+		return err
 	}
+	if s.wal.Size() >= walCheckpointSize {
+		return s.checkpoint()
+	}
+	return nil
 }
 
-func getChunkPath(u uint32) string {
-	return "/tmp/chunk/" + fmt.Sprint(u) + chunkFileSuffix
+// ChunkPath returns the path of the chunk file of unit u under dir
+func ChunkPath(dir string, u uint32) string {
+	return filepath.Join(dir, strconv.FormatUint(uint64(u), 10)+chunkFileSuffix)
+}
+
+// ListChunkUnits returns the units of every chunk file in dir, in ascending order
+func ListChunkUnits(dir string) (error, []uint32) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+chunkFileSuffix))
+	if err != nil {
+		return err, nil
+	}
+	units := make([]uint32, 0, len(paths))
+	for _, p := range paths {
+		if u, err := NewChunk(p, Options{}).GetChunkUint(); err == nil {
+			units = append(units, u)
+		}
+	}
+	sort.Slice(units, func(i, j int) bool { return units[i] < units[j] })
+	return nil, units
 }
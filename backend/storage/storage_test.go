@@ -1,12 +1,20 @@
 package storage
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestStorage_Store(t *testing.T) {
-	s := NewStorage("/tmp/chunk/1.chunk", "/tmp/index")
+	s := NewStorage(tempOptions(t))
 	err := s.Open()
 	defer s.Close()
 	if err != nil {
@@ -18,27 +26,500 @@ func TestStorage_Store(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = s.Store("test.txt", bts, FdNullFlags)
+	err, _ = s.Store("test.txt", bts, FdNullFlags)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestStorage_Read(t *testing.T) {
-	s := NewStorage("/tmp/chunk/1.chunk", "/tmp/index")
+	opts := tempOptions(t)
+	s := NewStorage(opts)
 	err := s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bts, err := ioutil.ReadFile("testdata/test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := s.Store("test.txt", bts, FdNullFlags); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// read back after reopen
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
 	defer s.Close()
+	i := s.index.slots[0]
+
+	err, name, f := s.Read(i.fId)
 	if err != nil {
 		t.Fatal(err)
 	}
-	i := s.index.slots[1]
+	if name != "test.txt" {
+		t.Fatalf("name %q, want %q", name, "test.txt")
+	}
+	if !bytes.Equal(f, bts) {
+		t.Fatalf("read %q, want %q", f, bts)
+	}
+}
 
-	t.Log(i.fId)
-	err, name, bts := s.Read(i.fId)
+func TestStorage_Options(t *testing.T) {
+	opts := tempOptions(t)
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got := s.currChunk.path; got != ChunkPath(opts.DataDir, 1) {
+		t.Fatalf("chunk path %q", got)
+	}
+	if got := s.index.path; got != opts.IndexPath {
+		t.Fatalf("index path %q", got)
+	}
+}
+
+func TestStorage_Delete(t *testing.T) {
+	opts := tempOptions(t)
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	bts := []byte("to be deleted")
+	id := HashSha256.Sum(bts)
+	if err, _ := s.Store("del.txt", bts, FdNullFlags); err != nil {
+		t.Fatal(err)
+	}
+	_, slot := s.index.find(id)
+	if err := s.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(id); err == nil {
+		t.Fatal("deleted twice")
+	}
+	if err, _, _ := s.Read(id); err == nil {
+		t.Fatal("read a deleted file")
+	}
+	if err, _, _, _ := s.Transfer(id); err == nil {
+		t.Fatal("transfer a deleted file")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tombstone and the block flag survive restart
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err, _, _ := s.Read(id); err == nil {
+		t.Fatal("read a deleted file after reopen")
+	}
+	if err, b := s.currChunk.ReadBlock(slot.offset); err != nil {
+		t.Fatal(err)
+	} else if b.flags&FdDeleted == 0 {
+		t.Fatal("block not flagged deleted")
+	}
+
+	// the same content can be stored again
+	if err, _ := s.Store("del.txt", bts, FdNullFlags); err != nil {
+		t.Fatal(err)
+	}
+	if err, _, f := s.Read(id); err != nil || !bytes.Equal(f, bts) {
+		t.Fatalf("read after store again: %v %q", err, f)
+	}
+}
+
+// flip a byte of the payload of the object at the offset from its end
+func corruptObject(t *testing.T, s *Storage, id ObjectID, fromEnd int64) IndexSlot {
+	t.Helper()
+	_, slot := s.index.find(id)
+	err, b := s.currChunk.ReadBlock(slot.offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(ChunkPath(s.opts.DataDir, slot.chunkFile), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	at := slot.offset + b.OnDiskSize() - fromEnd
+	p := make([]byte, 1)
+	if _, err := f.ReadAt(p, at); err != nil {
+		t.Fatal(err)
+	}
+	p[0] ^= 0xff
+	if _, err := f.WriteAt(p, at); err != nil {
+		t.Fatal(err)
+	}
+	return *slot
+}
+
+func TestStorage_ReadCorrupt(t *testing.T) {
+	s := NewStorage(tempOptions(t))
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	bts := bytes.Repeat([]byte("silOSS"), 20000)
+	err, id := s.Store("big.txt", bts, FdNullFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sound payloads pass through both paths of the block reader
+	err, _, _, br := s.Transfer(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, br); err != nil || !bytes.Equal(buf.Bytes(), bts) {
+		t.Fatalf("transfer %d bytes, %v", buf.Len(), err)
+	}
+	br.Close()
+	err, _, _, br = s.Transfer(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err := ioutil.ReadAll(br); err != nil || !bytes.Equal(f, bts) {
+		t.Fatalf("read all %d bytes, %v", len(f), err)
+	}
+	br.Close()
+
+	// a byte early in the payload goes bad
+	slot := corruptObject(t, s, id, int64(len(bts)-10))
+	var corrupt *ErrCorrupt
+	if err, _, _ := s.Read(id); !errors.As(err, &corrupt) || corrupt.Chunk != 1 || corrupt.Offset != slot.offset {
+		t.Fatalf("read of a corrupt block: %v", err)
+	}
+
+	// the transfer fails at its end and the tail is held back
+	err, _, _, br = s.Transfer(id)
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Log(name)
-	t.Log(len(bts))
-	t.Log(string(bts))
+	buf.Reset()
+	if _, err := io.Copy(&buf, br); !errors.As(err, &corrupt) {
+		t.Fatalf("transfer of a corrupt block: %v", err)
+	} else if buf.Len() != len(bts)-transferVerifyTail {
+		t.Fatalf("transfer sent %d bytes of %d", buf.Len(), len(bts))
+	}
+	br.Close()
+	err, _, _, br = s.Transfer(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err := ioutil.ReadAll(br); !errors.As(err, &corrupt) || len(f) >= len(bts) {
+		t.Fatalf("read all of a corrupt block: %d bytes, %v", len(f), err)
+	}
+	br.Close()
+
+	// a range away from the bad byte is not served either
+	if err, _, _, _ := s.TransferRange(id, int64(len(bts)-100), 50); !errors.As(err, &corrupt) {
+		t.Fatalf("range of a corrupt block: %v", err)
+	}
+	if err, _ := s.ReadRange(id, 0, 10); !errors.As(err, &corrupt) {
+		t.Fatalf("read range of a corrupt block: %v", err)
+	}
+}
+
+func TestStorage_OpenChunks(t *testing.T) {
+	opts := tempOptions(t)
+	opts.SegmentSize = 256
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]ObjectID, 0)
+	for i := 0; i < 10; i++ {
+		err, id := s.Store("f"+strconv.Itoa(i), []byte("a payload of chunk sized files "+strconv.Itoa(i)), FdNullFlags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	last, _ := s.currChunk.GetChunkUint()
+	if last < 3 {
+		t.Fatalf("stores went to %d chunks", last)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// every chunk is opened and writes go on in the last one
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.chunkMap) != int(last) {
+		t.Fatalf("%d chunks opened, want %d", len(s.chunkMap), last)
+	}
+	if u, _ := s.currChunk.GetChunkUint(); u != last {
+		t.Fatalf("writing to chunk %d, want %d", u, last)
+	}
+	if err, _ := s.Store("more", []byte("after the restart"), FdNullFlags); err != nil {
+		t.Fatal(err)
+	}
+	if _, slot := s.index.find(HashSha256.Sum([]byte("after the restart"))); slot.chunkFile < last {
+		t.Fatalf("stored to chunk %d after the restart", slot.chunkFile)
+	}
+	for _, id := range ids {
+		if err, _, _ := s.Read(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a chunk with a broken header keeps the storage from opening
+	if err := ioutil.WriteFile(ChunkPath(opts.DataDir, 2), []byte("SILOSSX"), opts.FileMode); err != nil {
+		t.Fatal(err)
+	}
+	s = NewStorage(opts)
+	if err := s.Open(); err == nil {
+		s.Close()
+		t.Fatal("opened with a broken chunk")
+	}
+}
+
+// a reader failing with err once n bytes of r went through, calling fail
+// first when set
+type failReader struct {
+	r    io.Reader
+	n    int
+	err  error
+	fail func()
+}
+
+func (f *failReader) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		if f.fail != nil {
+			f.fail()
+		}
+		return 0, f.err
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+func TestStorage_StoreReader(t *testing.T) {
+	opts := tempOptions(t)
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	bts := bytes.Repeat([]byte("streamed "), 100000)
+	err, id := s.StoreReader("big.bin", bytes.NewReader(bts), int64(len(bts)), FdNullFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != HashSha256.Sum(bts) {
+		t.Fatalf("id %s, want %s", id, HashSha256.Sum(bts))
+	}
+	end := s.currChunk.maxOffset
+
+	// the same content is kept once, the second copy is cut off again
+	if err, got := s.StoreReader("copy.bin", bytes.NewReader(bts), int64(len(bts)), FdNullFlags); err != nil || got != id {
+		t.Fatalf("store of a copy %s, %v", got, err)
+	}
+	if fi, _ := os.Stat(s.currChunk.path); fi.Size() != end || s.currChunk.maxOffset != end {
+		t.Fatalf("chunk size %d, max offset %d after a copy, want %d", fi.Size(), s.currChunk.maxOffset, end)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err, f := s.Get("big.bin"); err != nil || !bytes.Equal(f, bts) {
+		t.Fatalf("read back %d bytes, %v", len(f), err)
+	}
+	if err, f := s.Get("copy.bin"); err != nil || !bytes.Equal(f, bts) {
+		t.Fatalf("read back the copy %d bytes, %v", len(f), err)
+	}
+	if err, _ := s.StoreReader("neg", bytes.NewReader(nil), -1, FdNullFlags); err == nil {
+		t.Fatal("store of a negative size")
+	}
+}
+
+func TestStorage_StoreReaderRollBack(t *testing.T) {
+	opts := tempOptions(t)
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := s.Store("a.txt", []byte("aaaa"), FdNullFlags); err != nil {
+		t.Fatal(err)
+	}
+	end := s.currChunk.maxOffset
+	cut := func() {
+		t.Helper()
+		if fi, _ := os.Stat(s.currChunk.path); fi.Size() != end || s.currChunk.maxOffset != end {
+			t.Fatalf("chunk size %d, max offset %d, want %d", fi.Size(), s.currChunk.maxOffset, end)
+		}
+	}
+
+	bts := bytes.Repeat([]byte("b"), 64*1024)
+	failed := errors.New("connection reset")
+	r := &failReader{r: bytes.NewReader(bts), n: len(bts) / 2, err: failed}
+	if err, _ := s.StoreReader("b.txt", r, int64(len(bts)), FdNullFlags); err != failed {
+		t.Fatalf("store of a failing reader: %v", err)
+	}
+	cut()
+	if err, _ := s.StoreReader("b.txt", bytes.NewReader(bts[:10]), int64(len(bts)), FdNullFlags); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("store of a short reader: %v", err)
+	}
+	cut()
+	if err, _ := s.Stat("b.txt"); err != ErrKeyNotFound {
+		t.Fatalf("key of a failed store: %v", err)
+	}
+
+	// a crash halfway through the payload leaves the block to the replay
+	r = &failReader{r: bytes.NewReader(bts), n: len(bts) / 2, err: failed, fail: func() { crash(s) }}
+	if err, _ := s.StoreReader("b.txt", r, int64(len(bts)), FdNullFlags); err == nil {
+		t.Fatal("store through a crash")
+	}
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cut()
+	if err, _, f := s.Read(HashSha256.Sum([]byte("aaaa"))); err != nil || string(f) != "aaaa" {
+		t.Fatalf("read a.txt: %v %q", err, f)
+	}
+	if err, _ := s.StoreReader("b.txt", bytes.NewReader(bts), int64(len(bts)), FdNullFlags); err != nil {
+		t.Fatal(err)
+	}
+	if err, f := s.Get("b.txt"); err != nil || !bytes.Equal(f, bts) {
+		t.Fatalf("read b.txt %d bytes, %v", len(f), err)
+	}
+}
+
+func TestStorage_StoreReaderStalled(t *testing.T) {
+	opts := tempOptions(t)
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	bts := bytes.Repeat([]byte("s"), 256*1024)
+	pr, pw := io.Pipe()
+	done := make(chan error)
+	go func() {
+		err, _ := s.StoreReader("slow.bin", pr, int64(len(bts)), FdNullFlags)
+		done <- err
+	}()
+	pw.Write(bts[:1000])
+
+	// the client stalls halfway, other writers go on
+	stored := make(chan error)
+	go func() {
+		err, _ := s.Store("fast.txt", []byte("fast"), FdNullFlags)
+		stored <- err
+	}()
+	select {
+	case err := <-stored:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("store held up by a stalled reader")
+	}
+	pw.Write(bts[1000:])
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err, f := s.Get("slow.bin"); err != nil || !bytes.Equal(f, bts) {
+		t.Fatalf("read back %d bytes, %v", len(f), err)
+	}
+
+	// a spooled payload a crash left behind is cleared on open
+	if err := ioutil.WriteFile(filepath.Join(opts.SpoolDir, "put123"), bts, opts.FileMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if fs, _ := ioutil.ReadDir(opts.SpoolDir); len(fs) != 0 {
+		t.Fatalf("spool dir holds %d files", len(fs))
+	}
+}
+
+func TestStorage_ConcurrentReadStore(t *testing.T) {
+	opts := tempOptions(t)
+	opts.SegmentSize = 64 * 1024
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	payload := func(i int) []byte {
+		return bytes.Repeat([]byte(strconv.Itoa(i)+" "), 50+i%200)
+	}
+	ids := make([]ObjectID, 64)
+	for i := range ids {
+		err, id := s.Store("k"+strconv.Itoa(i), payload(i), FdNullFlags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id
+	}
+
+	var wg sync.WaitGroup
+	// writers store new objects, rolling over to new chunks, while the
+	// readers go over the first ones
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				n := 1000 + w*1000 + i
+				if err, _ := s.Store("k"+strconv.Itoa(n), payload(n), FdNullFlags); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				j := (r*7 + i) % len(ids)
+				err, _, f := s.Read(ids[j])
+				if err != nil || !bytes.Equal(f, payload(j)) {
+					t.Errorf("read of %d, %v", j, err)
+					return
+				}
+				err, f = s.ReadRange(ids[j], 2, 10)
+				if err != nil || !bytes.Equal(f, payload(j)[2:12]) {
+					t.Errorf("range of %d, %v", j, err)
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
 }
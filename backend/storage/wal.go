@@ -1 +1,396 @@
 package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	walFileName = "wal"
+	// crc32, length, type and sequence in front of every record
+	walFrameHeaderSize = 0 +
+		4 + 4 +
+		1 + 8 +
+		0
+	// a length above this can only come from a torn or garbage frame
+	walMaxRecordSize = 64 * 1024 * 1024
+	// entry sizes from before ids were hashes, replayed as crc32 ids
+	walStoreEntrySizeV1  = 4 + 8 + 8 + 4
+	walDeleteEntrySizeV1 = 4 + 8 + 4
+	// checkpoint once the log grows past this size
+	walCheckpointSize = 64 * 1024 * 1024
+
+	defaultWALBatchSize    = 64
+	defaultWALSyncInterval = 100 * time.Millisecond
+)
+
+// wal record types
+const (
+	walRecordStore  = 0x1 // intent to append a block and index it
+	walRecordCommit = 0x2 // the record of a sequence has fully applied
+	walRecordDelete = 0x3 // intent to flag a block deleted and tombstone it
+)
+
+// SyncPolicy tells when the write-ahead log is flushed to disk
+type SyncPolicy uint8
+
+const (
+	// fsync every record before the change it describes is made
+	SyncAlways SyncPolicy = iota
+	// fsync once every WALBatchSize records
+	SyncBatch
+	// fsync from the background every WALSyncInterval
+	SyncInterval
+)
+
+var errWALTorn = errors.New("torn wal record")
+
+// WAL is an append only log of storage operations, a Store logs its intent
+// before touching the chunk and the index, so a crash in between can be
+// rolled forward or back on the next Open
+type WAL struct {
+	path string
+	opts Options
+	w    *os.File
+	// last sequence handed out
+	seq uint64
+	// size of the valid part of the log
+	size int64
+	// records appended since the last fsync
+	pending int
+
+	done chan struct{}
+	wg   sync.WaitGroup
+	sync.Mutex
+}
+
+type walRecord struct {
+	typ  uint8
+	seq  uint64
+	data []byte
+}
+
+// payload of a walRecordStore
+type walStoreEntry struct {
+	chunk  uint32
+	offset int64
+	size   int64
+	fId    ObjectID
+}
+
+// payload of a walRecordDelete
+type walDeleteEntry struct {
+	chunk  uint32
+	offset int64
+	fId    ObjectID
+}
+
+func NewWAL(path string, opts Options) *WAL {
+	w := new(WAL)
+	w.path = path
+	opts.normalize()
+	w.opts = opts
+	return w
+}
+
+// Open opens or creates the log, a torn record at the tail is cut off
+func (w *WAL) Open() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if err := makeDir(w.path, w.opts.DirMode); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.path, os.O_RDWR|os.O_CREATE, w.opts.FileMode)
+	if err != nil {
+		return err
+	}
+	w.w = f
+
+	// find the end of the last complete record
+	r := bufio.NewReader(f)
+	for {
+		rec, err := readFrame(r)
+		if err == io.EOF || err == errWALTorn {
+			break
+		} else if err != nil {
+			f.Close()
+			return err
+		}
+		w.seq = rec.seq
+		w.size += walFrameHeaderSize + int64(len(rec.data))
+	}
+	if err := f.Truncate(w.size); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(w.size, 0); err != nil {
+		f.Close()
+		return err
+	}
+
+	if w.opts.WALSync == SyncInterval {
+		w.done = make(chan struct{})
+		w.wg.Add(1)
+		go w.syncLoop()
+	}
+	return nil
+}
+
+func (w *WAL) syncLoop() {
+	defer w.wg.Done()
+	t := time.NewTicker(w.opts.WALSyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			w.Lock()
+			if w.pending > 0 {
+				w.sync()
+			}
+			w.Unlock()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Append logs a record and flushes it according to the sync policy, commit
+// records are never waited on since replay checks the data they cover anyway
+func (w *WAL) Append(typ uint8, data []byte) (seq uint64, err error) {
+	seqs, err := w.AppendBatch(typ, [][]byte{data})
+	if err != nil {
+		return 0, err
+	}
+	return seqs[0], nil
+}
+
+// AppendBatch logs a record of the type for each data in one write, the
+// sync policy counts them as one
+func (w *WAL) AppendBatch(typ uint8, data [][]byte) (seqs []uint64, err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	var buf bytes.Buffer
+	seqs = make([]uint64, len(data))
+	for i, d := range data {
+		seqs[i] = w.seq + uint64(i) + 1
+		rec := walRecord{typ: typ, seq: seqs[i], data: d}
+		writeFrame(&buf, &rec)
+	}
+	n, err := w.w.Write(buf.Bytes())
+	if err != nil {
+		// drop whatever part of the frames made it to the file
+		w.w.Truncate(w.size)
+		w.w.Seek(w.size, 0)
+		return nil, err
+	}
+	w.seq += uint64(len(data))
+	w.size += int64(n)
+	w.pending++
+
+	if typ == walRecordCommit {
+		return seqs, nil
+	}
+	switch w.opts.WALSync {
+	case SyncAlways:
+		err = w.sync()
+	case SyncBatch:
+		if w.pending >= w.opts.WALBatchSize {
+			err = w.sync()
+		}
+	}
+	return seqs, err
+}
+
+// Sync flushes all appended records to disk
+func (w *WAL) Sync() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.sync()
+}
+
+func (w *WAL) sync() error {
+	if err := w.w.Sync(); err != nil {
+		return err
+	}
+	w.pending = 0
+	return nil
+}
+
+// Replay calls fn on every record of the log in order
+func (w *WAL) Replay(fn func(rec *walRecord) error) error {
+	w.Lock()
+	defer w.Unlock()
+
+	r := bufio.NewReader(io.NewSectionReader(w.w, 0, w.size))
+	for {
+		rec, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// Checkpoint empties the log, the caller must have flushed every chunk and
+// index change the records cover
+func (w *WAL) Checkpoint() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if err := w.w.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.w.Seek(0, 0); err != nil {
+		return err
+	}
+	w.size = 0
+	return w.sync()
+}
+
+// Size returns the size of the log in bytes
+func (w *WAL) Size() int64 {
+	w.Lock()
+	defer w.Unlock()
+	return w.size
+}
+
+func (w *WAL) Close() error {
+	if w.done != nil {
+		close(w.done)
+		w.wg.Wait()
+		w.done = nil
+	}
+	w.Lock()
+	defer w.Unlock()
+	if err := w.sync(); err != nil {
+		w.w.Close()
+		return err
+	}
+	return w.w.Close()
+}
+
+// a frame is crc32 | length | type | seq | data, the crc covers everything
+// behind itself
+func writeFrame(w io.Writer, rec *walRecord) (int64, error) {
+	buf := make([]byte, walFrameHeaderSize+len(rec.data))
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(rec.data)))
+	buf[8] = rec.typ
+	binary.BigEndian.PutUint64(buf[9:], rec.seq)
+	copy(buf[walFrameHeaderSize:], rec.data)
+	binary.BigEndian.PutUint32(buf[0:], crc32.ChecksumIEEE(buf[4:]))
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// read a frame, io.EOF at a clean end and errWALTorn for a partial or
+// damaged one
+func readFrame(r io.Reader) (*walRecord, error) {
+	h := make([]byte, walFrameHeaderSize)
+	if _, err := io.ReadFull(r, h); err == io.EOF {
+		return nil, io.EOF
+	} else if err == io.ErrUnexpectedEOF {
+		return nil, errWALTorn
+	} else if err != nil {
+		return nil, err
+	}
+	l := binary.BigEndian.Uint32(h[4:])
+	if l > walMaxRecordSize {
+		return nil, errWALTorn
+	}
+	rec := &walRecord{typ: h[8], seq: binary.BigEndian.Uint64(h[9:])}
+	rec.data = make([]byte, l)
+	if _, err := io.ReadFull(r, rec.data); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errWALTorn
+	} else if err != nil {
+		return nil, err
+	}
+
+	sum := crc32.NewIEEE()
+	sum.Write(h[4:])
+	sum.Write(rec.data)
+	if sum.Sum32() != binary.BigEndian.Uint32(h[0:]) {
+		return nil, errWALTorn
+	}
+	return rec, nil
+}
+
+func (e *walStoreEntry) bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, e.chunk)
+	binary.Write(&buf, binary.BigEndian, e.offset)
+	binary.Write(&buf, binary.BigEndian, e.size)
+	writeWALId(&buf, e.fId)
+	return buf.Bytes()
+}
+
+func readWALStoreEntry(data []byte) (e walStoreEntry, err error) {
+	r := bytes.NewReader(data)
+	if err := binary.Read(r, binary.BigEndian, &e.chunk); err != nil {
+		return e, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &e.offset); err != nil {
+		return e, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &e.size); err != nil {
+		return e, err
+	}
+	e.fId, err = readWALId(r, len(data) == walStoreEntrySizeV1)
+	return e, err
+}
+
+func (e *walDeleteEntry) bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, e.chunk)
+	binary.Write(&buf, binary.BigEndian, e.offset)
+	writeWALId(&buf, e.fId)
+	return buf.Bytes()
+}
+
+func readWALDeleteEntry(data []byte) (e walDeleteEntry, err error) {
+	r := bytes.NewReader(data)
+	if err := binary.Read(r, binary.BigEndian, &e.chunk); err != nil {
+		return e, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &e.offset); err != nil {
+		return e, err
+	}
+	e.fId, err = readWALId(r, len(data) == walDeleteEntrySizeV1)
+	return e, err
+}
+
+func writeWALId(buf *bytes.Buffer, id ObjectID) {
+	buf.WriteByte(byte(id.Algo))
+	buf.Write(id.Sum[:])
+}
+
+func readWALId(r io.Reader, v1 bool) (id ObjectID, err error) {
+	if v1 {
+		var crc uint32
+		err = binary.Read(r, binary.BigEndian, &crc)
+		return crc32Id(crc), err
+	}
+	if err := binary.Read(r, binary.BigEndian, &id.Algo); err != nil {
+		return id, err
+	}
+	_, err = io.ReadFull(r, id.Sum[:])
+	return id, err
+}
+
+func seqBytes(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// drop every handle without the checkpoint a Close does, as a crash would
+func crash(s *Storage) {
+	if s.wal.done != nil {
+		close(s.wal.done)
+		s.wal.wg.Wait()
+	}
+	s.wal.w.Close()
+	s.index.Close()
+	for _, c := range s.chunkMap {
+		c.Close()
+	}
+}
+
+func TestWAL_AppendReplay(t *testing.T) {
+	opts := tempOptions(t)
+	w := NewWAL(opts.WALPath, opts)
+	if err := w.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := w.Append(walRecordStore, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w = NewWAL(opts.WALPath, opts)
+	if err := w.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	i := 0
+	err := w.Replay(func(rec *walRecord) error {
+		if rec.seq != uint64(i+1) || !bytes.Equal(rec.data, []byte{byte(i)}) {
+			t.Fatalf("record %d: %#v", i, rec)
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 10 {
+		t.Fatalf("replayed %d records, want 10", i)
+	}
+	if seq, _ := w.Append(walRecordCommit, seqBytes(1)); seq != 11 {
+		t.Fatalf("seq %d after reopen, want 11", seq)
+	}
+}
+
+func TestWAL_TornTail(t *testing.T) {
+	opts := tempOptions(t)
+	opts.WALSync = SyncBatch
+	w := NewWAL(opts.WALPath, opts)
+	if err := w.Open(); err != nil {
+		t.Fatal(err)
+	}
+	w.Append(walRecordStore, []byte("first"))
+	w.Append(walRecordStore, []byte("second"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// lose the last bytes of the second record
+	fi, err := os.Stat(opts.WALPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(opts.WALPath, fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	w = NewWAL(opts.WALPath, opts)
+	if err := w.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	n := 0
+	w.Replay(func(rec *walRecord) error {
+		n++
+		return nil
+	})
+	if n != 1 {
+		t.Fatalf("replayed %d records, want 1", n)
+	}
+	if w.Size() != walFrameHeaderSize+int64(len("first")) {
+		t.Fatalf("torn tail not cut, size %d", w.Size())
+	}
+}
+
+func TestStorage_ReplayRollBack(t *testing.T) {
+	opts := tempOptions(t)
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := s.Store("a.txt", []byte("aaaa"), FdNullFlags); err != nil {
+		t.Fatal(err)
+	}
+	end := s.currChunk.maxOffset
+
+	// log a store and crash halfway through writing its block
+	bts := []byte("bbbbbbbb")
+	b := NewBlock()
+	b.SetBlock("b.txt", FdNullFlags, &bts)
+	e := walStoreEntry{chunk: 1, offset: end, size: b.OnDiskSize(), fId: b.ID()}
+	if _, err := s.wal.Append(walRecordStore, e.bytes()); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	b.WriteTo(&buf)
+	if _, err := s.currChunk.w.WriteAt(buf.Bytes()[:buf.Len()/2], end); err != nil {
+		t.Fatal(err)
+	}
+	crash(s)
+
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.currChunk.maxOffset != end {
+		t.Fatalf("max offset %d, want %d", s.currChunk.maxOffset, end)
+	}
+	if fi, _ := os.Stat(s.currChunk.path); fi.Size() != end {
+		t.Fatalf("torn block not cut, chunk size %d", fi.Size())
+	}
+	if find, _ := s.index.find(b.ID()); find {
+		t.Fatal("torn block is indexed")
+	}
+	if err, _, f := s.Read(HashSha256.Sum([]byte("aaaa"))); err != nil || string(f) != "aaaa" {
+		t.Fatalf("read a.txt: %v %q", err, f)
+	}
+}
+
+func TestStorage_ReplayRollForward(t *testing.T) {
+	opts := tempOptions(t)
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the block made it to the chunk but the crash hit before indexing
+	bts := []byte("bbbbbbbb")
+	b := NewBlock()
+	b.SetBlock("b.txt", FdNullFlags, &bts)
+	e := walStoreEntry{chunk: 1, offset: s.currChunk.maxOffset, size: b.OnDiskSize(), fId: b.ID()}
+	if _, err := s.wal.Append(walRecordStore, e.bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := s.currChunk.AppendBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	// the key did, an object without one would go with the replay
+	if _, err := s.names.put(NameEntry{Key: "b.txt", ID: b.ID(), Size: int64(len(bts))}); err != nil {
+		t.Fatal(err)
+	}
+	crash(s)
+
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err, name, f := s.Read(b.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "b.txt" || !bytes.Equal(f, bts) {
+		t.Fatalf("read %q %q", name, f)
+	}
+	if s.wal.Size() != 0 {
+		t.Fatalf("wal not checkpointed after replay, size %d", s.wal.Size())
+	}
+}
+
+func TestStorage_ReplayUnkeyed(t *testing.T) {
+	opts := tempOptions(t)
+	opts.PartSize = 1024
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	err, kept := s.Store("a.txt", []byte("aaaa"), FdNullFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a block and an object in parts are stored, the crash hits before
+	// their keys are put
+	bts := []byte("bbbb")
+	b := NewBlock()
+	b.SetBlock("b.txt", FdNullFlags, &bts)
+	if err := s.storeBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	large := bytes.Repeat([]byte("0123456789"), 300)
+	err, id := s.storeParts("c.txt", bytes.NewReader(large), int64(len(large)), FdNullFlags, CodecNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, m := s.readManifest(id)
+	if err != nil || m == nil {
+		t.Fatalf("manifest %v", err)
+	}
+	crash(s)
+
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, id := range []ObjectID{b.ID(), id, m.parts[0].id} {
+		if find, _ := s.index.find(id); find {
+			t.Fatalf("object %s without a key left", id)
+		}
+	}
+	if err, _, f := s.Read(kept); err != nil || string(f) != "aaaa" {
+		t.Fatalf("read a.txt: %v %q", err, f)
+	}
+}
+
+func TestStorage_ReplayDelete(t *testing.T) {
+	opts := tempOptions(t)
+	s := NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	bts := []byte("cccc")
+	if err, _ := s.Store("c.txt", bts, FdNullFlags); err != nil {
+		t.Fatal(err)
+	}
+	_, slot := s.index.find(HashSha256.Sum(bts))
+
+	// the delete is logged but the crash hits before it is applied
+	e := walDeleteEntry{chunk: slot.chunkFile, offset: slot.offset, fId: slot.fId}
+	if _, err := s.wal.Append(walRecordDelete, e.bytes()); err != nil {
+		t.Fatal(err)
+	}
+	crash(s)
+
+	s = NewStorage(opts)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err, _, _ := s.Read(slot.fId); err == nil {
+		t.Fatal("logged delete not replayed")
+	}
+}
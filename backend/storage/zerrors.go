@@ -8,7 +8,9 @@ const (
 	FdExecutable = 0x4  // can execute
 	FdIdMd5      = 0x8  // file id calculated by md5
 	FdIdCrc32    = 0x10 // file if calculated by crc32
-	FdFlag1      = 0x20 // reserved flag 1
-	FdFlag2      = 0x40 // reserved flag 2
+	FdIdSha256   = 0x18 // file id calculated by sha256
+	FdIdMask     = 0x18 // hash algorithm field of the file id
+	FdManifest   = 0x20 // manifest listing the parts of a large object
+	FdCompressed = 0x40 // payload compressed, led by its codec byte
 	FdFlag3      = 0x80 // reserved flag 3
 )
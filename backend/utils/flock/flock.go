@@ -0,0 +1,41 @@
+package flock
+
+import (
+	"errors"
+	"os"
+	"strconv"
+)
+
+// ErrLocked is returned when another process holds the lock
+var ErrLocked = errors.New("locked by another process")
+
+// Lock is an exclusive lock on a file, held until Unlock or until the
+// process dies
+type Lock struct {
+	f *os.File
+}
+
+// TryLockPid takes the lock on path and writes the pid of the process into
+// the file, it fails with ErrLocked at once instead of waiting
+func TryLockPid(path string) (*Lock, error) {
+	l, err := TryLock(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.f.Truncate(0); err != nil {
+		l.Unlock()
+		return nil, err
+	}
+	if _, err := l.f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		l.Unlock()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Unlock releases the lock, the file is emptied but left in place since
+// removing it would race another process opening it
+func (l *Lock) Unlock() error {
+	l.f.Truncate(0)
+	return l.f.Close()
+}
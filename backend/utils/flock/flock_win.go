@@ -0,0 +1,28 @@
+// +build windows
+
+package flock
+
+import (
+	"os"
+	"syscall"
+)
+
+// ERROR_SHARING_VIOLATION, missing from syscall
+const errorSharingViolation syscall.Errno = 32
+
+// TryLock takes the lock on path, the file is created if missing. The file
+// is opened without sharing, which keeps every other open out
+func TryLock(path string) (*Lock, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(p, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+		syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err == errorSharingViolation {
+		return nil, ErrLocked
+	} else if err != nil {
+		return nil, err
+	}
+	return &Lock{f: os.NewFile(uintptr(h), path)}, nil
+}
@@ -1 +1,8 @@
 module silOSS
+
+go 1.21
+
+require (
+	github.com/klauspost/compress v1.17.11
+	github.com/pierrec/lz4/v4 v4.1.21
+)